@@ -3,26 +3,28 @@ package main
 import (
 	"fmt"
 
+	"github.com/orktes/mongache/pkg/memstore"
 	"github.com/orktes/mongache/pkg/server"
-	"github.com/orktes/mongache/pkg/slice"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
 func main() {
-	s := server.Server{
-		Handler: func(collection string, q bson.M, fields bson.M) (server.Cursor, error) {
-			fmt.Printf("%s %+v\n", collection, q)
+	store := memstore.New()
 
-			data := make([]interface{}, 3000)
-			for i := 0; i < 3000; i++ {
-				data[i] = map[string]interface{}{
-					"foo": fmt.Sprintf("bar_%d", i),
-				}
-			}
-
-			return slice.NewCursor(data)
-		},
+	// Demo data queried by tests/index.js
+	data := make([]interface{}, 3000)
+	for i := 0; i < 3000; i++ {
+		data[i] = bson.M{
+			"foo": fmt.Sprintf("bar_%d", i),
+		}
+	}
+	if _, err := store.Database("sample_mflix").Collection("movies").Insert(data...); err != nil {
+		panic(err)
 	}
+
+	s := &server.Server{}
+	store.Register(s)
+
 	err := s.ListenAddr(":6666")
 	panic(err)
 }
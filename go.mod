@@ -3,8 +3,11 @@ module github.com/orktes/mongache
 go 1.14
 
 require (
+	github.com/golang/snappy v0.0.1
+	github.com/klauspost/compress v1.9.5
 	github.com/mongodb/mongo-tools-common v0.0.0-20190305192132-ff545c79e447
 	github.com/stretchr/testify v1.6.1
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c
 	go.mongodb.org/mongo-driver v1.4.3
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22 // indirect
 
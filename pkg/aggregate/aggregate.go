@@ -0,0 +1,173 @@
+// Package aggregate runs MongoDB aggregation pipelines over server cursors.
+package aggregate
+
+import (
+	"context"
+	"io"
+
+	"github.com/orktes/mongache/pkg/server"
+	"github.com/orktes/mongache/pkg/slice"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Source returns the documents of a collection, used by $lookup stages.
+type Source func(ctx context.Context, collection string) (server.Cursor, error)
+
+// env is shared by the stages of a single run of a pipeline.
+type env struct {
+	source      Source
+	collections map[string][]bson.Raw
+}
+
+// collection returns the documents of a collection read from the source.
+func (env *env) collection(ctx context.Context, name string) ([]bson.Raw, error) {
+	if docs, ok := env.collections[name]; ok {
+		return docs, nil
+	}
+	if env.source == nil {
+		return nil, server.Errorf(server.ErrorCodeCommandNotSupported, "$lookup is not supported without a source")
+	}
+
+	cur, err := env.source(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := readAll(ctx, cur)
+	if err != nil {
+		return nil, err
+	}
+	env.collections[name] = docs
+	return docs, nil
+}
+
+// Pipeline is a compiled aggregation pipeline.
+type Pipeline struct {
+	stages []stage
+	specs  []bson.Raw
+}
+
+// Compile compiles a pipeline given as an array of stage documents.
+func Compile(pipeline interface{}) (*Pipeline, error) {
+	b, err := bson.Marshal(bson.D{{Key: "pipeline", Value: pipeline}})
+	if err != nil {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "%s", err)
+	}
+	arr, ok := bson.Raw(b).Lookup("pipeline").ArrayOK()
+	if !ok {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "a pipeline must be an array")
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pipeline{}
+	for _, v := range values {
+		doc, ok := v.DocumentOK()
+		if !ok {
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "each element of the 'pipeline' array must be an object")
+		}
+		s, err := compileStage(doc)
+		if err != nil {
+			return nil, err
+		}
+		p.stages = append(p.stages, s)
+		p.specs = append(p.specs, doc)
+	}
+	return p, nil
+}
+
+// Run runs the pipeline over the documents of input, which it closes.
+// source is consulted for the collections of $lookup stages and may be nil.
+func (p *Pipeline) Run(ctx context.Context, input server.Cursor, source Source) (server.Cursor, error) {
+	docs, err := readAll(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err = p.run(ctx, docs, &env{source: source, collections: map[string][]bson.Raw{}})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([][]byte, len(docs))
+	for i, doc := range docs {
+		out[i] = doc
+	}
+	return slice.NewCursor(out)
+}
+
+func (p *Pipeline) run(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+	for _, s := range p.stages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var err error
+		if docs, err = s.run(ctx, docs, env); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// readAll reads and closes a cursor.
+func readAll(ctx context.Context, cur server.Cursor) ([]bson.Raw, error) {
+	defer cur.Close(ctx)
+
+	var docs []bson.Raw
+	for {
+		v, err := cur.Next(ctx)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch doc := v.(type) {
+		case bson.Raw:
+			docs = append(docs, doc)
+		case []byte:
+			docs = append(docs, doc)
+		default:
+			b, err := bson.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, b)
+		}
+	}
+}
+
+// Handler returns a server.AggregateHandler running pipelines over the
+// collections of find. The filter of a leading $match stage is passed to
+// find, which may use it to narrow the documents it returns; the stage still
+// runs over them.
+func Handler(find server.FindHandler) server.AggregateHandler {
+	return func(ctx context.Context, req *server.AggregateRequest) (server.Cursor, error) {
+		if req.Collection == "" {
+			return nil, server.Errorf(server.ErrorCodeCommandNotSupported, "aggregate: 1 is not supported by this server")
+		}
+		p, err := Compile(req.Pipeline)
+		if err != nil {
+			return nil, err
+		}
+
+		query := &server.FindRequest{Database: req.Database, Collection: req.Collection}
+		if len(p.specs) > 0 {
+			if filter, ok := p.specs[0].Lookup("$match").DocumentOK(); ok {
+				if err := bson.Unmarshal(filter, &query.Filter); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		input, err := find(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		return p.Run(ctx, input, func(ctx context.Context, collection string) (server.Cursor, error) {
+			return find(ctx, &server.FindRequest{Database: req.Database, Collection: collection})
+		})
+	}
+}
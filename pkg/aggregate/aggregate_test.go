@@ -0,0 +1,263 @@
+package aggregate_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/orktes/mongache/pkg/aggregate"
+	"github.com/orktes/mongache/pkg/server"
+	"github.com/orktes/mongache/pkg/slice"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var orders = []bson.M{
+	{"_id": int32(1), "item": "apple", "qty": int32(5), "price": 1.5, "tags": bson.A{"fruit", "red"}},
+	{"_id": int32(2), "item": "banana", "qty": int32(10), "price": 0.5, "tags": bson.A{"fruit"}},
+	{"_id": int32(3), "item": "carrot", "qty": int32(3), "price": 0.25, "tags": bson.A{}},
+	{"_id": int32(4), "item": "apple", "qty": int32(2), "price": 1.5},
+}
+
+var items = []bson.M{
+	{"_id": "apple", "color": "red"},
+	{"_id": "banana", "color": "yellow"},
+}
+
+func run(t *testing.T, docs interface{}, pipeline bson.A) []bson.M {
+	t.Helper()
+
+	p, err := aggregate.Compile(pipeline)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	input, err := slice.NewCursor(docs)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+
+	ctx := context.Background()
+	cur, err := p.Run(ctx, input, func(ctx context.Context, collection string) (server.Cursor, error) {
+		assert.Equal(t, "items", collection)
+		return slice.NewCursor(items)
+	})
+	if !assert.NoError(t, err) {
+		return nil
+	}
+
+	var out []bson.M
+	for {
+		v, err := cur.Next(ctx)
+		if err == io.EOF {
+			return out
+		}
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		var doc bson.M
+		assert.NoError(t, bson.Unmarshal(v.([]byte), &doc))
+		out = append(out, doc)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline bson.A
+		expected []bson.M
+	}{
+		{
+			"match sort skip limit",
+			bson.A{
+				bson.M{"$match": bson.M{"qty": bson.M{"$gte": 3}}},
+				bson.M{"$sort": bson.D{{Key: "qty", Value: -1}}},
+				bson.M{"$skip": 1},
+				bson.M{"$limit": 1},
+				bson.M{"$project": bson.M{"item": 1}},
+			},
+			[]bson.M{{"_id": int32(1), "item": "apple"}},
+		},
+		{
+			"project computed and exclusion",
+			bson.A{
+				bson.M{"$match": bson.M{"_id": 1}},
+				bson.M{"$project": bson.D{
+					{Key: "_id", Value: 0},
+					{Key: "item", Value: bson.M{"$toUpper": "$item"}},
+					{Key: "total", Value: bson.M{"$multiply": bson.A{"$qty", "$price"}}},
+				}},
+			},
+			[]bson.M{{"item": "APPLE", "total": 7.5}},
+		},
+		{
+			"addFields and unset",
+			bson.A{
+				bson.M{"$match": bson.M{"_id": 2}},
+				bson.M{"$set": bson.M{"info.cheap": bson.M{"$lt": bson.A{"$price", 1}}}},
+				bson.M{"$unset": bson.A{"tags", "price", "qty"}},
+			},
+			[]bson.M{{"_id": int32(2), "item": "banana", "info": bson.M{"cheap": true}}},
+		},
+		{
+			"group",
+			bson.A{
+				bson.M{"$group": bson.D{
+					{Key: "_id", Value: "$item"},
+					{Key: "qty", Value: bson.M{"$sum": "$qty"}},
+					{Key: "n", Value: bson.M{"$sum": 1}},
+					{Key: "avg", Value: bson.M{"$avg": "$qty"}},
+					{Key: "max", Value: bson.M{"$max": "$qty"}},
+					{Key: "ids", Value: bson.M{"$push": "$_id"}},
+					{Key: "prices", Value: bson.M{"$addToSet": "$price"}},
+					{Key: "first", Value: bson.M{"$first": "$_id"}},
+					{Key: "last", Value: bson.M{"$last": "$_id"}},
+				}},
+				bson.M{"$match": bson.M{"_id": "apple"}},
+			},
+			[]bson.M{{
+				"_id": "apple", "qty": int32(7), "n": int32(2), "avg": 3.5, "max": int32(5),
+				"ids": bson.A{int32(1), int32(4)}, "prices": bson.A{1.5}, "first": int32(1), "last": int32(4),
+			}},
+		},
+		{
+			"unwind",
+			bson.A{
+				bson.M{"$unwind": bson.M{"path": "$tags", "includeArrayIndex": "i", "preserveNullAndEmptyArrays": true}},
+				bson.M{"$project": bson.M{"tags": 1, "i": 1}},
+			},
+			[]bson.M{
+				{"_id": int32(1), "tags": "fruit", "i": int64(0)},
+				{"_id": int32(1), "tags": "red", "i": int64(1)},
+				{"_id": int32(2), "tags": "fruit", "i": int64(0)},
+				{"_id": int32(3), "i": nil},
+				{"_id": int32(4), "i": nil},
+			},
+		},
+		{
+			"count",
+			bson.A{
+				bson.M{"$unwind": "$tags"},
+				bson.M{"$count": "n"},
+			},
+			[]bson.M{{"n": int32(3)}},
+		},
+		{
+			"count nothing",
+			bson.A{
+				bson.M{"$match": bson.M{"qty": 100}},
+				bson.M{"$count": "n"},
+			},
+			nil,
+		},
+		{
+			"lookup",
+			bson.A{
+				bson.M{"$match": bson.M{"_id": bson.M{"$in": bson.A{2, 3}}}},
+				bson.M{"$lookup": bson.M{"from": "items", "localField": "item", "foreignField": "_id", "as": "item"}},
+				bson.M{"$project": bson.M{"item": 1}},
+			},
+			[]bson.M{
+				{"_id": int32(2), "item": bson.A{bson.M{"_id": "banana", "color": "yellow"}}},
+				{"_id": int32(3), "item": bson.A{}},
+			},
+		},
+		{
+			"lookup pipeline",
+			bson.A{
+				bson.M{"$limit": 1},
+				bson.M{"$lookup": bson.M{"from": "items", "pipeline": bson.A{bson.M{"$match": bson.M{"color": "red"}}}, "as": "red"}},
+				bson.M{"$project": bson.M{"red._id": 1}},
+			},
+			[]bson.M{{"_id": int32(1), "red": bson.A{bson.M{"_id": "apple"}}}},
+		},
+		{
+			"facet",
+			bson.A{
+				bson.M{"$facet": bson.D{
+					{Key: "total", Value: bson.A{bson.M{"$count": "n"}}},
+					{Key: "cheapest", Value: bson.A{
+						bson.M{"$sort": bson.M{"price": 1}},
+						bson.M{"$limit": 1},
+						bson.M{"$project": bson.M{"_id": 0, "item": 1}},
+					}},
+				}},
+			},
+			[]bson.M{{"total": bson.A{bson.M{"n": int32(4)}}, "cheapest": bson.A{bson.M{"item": "carrot"}}}},
+		},
+		{
+			"expressions",
+			bson.A{
+				bson.M{"$match": bson.M{"_id": 3}},
+				bson.M{"$project": bson.D{
+					{Key: "size", Value: bson.M{"$size": "$tags"}},
+					{Key: "label", Value: bson.M{"$concat": bson.A{"$item", "-", bson.M{"$toLower": "X"}}}},
+					{Key: "kind", Value: bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$qty", 2}}, "many", "few"}}},
+					{Key: "color", Value: bson.M{"$ifNull": bson.A{"$color", "none"}}},
+					{Key: "half", Value: bson.M{"$divide": bson.A{"$qty", 2}}},
+					{Key: "rest", Value: bson.M{"$mod": bson.A{"$qty", 2}}},
+				}},
+			},
+			[]bson.M{{"_id": int32(3), "size": int32(0), "label": "carrot-x", "kind": "many", "color": "none", "half": 1.5, "rest": int32(1)}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, run(t, orders, test.pipeline))
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, pipeline := range []bson.A{
+		{bson.M{"$bogus": 1}},
+		{bson.D{{Key: "$match", Value: bson.M{}}, {Key: "$limit", Value: 1}}},
+		{bson.M{"$limit": 0}},
+		{bson.M{"$sort": bson.M{"a": 2}}},
+		{bson.M{"$project": bson.M{"a": 1, "b": 0}}},
+		{bson.M{"$unwind": "tags"}},
+		{bson.M{"$group": bson.M{"n": bson.M{"$sum": 1}}}},
+		{bson.M{"$lookup": bson.M{"from": "items", "as": "x"}}},
+		{"$match"},
+	} {
+		_, err := aggregate.Compile(pipeline)
+		if assert.Error(t, err, "%v", pipeline) {
+			assert.Equal(t, server.ErrorCodeFailedToParse, err.(*server.Error).Code, "%v", pipeline)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var filters []bson.M
+	handler := aggregate.Handler(func(ctx context.Context, req *server.FindRequest) (server.Cursor, error) {
+		assert.Equal(t, "foo", req.Database)
+		filters = append(filters, req.Filter)
+		// The filter is a hint only: every document is returned
+		if req.Collection == "items" {
+			return slice.NewCursor(items)
+		}
+		return slice.NewCursor(orders)
+	})
+
+	ctx := context.Background()
+	pipeline, _ := bson.Marshal(bson.M{"$match": bson.M{"item": "apple"}})
+	cur, err := handler(ctx, &server.AggregateRequest{Database: "foo", Collection: "orders", Pipeline: []bson.Raw{pipeline}})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var ids []int32
+	for {
+		v, err := cur.Next(ctx)
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		ids = append(ids, bson.Raw(v.([]byte)).Lookup("_id").Int32())
+	}
+	assert.Equal(t, []int32{1, 4}, ids)
+	assert.Equal(t, []bson.M{{"item": "apple"}}, filters)
+
+	_, err = handler(ctx, &server.AggregateRequest{Database: "foo", Pipeline: []bson.Raw{pipeline}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,591 @@
+package aggregate
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/orktes/mongache/pkg/match"
+	"github.com/orktes/mongache/pkg/server"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// expression is a compiled aggregation expression. Evaluating to a zero
+// RawValue means the value is missing.
+type expression interface {
+	eval(doc bson.Raw) (bson.RawValue, error)
+}
+
+type literal bson.RawValue
+
+func (e literal) eval(doc bson.Raw) (bson.RawValue, error) {
+	return bson.RawValue(e), nil
+}
+
+// fieldPath is a "$a.b" path in the current document.
+type fieldPath []string
+
+func (e fieldPath) eval(doc bson.Raw) (bson.RawValue, error) {
+	return lookupPath(bson.RawValue{Type: bsontype.EmbeddedDocument, Value: doc}, e), nil
+}
+
+// lookupPath returns the value of a path. Arrays on the path are mapped to
+// the values of the rest of the path in their document elements.
+func lookupPath(v bson.RawValue, path []string) bson.RawValue {
+	for i, key := range path {
+		switch v.Type {
+		case bsontype.EmbeddedDocument:
+			var err error
+			if v, err = v.Document().LookupErr(key); err != nil {
+				return bson.RawValue{}
+			}
+		case bsontype.Array:
+			elems, _ := v.Array().Values()
+			out := bson.A{}
+			for _, elem := range elems {
+				if elem.Type != bsontype.EmbeddedDocument {
+					continue
+				}
+				if r := lookupPath(elem, path[i:]); r.Type != 0 {
+					out = append(out, r)
+				}
+			}
+			return value(out)
+		default:
+			return bson.RawValue{}
+		}
+	}
+	return v
+}
+
+type objectField struct {
+	name string
+	expr expression
+}
+
+// object builds a document from expressions. Missing values are left out.
+type object []objectField
+
+func (e object) eval(doc bson.Raw) (bson.RawValue, error) {
+	d := bson.D{}
+	for _, field := range e {
+		v, err := field.expr.eval(doc)
+		if err != nil {
+			return bson.RawValue{}, err
+		}
+		if v.Type != 0 {
+			d = append(d, bson.E{Key: field.name, Value: v})
+		}
+	}
+	return value(d), nil
+}
+
+// array builds an array from expressions. Missing values are null.
+type array []expression
+
+func (e array) eval(doc bson.Raw) (bson.RawValue, error) {
+	values, err := evalAll(e, doc)
+	if err != nil {
+		return bson.RawValue{}, err
+	}
+	out := make(bson.A, len(values))
+	for i, v := range values {
+		out[i] = orNull(v)
+	}
+	return value(out), nil
+}
+
+// operator applies an expression operator to the values of its arguments.
+type operator struct {
+	name string
+	args []expression
+	fn   func(args []bson.RawValue) (bson.RawValue, error)
+}
+
+func (e *operator) eval(doc bson.Raw) (bson.RawValue, error) {
+	args, err := evalAll(e.args, doc)
+	if err != nil {
+		return bson.RawValue{}, err
+	}
+	return e.fn(args)
+}
+
+// lazy is an operator evaluating its arguments itself, such as $cond.
+type lazy struct {
+	args []expression
+	fn   func(doc bson.Raw, args []expression) (bson.RawValue, error)
+}
+
+func (e *lazy) eval(doc bson.Raw) (bson.RawValue, error) {
+	return e.fn(doc, e.args)
+}
+
+func evalAll(exprs []expression, doc bson.Raw) ([]bson.RawValue, error) {
+	values := make([]bson.RawValue, len(exprs))
+	for i, expr := range exprs {
+		v, err := expr.eval(doc)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// value returns a Go value as a bson.RawValue.
+func value(v interface{}) bson.RawValue {
+	if rv, ok := v.(bson.RawValue); ok {
+		return rv
+	}
+	b, err := bson.Marshal(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return bson.RawValue{}
+	}
+	return bson.Raw(b).Lookup("v")
+}
+
+func orNull(v bson.RawValue) bson.RawValue {
+	if v.Type == 0 {
+		return value(nil)
+	}
+	return v
+}
+
+func isNullish(v bson.RawValue) bool {
+	return v.Type == 0 || v.Type == bsontype.Null || v.Type == bsontype.Undefined
+}
+
+// truthy tells if a value is true in a boolean context.
+func truthy(v bson.RawValue) bool {
+	switch v.Type {
+	case 0, bsontype.Null, bsontype.Undefined:
+		return false
+	case bsontype.Boolean:
+		return v.Boolean()
+	}
+	if v.IsNumber() {
+		return toFloat(v) != 0
+	}
+	return true
+}
+
+// compileExpression compiles an aggregation expression.
+func compileExpression(v bson.RawValue) (expression, error) {
+	switch v.Type {
+	case bsontype.String:
+		s := v.StringValue()
+		switch {
+		case s == "$$ROOT" || s == "$$CURRENT":
+			return fieldPath(nil), nil
+		case strings.HasPrefix(s, "$$ROOT.") || strings.HasPrefix(s, "$$CURRENT."):
+			return fieldPath(strings.Split(s, ".")[1:]), nil
+		case strings.HasPrefix(s, "$$"):
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "Use of undefined variable: %s", s[2:])
+		case strings.HasPrefix(s, "$"):
+			if len(s) == 1 {
+				return nil, server.Errorf(server.ErrorCodeFailedToParse, "'$' by itself is not a valid FieldPath")
+			}
+			return fieldPath(strings.Split(s[1:], ".")), nil
+		}
+	case bsontype.Array:
+		elems, err := v.Array().Values()
+		if err != nil {
+			return nil, err
+		}
+		exprs := make(array, len(elems))
+		for i, elem := range elems {
+			if exprs[i], err = compileExpression(elem); err != nil {
+				return nil, err
+			}
+		}
+		return exprs, nil
+	case bsontype.EmbeddedDocument:
+		elems, err := v.Document().Elements()
+		if err != nil {
+			return nil, err
+		}
+		if len(elems) > 0 && strings.HasPrefix(elems[0].Key(), "$") {
+			if len(elems) != 1 {
+				return nil, server.Errorf(server.ErrorCodeFailedToParse, "an expression specification must contain exactly one field, the name of the expression")
+			}
+			return compileOperator(elems[0].Key(), elems[0].Value())
+		}
+
+		obj := make(object, len(elems))
+		for i, elem := range elems {
+			if strings.HasPrefix(elem.Key(), "$") {
+				return nil, server.Errorf(server.ErrorCodeFailedToParse, "field names may not start with '$': %s", elem.Key())
+			}
+			expr, err := compileExpression(elem.Value())
+			if err != nil {
+				return nil, err
+			}
+			obj[i] = objectField{name: elem.Key(), expr: expr}
+		}
+		return obj, nil
+	}
+	return literal(v), nil
+}
+
+// operatorArgs compiles the arguments of an operator: the elements of an
+// array, or a single argument.
+func operatorArgs(v bson.RawValue) ([]expression, error) {
+	if v.Type != bsontype.Array {
+		expr, err := compileExpression(v)
+		if err != nil {
+			return nil, err
+		}
+		return []expression{expr}, nil
+	}
+
+	expr, err := compileExpression(v)
+	if err != nil {
+		return nil, err
+	}
+	return expr.(array), nil
+}
+
+type operatorFunc func(args []bson.RawValue) (bson.RawValue, error)
+
+// operators are the expression operators evaluated from the values of their
+// arguments, and the number of arguments they take, -1 for any.
+var operators = map[string]struct {
+	nargs int
+	fn    operatorFunc
+}{
+	"$add":         {-1, add},
+	"$subtract":    {2, subtract},
+	"$multiply":    {-1, multiply},
+	"$divide":      {2, divide},
+	"$mod":         {2, mod},
+	"$concat":      {-1, concat},
+	"$toLower":     {1, stringCase(strings.ToLower)},
+	"$toUpper":     {1, stringCase(strings.ToUpper)},
+	"$size":        {1, size},
+	"$arrayElemAt": {2, arrayElemAt},
+	"$in":          {2, in},
+	"$not":         {1, not},
+	"$cmp":         {2, comparison(func(c int) interface{} { return int32(c) })},
+	"$eq":          {2, comparison(func(c int) interface{} { return c == 0 })},
+	"$ne":          {2, comparison(func(c int) interface{} { return c != 0 })},
+	"$gt":          {2, comparison(func(c int) interface{} { return c > 0 })},
+	"$gte":         {2, comparison(func(c int) interface{} { return c >= 0 })},
+	"$lt":          {2, comparison(func(c int) interface{} { return c < 0 })},
+	"$lte":         {2, comparison(func(c int) interface{} { return c <= 0 })},
+	"$sum":         {-1, overValues(accumulateSum)},
+	"$avg":         {-1, overValues(accumulateAvg)},
+	"$min":         {-1, overValues(accumulateMin)},
+	"$max":         {-1, overValues(accumulateMax)},
+}
+
+func compileOperator(name string, arg bson.RawValue) (expression, error) {
+	switch name {
+	case "$literal":
+		return literal(arg), nil
+	case "$cond":
+		return compileCond(arg)
+	case "$ifNull":
+		args, err := operatorArgs(arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) < 2 {
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "$ifNull needs at least two arguments")
+		}
+		return &lazy{args: args, fn: ifNull}, nil
+	case "$and", "$or":
+		args, err := operatorArgs(arg)
+		if err != nil {
+			return nil, err
+		}
+		return &lazy{args: args, fn: logical(name == "$and")}, nil
+	}
+
+	op, ok := operators[name]
+	if !ok {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "Unrecognized expression '%s'", name)
+	}
+	args, err := operatorArgs(arg)
+	if err != nil {
+		return nil, err
+	}
+	if op.nargs >= 0 && len(args) != op.nargs {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "Expression %s takes exactly %d arguments. %d were passed in.", name, op.nargs, len(args))
+	}
+	return &operator{name: name, args: args, fn: op.fn}, nil
+}
+
+func compileCond(arg bson.RawValue) (expression, error) {
+	var args []expression
+	if doc, ok := arg.DocumentOK(); ok {
+		for _, key := range []string{"if", "then", "else"} {
+			v, err := doc.LookupErr(key)
+			if err != nil {
+				return nil, server.Errorf(server.ErrorCodeFailedToParse, "Missing '%s' parameter to $cond", key)
+			}
+			expr, err := compileExpression(v)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, expr)
+		}
+	} else {
+		var err error
+		if args, err = operatorArgs(arg); err != nil {
+			return nil, err
+		}
+		if len(args) != 3 {
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "Expression $cond takes exactly 3 arguments. %d were passed in.", len(args))
+		}
+	}
+
+	return &lazy{args: args, fn: func(doc bson.Raw, args []expression) (bson.RawValue, error) {
+		cond, err := args[0].eval(doc)
+		if err != nil {
+			return bson.RawValue{}, err
+		}
+		if truthy(cond) {
+			return args[1].eval(doc)
+		}
+		return args[2].eval(doc)
+	}}, nil
+}
+
+func ifNull(doc bson.Raw, args []expression) (bson.RawValue, error) {
+	for _, arg := range args[:len(args)-1] {
+		v, err := arg.eval(doc)
+		if err != nil || !isNullish(v) {
+			return v, err
+		}
+	}
+	return args[len(args)-1].eval(doc)
+}
+
+func logical(and bool) func(doc bson.Raw, args []expression) (bson.RawValue, error) {
+	return func(doc bson.Raw, args []expression) (bson.RawValue, error) {
+		for _, arg := range args {
+			v, err := arg.eval(doc)
+			if err != nil {
+				return bson.RawValue{}, err
+			}
+			if truthy(v) != and {
+				return value(!and), nil
+			}
+		}
+		return value(and), nil
+	}
+}
+
+func not(args []bson.RawValue) (bson.RawValue, error) {
+	return value(!truthy(args[0])), nil
+}
+
+func comparison(result func(c int) interface{}) operatorFunc {
+	return func(args []bson.RawValue) (bson.RawValue, error) {
+		return value(result(match.Compare(args[0], args[1]))), nil
+	}
+}
+
+func toFloat(v bson.RawValue) float64 {
+	switch v.Type {
+	case bsontype.Int32:
+		return float64(v.Int32())
+	case bsontype.Int64:
+		return float64(v.Int64())
+	case bsontype.Double:
+		return v.Double()
+	case bsontype.Decimal128:
+		f, _ := strconv.ParseFloat(v.Decimal128().String(), 64)
+		return f
+	}
+	return 0
+}
+
+func toInt(v bson.RawValue) int64 {
+	switch v.Type {
+	case bsontype.Int32:
+		return int64(v.Int32())
+	case bsontype.Int64:
+		return v.Int64()
+	}
+	return int64(toFloat(v))
+}
+
+// number returns a sum or product of integers as the narrowest type
+// holding it.
+func number(n int64, isInt32 bool) bson.RawValue {
+	if isInt32 && n >= math.MinInt32 && n <= math.MaxInt32 {
+		return value(int32(n))
+	}
+	return value(n)
+}
+
+// arithmetic folds numbers, as integers while all of them are, nulls
+// making the result null.
+func arithmetic(name string, args []bson.RawValue, intOp func(a, b int64) int64, floatOp func(a, b float64) float64) (bson.RawValue, error) {
+	isInt32, isInt := true, true
+	for _, arg := range args {
+		if isNullish(arg) {
+			return value(nil), nil
+		}
+		if !arg.IsNumber() {
+			return bson.RawValue{}, server.Errorf(server.ErrorCodeTypeMismatch, "%s only supports numeric types, not %s", name, arg.Type)
+		}
+		isInt32 = isInt32 && arg.Type == bsontype.Int32
+		isInt = isInt && (arg.Type == bsontype.Int32 || arg.Type == bsontype.Int64)
+	}
+	if len(args) == 0 {
+		return value(int32(0)), nil
+	}
+
+	if isInt {
+		n := toInt(args[0])
+		for _, arg := range args[1:] {
+			n = intOp(n, toInt(arg))
+		}
+		return number(n, isInt32), nil
+	}
+	f := toFloat(args[0])
+	for _, arg := range args[1:] {
+		f = floatOp(f, toFloat(arg))
+	}
+	return value(f), nil
+}
+
+func add(args []bson.RawValue) (bson.RawValue, error) {
+	return arithmetic("$add", args, func(a, b int64) int64 { return a + b }, func(a, b float64) float64 { return a + b })
+}
+
+func subtract(args []bson.RawValue) (bson.RawValue, error) {
+	return arithmetic("$subtract", args, func(a, b int64) int64 { return a - b }, func(a, b float64) float64 { return a - b })
+}
+
+func multiply(args []bson.RawValue) (bson.RawValue, error) {
+	if len(args) == 0 {
+		return value(int32(1)), nil
+	}
+	return arithmetic("$multiply", args, func(a, b int64) int64 { return a * b }, func(a, b float64) float64 { return a * b })
+}
+
+func divide(args []bson.RawValue) (bson.RawValue, error) {
+	if args[1].IsNumber() && toFloat(args[1]) == 0 {
+		return bson.RawValue{}, server.Errorf(server.ErrorCodeBadValue, "can't $divide by zero")
+	}
+	// Integers are divided as doubles
+	floats := make([]bson.RawValue, len(args))
+	for i, arg := range args {
+		floats[i] = arg
+		if arg.Type == bsontype.Int32 || arg.Type == bsontype.Int64 {
+			floats[i] = value(toFloat(arg))
+		}
+	}
+	return arithmetic("$divide", floats, nil, func(a, b float64) float64 { return a / b })
+}
+
+func mod(args []bson.RawValue) (bson.RawValue, error) {
+	if args[1].IsNumber() && toFloat(args[1]) == 0 {
+		return bson.RawValue{}, server.Errorf(server.ErrorCodeBadValue, "can't $mod by zero")
+	}
+	return arithmetic("$mod", args, func(a, b int64) int64 { return a % b }, math.Mod)
+}
+
+func concat(args []bson.RawValue) (bson.RawValue, error) {
+	var sb strings.Builder
+	for _, arg := range args {
+		if isNullish(arg) {
+			return value(nil), nil
+		}
+		s, ok := arg.StringValueOK()
+		if !ok {
+			return bson.RawValue{}, server.Errorf(server.ErrorCodeTypeMismatch, "$concat only supports strings, not %s", arg.Type)
+		}
+		sb.WriteString(s)
+	}
+	return value(sb.String()), nil
+}
+
+func stringCase(fn func(string) string) operatorFunc {
+	return func(args []bson.RawValue) (bson.RawValue, error) {
+		if isNullish(args[0]) {
+			return value(""), nil
+		}
+		s, ok := args[0].StringValueOK()
+		if !ok {
+			return bson.RawValue{}, server.Errorf(server.ErrorCodeTypeMismatch, "can't convert %s to a string", args[0].Type)
+		}
+		return value(fn(s)), nil
+	}
+}
+
+func size(args []bson.RawValue) (bson.RawValue, error) {
+	arr, ok := args[0].ArrayOK()
+	if !ok {
+		return bson.RawValue{}, server.Errorf(server.ErrorCodeTypeMismatch, "The argument to $size must be an array. Type of the argument was %s", args[0].Type)
+	}
+	elems, err := arr.Values()
+	return value(int32(len(elems))), err
+}
+
+func arrayElemAt(args []bson.RawValue) (bson.RawValue, error) {
+	if isNullish(args[0]) || isNullish(args[1]) {
+		return value(nil), nil
+	}
+	arr, ok := args[0].ArrayOK()
+	if !ok || !args[1].IsNumber() {
+		return bson.RawValue{}, server.Errorf(server.ErrorCodeTypeMismatch, "$arrayElemAt takes an array and a numeric index")
+	}
+	elems, err := arr.Values()
+	if err != nil {
+		return bson.RawValue{}, err
+	}
+	i := int(toInt(args[1]))
+	if i < 0 {
+		i += len(elems)
+	}
+	if i < 0 || i >= len(elems) {
+		return bson.RawValue{}, nil
+	}
+	return elems[i], nil
+}
+
+func in(args []bson.RawValue) (bson.RawValue, error) {
+	arr, ok := args[1].ArrayOK()
+	if !ok {
+		return bson.RawValue{}, server.Errorf(server.ErrorCodeTypeMismatch, "$in requires an array as a second argument, found: %s", args[1].Type)
+	}
+	elems, err := arr.Values()
+	if err != nil {
+		return bson.RawValue{}, err
+	}
+	for _, elem := range elems {
+		if match.Equal(elem, args[0]) {
+			return value(true), nil
+		}
+	}
+	return value(false), nil
+}
+
+// overValues evaluates an accumulator over the elements of a single array
+// argument, or over the arguments.
+func overValues(newAcc func() accumulator) operatorFunc {
+	return func(args []bson.RawValue) (bson.RawValue, error) {
+		if len(args) == 1 && args[0].Type == bsontype.Array {
+			var err error
+			if args, err = args[0].Array().Values(); err != nil {
+				return bson.RawValue{}, err
+			}
+		}
+
+		acc := newAcc()
+		for _, arg := range args {
+			if arg.Type == bsontype.Array {
+				continue
+			}
+			if err := acc.add(arg); err != nil {
+				return bson.RawValue{}, err
+			}
+		}
+		return acc.result(), nil
+	}
+}
@@ -0,0 +1,280 @@
+package aggregate
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/orktes/mongache/pkg/match"
+	"github.com/orktes/mongache/pkg/server"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// accumulator computes a value from the values of the documents of a group.
+type accumulator interface {
+	add(v bson.RawValue) error
+	result() bson.RawValue
+}
+
+var accumulators = map[string]func() accumulator{
+	"$sum":      accumulateSum,
+	"$avg":      accumulateAvg,
+	"$min":      accumulateMin,
+	"$max":      accumulateMax,
+	"$push":     func() accumulator { return &pushAccumulator{values: bson.A{}} },
+	"$addToSet": func() accumulator { return &pushAccumulator{values: bson.A{}, unique: true} },
+	"$first":    func() accumulator { return &firstAccumulator{} },
+	"$last":     func() accumulator { return &lastAccumulator{} },
+}
+
+// sumAccumulator sums numbers, ignoring other values.
+type sumAccumulator struct {
+	isInt32, isInt bool
+	i              int64
+	f              float64
+	n              int
+}
+
+func accumulateSum() accumulator {
+	return &sumAccumulator{isInt32: true, isInt: true}
+}
+
+func (acc *sumAccumulator) add(v bson.RawValue) error {
+	if !v.IsNumber() {
+		return nil
+	}
+	acc.n++
+	acc.isInt32 = acc.isInt32 && v.Type == bson.TypeInt32
+	acc.isInt = acc.isInt && (v.Type == bson.TypeInt32 || v.Type == bson.TypeInt64)
+	acc.i += toInt(v)
+	acc.f += toFloat(v)
+	return nil
+}
+
+func (acc *sumAccumulator) result() bson.RawValue {
+	if acc.isInt {
+		return number(acc.i, acc.isInt32)
+	}
+	return value(acc.f)
+}
+
+// avgAccumulator averages numbers, ignoring other values.
+type avgAccumulator struct {
+	sum float64
+	n   int
+}
+
+func accumulateAvg() accumulator {
+	return &avgAccumulator{}
+}
+
+func (acc *avgAccumulator) add(v bson.RawValue) error {
+	if v.IsNumber() {
+		acc.sum += toFloat(v)
+		acc.n++
+	}
+	return nil
+}
+
+func (acc *avgAccumulator) result() bson.RawValue {
+	if acc.n == 0 {
+		return value(nil)
+	}
+	return value(acc.sum / float64(acc.n))
+}
+
+// extremeAccumulator keeps the smallest or largest value, ignoring nulls.
+type extremeAccumulator struct {
+	max   bool
+	value bson.RawValue
+}
+
+func accumulateMin() accumulator {
+	return &extremeAccumulator{}
+}
+
+func accumulateMax() accumulator {
+	return &extremeAccumulator{max: true}
+}
+
+func (acc *extremeAccumulator) add(v bson.RawValue) error {
+	if isNullish(v) {
+		return nil
+	}
+	c := match.Compare(v, acc.value)
+	if acc.value.Type == 0 || (acc.max && c > 0) || (!acc.max && c < 0) {
+		acc.value = v
+	}
+	return nil
+}
+
+func (acc *extremeAccumulator) result() bson.RawValue {
+	return orNull(acc.value)
+}
+
+// pushAccumulator collects values, or distinct values when unique.
+type pushAccumulator struct {
+	values bson.A
+	unique bool
+}
+
+func (acc *pushAccumulator) add(v bson.RawValue) error {
+	if v.Type == 0 {
+		return nil
+	}
+	if acc.unique {
+		for _, other := range acc.values {
+			if match.Equal(other.(bson.RawValue), v) {
+				return nil
+			}
+		}
+	}
+	acc.values = append(acc.values, v)
+	return nil
+}
+
+func (acc *pushAccumulator) result() bson.RawValue {
+	return value(acc.values)
+}
+
+type firstAccumulator struct {
+	value bson.RawValue
+	set   bool
+}
+
+func (acc *firstAccumulator) add(v bson.RawValue) error {
+	if !acc.set {
+		acc.value, acc.set = v, true
+	}
+	return nil
+}
+
+func (acc *firstAccumulator) result() bson.RawValue {
+	return orNull(acc.value)
+}
+
+type lastAccumulator struct {
+	value bson.RawValue
+}
+
+func (acc *lastAccumulator) add(v bson.RawValue) error {
+	acc.value = v
+	return nil
+}
+
+func (acc *lastAccumulator) result() bson.RawValue {
+	return orNull(acc.value)
+}
+
+type groupField struct {
+	name   string
+	newAcc func() accumulator
+	expr   expression
+}
+
+// groupStage is a $group stage.
+type groupStage struct {
+	id     expression
+	fields []groupField
+}
+
+func compileGroup(spec bson.RawValue) (stage, error) {
+	doc, ok := spec.DocumentOK()
+	if !ok {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "a group's fields must be specified in an object")
+	}
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &groupStage{}
+	for _, elem := range elems {
+		if elem.Key() == "_id" {
+			if g.id, err = compileExpression(elem.Value()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		accDoc, ok := elem.Value().DocumentOK()
+		accElems, _ := accDoc.Elements()
+		if !ok || len(accElems) != 1 {
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "The field '%s' must be an accumulator object", elem.Key())
+		}
+		newAcc, ok := accumulators[accElems[0].Key()]
+		if !ok {
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "unknown group operator '%s'", accElems[0].Key())
+		}
+		expr, err := compileExpression(accElems[0].Value())
+		if err != nil {
+			return nil, err
+		}
+		g.fields = append(g.fields, groupField{name: elem.Key(), newAcc: newAcc, expr: expr})
+	}
+	if g.id == nil {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "a group specification must include an _id")
+	}
+	return g, nil
+}
+
+// groupKey returns a key equal for the values MongoDB groups together.
+func groupKey(v bson.RawValue) string {
+	switch {
+	case isNullish(v):
+		return "null"
+	case v.IsNumber():
+		return "n" + strconv.FormatFloat(toFloat(v), 'g', -1, 64)
+	}
+	return string(rune(v.Type)) + string(v.Value)
+}
+
+func (g *groupStage) run(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+	type group struct {
+		id   bson.RawValue
+		accs []accumulator
+	}
+
+	groups := map[string]*group{}
+	var order []*group
+	for _, doc := range docs {
+		id, err := g.id.eval(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		key := groupKey(id)
+		grp, ok := groups[key]
+		if !ok {
+			grp = &group{id: orNull(id), accs: make([]accumulator, len(g.fields))}
+			for i, field := range g.fields {
+				grp.accs[i] = field.newAcc()
+			}
+			groups[key] = grp
+			order = append(order, grp)
+		}
+
+		for i, field := range g.fields {
+			v, err := field.expr.eval(doc)
+			if err != nil {
+				return nil, err
+			}
+			if err := grp.accs[i].add(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	out := make([]bson.Raw, 0, len(order))
+	for _, grp := range order {
+		d := bson.D{{Key: "_id", Value: grp.id}}
+		for i, field := range g.fields {
+			d = append(d, bson.E{Key: field.name, Value: grp.accs[i].result()})
+		}
+		b, err := bson.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
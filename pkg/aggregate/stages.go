@@ -0,0 +1,763 @@
+package aggregate
+
+import (
+	"context"
+	"strings"
+
+	"github.com/orktes/mongache/pkg/match"
+	"github.com/orktes/mongache/pkg/server"
+	"github.com/orktes/mongache/pkg/slice"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// stage is a compiled stage of a pipeline.
+type stage interface {
+	run(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error)
+}
+
+// stageFunc adapts a function to a stage.
+type stageFunc func(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error)
+
+func (fn stageFunc) run(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+	return fn(ctx, docs, env)
+}
+
+var stageCompilers map[string]func(spec bson.RawValue) (stage, error)
+
+func init() {
+	stageCompilers = map[string]func(spec bson.RawValue) (stage, error){
+		"$match":     compileMatch,
+		"$project":   compileProject,
+		"$addFields": compileAddFields,
+		"$set":       compileAddFields,
+		"$unset":     compileUnset,
+		"$sort":      compileSort,
+		"$skip":      compileSkip,
+		"$limit":     compileLimit,
+		"$group":     compileGroup,
+		"$unwind":    compileUnwind,
+		"$count":     compileCount,
+		"$lookup":    compileLookup,
+		"$facet":     compileFacet,
+	}
+}
+
+func compileStage(doc bson.Raw) (stage, error) {
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	if len(elems) != 1 {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "A pipeline stage specification object must contain exactly one field.")
+	}
+
+	compile, ok := stageCompilers[elems[0].Key()]
+	if !ok {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "Unrecognized pipeline stage name: '%s'", elems[0].Key())
+	}
+	return compile(elems[0].Value())
+}
+
+func specDocument(name string, spec bson.RawValue) (bson.Raw, error) {
+	doc, ok := spec.DocumentOK()
+	if !ok {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "the %s stage specification must be an object", name)
+	}
+	return doc, nil
+}
+
+func marshalAll(ds []bson.D) ([]bson.Raw, error) {
+	out := make([]bson.Raw, len(ds))
+	for i, d := range ds {
+		b, err := bson.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = b
+	}
+	return out, nil
+}
+
+func compileMatch(spec bson.RawValue) (stage, error) {
+	filter, err := specDocument("$match", spec)
+	if err != nil {
+		return nil, err
+	}
+	m, err := match.Compile(filter)
+	if err != nil {
+		return nil, server.Errorf(server.ErrorCodeBadValue, "%s", err)
+	}
+
+	return stageFunc(func(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+		var out []bson.Raw
+		for _, doc := range docs {
+			if m.MatchRaw(doc) {
+				out = append(out, doc)
+			}
+		}
+		return out, nil
+	}), nil
+}
+
+// projectNode is a field of a projection: included, excluded, computed by
+// an expression or a projection of an embedded document.
+type projectNode struct {
+	include, exclude bool
+	expr             expression
+	children         map[string]*projectNode
+	order            []string // names of the children in specification order
+}
+
+func (node *projectNode) child(name string) *projectNode {
+	if node.children == nil {
+		node.children = map[string]*projectNode{}
+	}
+	child, ok := node.children[name]
+	if !ok {
+		child = &projectNode{}
+		node.children[name] = child
+		node.order = append(node.order, name)
+	}
+	return child
+}
+
+// projectStage is a $project or $unset stage.
+type projectStage struct {
+	root      *projectNode
+	inclusion bool
+	excludeID bool
+}
+
+func compileProject(spec bson.RawValue) (stage, error) {
+	doc, err := specDocument("$project", spec)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &projectStage{root: &projectNode{}}
+	var included, excluded bool
+	var parse func(node *projectNode, doc bson.Raw, top bool) error
+	parse = func(node *projectNode, doc bson.Raw, top bool) error {
+		elems, err := doc.Elements()
+		if err != nil {
+			return err
+		}
+		for _, elem := range elems {
+			key, v := elem.Key(), elem.Value()
+			if strings.HasPrefix(key, "$") {
+				return server.Errorf(server.ErrorCodeFailedToParse, "FieldPath field names may not start with '$': %s", key)
+			}
+
+			leaf := node
+			for _, name := range strings.Split(key, ".") {
+				leaf = leaf.child(name)
+			}
+
+			switch {
+			case v.Type == bsontype.Boolean || v.IsNumber():
+				if truthy(v) {
+					leaf.include = true
+					included = included || !(top && key == "_id")
+				} else if top && key == "_id" {
+					p.excludeID = true
+				} else {
+					leaf.exclude = true
+					excluded = true
+				}
+			case v.Type == bsontype.EmbeddedDocument && !isOperatorDocument(v.Document()):
+				if err := parse(leaf, v.Document(), false); err != nil {
+					return err
+				}
+			default:
+				if leaf.expr, err = compileExpression(v); err != nil {
+					return err
+				}
+				included = true
+			}
+		}
+		return nil
+	}
+	if err := parse(p.root, doc, true); err != nil {
+		return nil, err
+	}
+
+	if included && excluded {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "Cannot do exclusion and inclusion in the same $project")
+	}
+	if len(p.root.children) == 0 && !p.excludeID {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "$project requires at least one output field")
+	}
+	p.inclusion = included || (!excluded && !p.excludeID)
+	return p, nil
+}
+
+func isOperatorDocument(doc bson.Raw) bool {
+	elems, err := doc.Elements()
+	return err == nil && len(elems) > 0 && strings.HasPrefix(elems[0].Key(), "$")
+}
+
+func compileUnset(spec bson.RawValue) (stage, error) {
+	var paths []string
+	switch spec.Type {
+	case bsontype.String:
+		paths = []string{spec.StringValue()}
+	case bsontype.Array:
+		if err := spec.Unmarshal(&paths); err != nil {
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "$unset specification must be a string or an array of strings")
+		}
+	default:
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "$unset specification must be a string or an array of strings")
+	}
+
+	p := &projectStage{root: &projectNode{}}
+	for _, path := range paths {
+		if path == "_id" {
+			p.excludeID = true
+			continue
+		}
+		node := p.root
+		for _, name := range strings.Split(path, ".") {
+			node = node.child(name)
+		}
+		node.exclude = true
+	}
+	return p, nil
+}
+
+func (p *projectStage) run(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+	out := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		var err error
+		if p.inclusion {
+			out[i], err = p.include(p.root, doc, doc, true)
+		} else {
+			out[i] = p.exclude(p.root, doc, true)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return marshalAll(out)
+}
+
+// include applies an inclusion projection to doc. Expressions are
+// evaluated against root.
+func (p *projectStage) include(node *projectNode, doc, root bson.Raw, top bool) (bson.D, error) {
+	out := bson.D{}
+	elems, _ := doc.Elements()
+	for _, elem := range elems {
+		key, v := elem.Key(), elem.Value()
+		child := node.children[key]
+		if top && key == "_id" && !p.excludeID && (child == nil || child.expr == nil) {
+			out = append(out, bson.E{Key: key, Value: v})
+			continue
+		}
+		if child == nil || child.expr != nil {
+			continue
+		}
+
+		switch {
+		case child.include:
+			out = append(out, bson.E{Key: key, Value: v})
+		case v.Type == bsontype.EmbeddedDocument:
+			sub, err := p.include(child, v.Document(), root, false)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, bson.E{Key: key, Value: sub})
+		case v.Type == bsontype.Array:
+			values, _ := v.Array().Values()
+			arr := bson.A{}
+			for _, elem := range values {
+				if elem.Type != bsontype.EmbeddedDocument {
+					continue
+				}
+				sub, err := p.include(child, elem.Document(), root, false)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, sub)
+			}
+			out = append(out, bson.E{Key: key, Value: arr})
+		}
+	}
+
+	// Computed fields follow, in specification order
+	for _, key := range node.order {
+		child := node.children[key]
+		switch {
+		case child.expr != nil:
+			v, err := child.expr.eval(root)
+			if err != nil {
+				return nil, err
+			}
+			if v.Type != 0 {
+				out = setField(out, []string{key}, v)
+			}
+		case !child.include && hasExpression(child) && !hasField(out, key):
+			sub, err := p.include(child, emptyDocument, root, false)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, bson.E{Key: key, Value: sub})
+		}
+	}
+	return out, nil
+}
+
+var emptyDocument, _ = bson.Marshal(bson.D{})
+
+func hasExpression(node *projectNode) bool {
+	if node.expr != nil {
+		return true
+	}
+	for _, child := range node.children {
+		if hasExpression(child) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasField(d bson.D, key string) bool {
+	for _, e := range d {
+		if e.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// exclude applies an exclusion projection to doc.
+func (p *projectStage) exclude(node *projectNode, doc bson.Raw, top bool) bson.D {
+	out := bson.D{}
+	elems, _ := doc.Elements()
+	for _, elem := range elems {
+		key, v := elem.Key(), elem.Value()
+		if top && key == "_id" && p.excludeID {
+			continue
+		}
+		child := node.children[key]
+		switch {
+		case child == nil:
+			out = append(out, bson.E{Key: key, Value: v})
+		case child.exclude:
+		case v.Type == bsontype.EmbeddedDocument:
+			out = append(out, bson.E{Key: key, Value: p.exclude(child, v.Document(), false)})
+		case v.Type == bsontype.Array:
+			values, _ := v.Array().Values()
+			arr := bson.A{}
+			for _, elem := range values {
+				if elem.Type == bsontype.EmbeddedDocument {
+					arr = append(arr, p.exclude(child, elem.Document(), false))
+				} else {
+					arr = append(arr, elem)
+				}
+			}
+			out = append(out, bson.E{Key: key, Value: arr})
+		default:
+			out = append(out, bson.E{Key: key, Value: v})
+		}
+	}
+	return out
+}
+
+// toD returns the fields of a document.
+func toD(doc bson.Raw) bson.D {
+	elems, _ := doc.Elements()
+	d := make(bson.D, len(elems))
+	for i, elem := range elems {
+		d[i] = bson.E{Key: elem.Key(), Value: elem.Value()}
+	}
+	return d
+}
+
+// setField sets the value of a dotted path in a document, replacing values
+// on the path that are not documents.
+func setField(d bson.D, path []string, v interface{}) bson.D {
+	for i, e := range d {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			d[i].Value = v
+			return d
+		}
+
+		var sub bson.D
+		switch ev := e.Value.(type) {
+		case bson.D:
+			sub = ev
+		case bson.RawValue:
+			if doc, ok := ev.DocumentOK(); ok {
+				sub = toD(doc)
+			}
+		}
+		d[i].Value = setField(sub, path[1:], v)
+		return d
+	}
+
+	if len(path) == 1 {
+		return append(d, bson.E{Key: path[0], Value: v})
+	}
+	return append(d, bson.E{Key: path[0], Value: setField(bson.D{}, path[1:], v)})
+}
+
+type addField struct {
+	path []string
+	expr expression
+}
+
+func compileAddFields(spec bson.RawValue) (stage, error) {
+	doc, err := specDocument("$addFields", spec)
+	if err != nil {
+		return nil, err
+	}
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]addField, len(elems))
+	for i, elem := range elems {
+		if strings.HasPrefix(elem.Key(), "$") {
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "FieldPath field names may not start with '$': %s", elem.Key())
+		}
+		expr, err := compileExpression(elem.Value())
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = addField{path: strings.Split(elem.Key(), "."), expr: expr}
+	}
+
+	return stageFunc(func(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+		out := make([]bson.D, len(docs))
+		for i, doc := range docs {
+			d := toD(doc)
+			for _, field := range fields {
+				v, err := field.expr.eval(doc)
+				if err != nil {
+					return nil, err
+				}
+				if v.Type != 0 {
+					d = setField(d, field.path, v)
+				}
+			}
+			out[i] = d
+		}
+		return marshalAll(out)
+	}), nil
+}
+
+func compileSort(spec bson.RawValue) (stage, error) {
+	doc, err := specDocument("$sort", spec)
+	if err != nil {
+		return nil, err
+	}
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	if len(elems) == 0 {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "$sort stage must have at least one sort key")
+	}
+
+	sortBy := make(bson.D, len(elems))
+	for i, elem := range elems {
+		v := elem.Value()
+		if !v.IsNumber() || (toFloat(v) != 1 && toFloat(v) != -1) {
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "$sort key ordering must be 1 (for ascending) or -1 (for descending)")
+		}
+		sortBy[i] = bson.E{Key: elem.Key(), Value: toInt(v)}
+	}
+
+	return stageFunc(func(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+		cur, err := slice.NewQueryCursor(docs, nil, nil, sortBy)
+		if err != nil {
+			return nil, err
+		}
+		return readAll(ctx, cur)
+	}), nil
+}
+
+func nonNegative(name string, spec bson.RawValue) (int, error) {
+	if !spec.IsNumber() || toFloat(spec) < 0 || toFloat(spec) != float64(toInt(spec)) {
+		return 0, server.Errorf(server.ErrorCodeFailedToParse, "invalid argument to %s stage: expected a non-negative integer", name)
+	}
+	return int(toInt(spec)), nil
+}
+
+func compileSkip(spec bson.RawValue) (stage, error) {
+	n, err := nonNegative("$skip", spec)
+	if err != nil {
+		return nil, err
+	}
+	return stageFunc(func(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+		if n >= len(docs) {
+			return nil, nil
+		}
+		return docs[n:], nil
+	}), nil
+}
+
+func compileLimit(spec bson.RawValue) (stage, error) {
+	n, err := nonNegative("$limit", spec)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "the limit must be positive")
+	}
+	return stageFunc(func(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+		if n < len(docs) {
+			return docs[:n], nil
+		}
+		return docs, nil
+	}), nil
+}
+
+type unwindOptions struct {
+	Path                       string `bson:"path"`
+	IncludeArrayIndex          string `bson:"includeArrayIndex"`
+	PreserveNullAndEmptyArrays bool   `bson:"preserveNullAndEmptyArrays"`
+}
+
+func compileUnwind(spec bson.RawValue) (stage, error) {
+	var opts unwindOptions
+	switch spec.Type {
+	case bsontype.String:
+		opts.Path = spec.StringValue()
+	case bsontype.EmbeddedDocument:
+		if err := spec.Unmarshal(&opts); err != nil {
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "%s", err)
+		}
+	default:
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "expected either a string or an object as specification for $unwind stage")
+	}
+	if !strings.HasPrefix(opts.Path, "$") || len(opts.Path) == 1 {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "path option to $unwind stage should be prefixed with a '$': %s", opts.Path)
+	}
+	path := strings.Split(opts.Path[1:], ".")
+
+	return stageFunc(func(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+		var out []bson.D
+		for _, doc := range docs {
+			v, _ := doc.LookupErr(path...)
+
+			var elems []bson.RawValue
+			if arr, ok := v.ArrayOK(); ok {
+				elems, _ = arr.Values()
+			} else if !isNullish(v) {
+				d := toD(doc)
+				if opts.IncludeArrayIndex != "" {
+					d = setField(d, []string{opts.IncludeArrayIndex}, nil)
+				}
+				out = append(out, d)
+				continue
+			}
+
+			if len(elems) == 0 {
+				if opts.PreserveNullAndEmptyArrays {
+					d := toD(doc)
+					if v.Type == bsontype.Array {
+						d = unsetField(d, path)
+					}
+					if opts.IncludeArrayIndex != "" {
+						d = setField(d, []string{opts.IncludeArrayIndex}, nil)
+					}
+					out = append(out, d)
+				}
+				continue
+			}
+
+			for i, elem := range elems {
+				d := setField(toD(doc), path, elem)
+				if opts.IncludeArrayIndex != "" {
+					d = setField(d, []string{opts.IncludeArrayIndex}, int64(i))
+				}
+				out = append(out, d)
+			}
+		}
+		return marshalAll(out)
+	}), nil
+}
+
+// unsetField removes a dotted path from a document.
+func unsetField(d bson.D, path []string) bson.D {
+	for i, e := range d {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return append(d[:i:i], d[i+1:]...)
+		}
+		if rv, ok := e.Value.(bson.RawValue); ok {
+			if doc, ok := rv.DocumentOK(); ok {
+				d[i].Value = unsetField(toD(doc), path[1:])
+			}
+		}
+		return d
+	}
+	return d
+}
+
+func compileCount(spec bson.RawValue) (stage, error) {
+	name, ok := spec.StringValueOK()
+	if !ok || name == "" || strings.HasPrefix(name, "$") || strings.Contains(name, ".") {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "the count field must be a non-empty string without '$' or '.'")
+	}
+
+	return stageFunc(func(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+		if len(docs) == 0 {
+			return nil, nil
+		}
+		return marshalAll([]bson.D{{{Key: name, Value: int32(len(docs))}}})
+	}), nil
+}
+
+type lookupOptions struct {
+	From         string     `bson:"from"`
+	LocalField   string     `bson:"localField"`
+	ForeignField string     `bson:"foreignField"`
+	As           string     `bson:"as"`
+	Let          bson.Raw   `bson:"let"`
+	Pipeline     []bson.Raw `bson:"pipeline"`
+}
+
+func compileLookup(spec bson.RawValue) (stage, error) {
+	if _, err := specDocument("$lookup", spec); err != nil {
+		return nil, err
+	}
+	var opts lookupOptions
+	if err := spec.Unmarshal(&opts); err != nil {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "%s", err)
+	}
+	if opts.From == "" || opts.As == "" {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "$lookup requires 'from' and 'as' fields")
+	}
+	if opts.Let != nil {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "$lookup with 'let' is not supported")
+	}
+
+	var pipeline *Pipeline
+	if opts.Pipeline != nil {
+		if opts.LocalField != "" || opts.ForeignField != "" {
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "$lookup with 'pipeline' may not specify 'localField' or 'foreignField'")
+		}
+		var err error
+		if pipeline, err = Compile(opts.Pipeline); err != nil {
+			return nil, err
+		}
+	} else if opts.LocalField == "" || opts.ForeignField == "" {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "$lookup requires either 'pipeline' or both 'localField' and 'foreignField'")
+	}
+	as := strings.Split(opts.As, ".")
+
+	return stageFunc(func(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+		foreign, err := env.collection(ctx, opts.From)
+		if err != nil {
+			return nil, err
+		}
+
+		var joined bson.A
+		if pipeline != nil {
+			results, err := pipeline.run(ctx, foreign, env)
+			if err != nil {
+				return nil, err
+			}
+			joined = rawArray(results)
+		}
+
+		out := make([]bson.D, len(docs))
+		for i, doc := range docs {
+			if pipeline == nil {
+				local := joinValues(doc, opts.LocalField)
+				var matched []bson.Raw
+				for _, f := range foreign {
+					if anyEqual(local, joinValues(f, opts.ForeignField)) {
+						matched = append(matched, f)
+					}
+				}
+				joined = rawArray(matched)
+			}
+			out[i] = setField(toD(doc), as, joined)
+		}
+		return marshalAll(out)
+	}), nil
+}
+
+func rawArray(docs []bson.Raw) bson.A {
+	arr := make(bson.A, len(docs))
+	for i, doc := range docs {
+		arr[i] = doc
+	}
+	return arr
+}
+
+// joinValues returns the values $lookup joins a document by: the values of
+// the path with arrays expanded, null when missing.
+func joinValues(doc bson.Raw, path string) []bson.RawValue {
+	var values []bson.RawValue
+	for _, v := range match.Lookup(doc, path) {
+		if arr, ok := v.ArrayOK(); ok {
+			elems, _ := arr.Values()
+			values = append(values, elems...)
+			continue
+		}
+		values = append(values, orNull(v))
+	}
+	if len(values) == 0 {
+		values = append(values, value(nil))
+	}
+	return values
+}
+
+func anyEqual(a, b []bson.RawValue) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if match.Equal(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func compileFacet(spec bson.RawValue) (stage, error) {
+	doc, err := specDocument("$facet", spec)
+	if err != nil {
+		return nil, err
+	}
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	if len(elems) == 0 {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "the $facet specification must be a non-empty object")
+	}
+
+	names := make([]string, len(elems))
+	pipelines := make([]*Pipeline, len(elems))
+	for i, elem := range elems {
+		names[i] = elem.Key()
+		if elem.Value().Type != bsontype.Array {
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "arguments to $facet must be arrays, %s is type %s", elem.Key(), elem.Value().Type)
+		}
+		if pipelines[i], err = Compile(elem.Value()); err != nil {
+			return nil, err
+		}
+	}
+
+	return stageFunc(func(ctx context.Context, docs []bson.Raw, env *env) ([]bson.Raw, error) {
+		d := make(bson.D, len(pipelines))
+		for i, p := range pipelines {
+			results, err := p.run(ctx, docs, env)
+			if err != nil {
+				return nil, err
+			}
+			d[i] = bson.E{Key: names[i], Value: rawArray(results)}
+		}
+		return marshalAll([]bson.D{d})
+	}), nil
+}
@@ -0,0 +1,200 @@
+// Package catalog serves read-only slice.Dataset collections from a
+// server.Server, with the index commands managing their indexes.
+package catalog
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/orktes/mongache/pkg/aggregate"
+	"github.com/orktes/mongache/pkg/match"
+	"github.com/orktes/mongache/pkg/server"
+	"github.com/orktes/mongache/pkg/slice"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Catalog holds datasets by namespace. The zero value is an empty catalog.
+type Catalog struct {
+	mu       sync.RWMutex
+	datasets map[string]*slice.Dataset
+}
+
+// New returns an empty catalog.
+func New() *Catalog {
+	return &Catalog{}
+}
+
+// Add makes ds the collection of the "dbname.collectionname" namespace ns,
+// replacing any previous one.
+func (c *Catalog) Add(ns string, ds *slice.Dataset) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.datasets == nil {
+		c.datasets = map[string]*slice.Dataset{}
+	}
+	c.datasets[ns] = ds
+}
+
+// Dataset returns the collection of a namespace, or nil.
+func (c *Catalog) Dataset(ns string) *slice.Dataset {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.datasets[ns]
+}
+
+// Namespaces returns the namespaces of the catalog, sorted.
+func (c *Catalog) Namespaces() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	names := make([]string, 0, len(c.datasets))
+	for ns := range c.datasets {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Catalog) lookup(ns string) (*slice.Dataset, error) {
+	ds := c.Dataset(ns)
+	if ds == nil {
+		return nil, server.Errorf(server.ErrorCodeNamespaceNotFound, "ns does not exist: %s", ns)
+	}
+	return ds, nil
+}
+
+// Find is a server.FindHandler answering queries from the catalog. Queries
+// on unknown namespaces return no documents.
+func (c *Catalog) Find(ctx context.Context, req *server.FindRequest) (server.Cursor, error) {
+	ds := c.Dataset(req.Namespace())
+	if ds == nil {
+		return slice.NewCursor([]bson.Raw{})
+	}
+
+	cur, err := ds.Find(req.Filter, req.Projection, req.Sort)
+	if err != nil {
+		return nil, server.Errorf(server.ErrorCodeBadValue, "%s", err)
+	}
+	return cur, cur.Skip(ctx, req.Skip)
+}
+
+// indexError converts an error of a dataset to a server error.
+func indexError(err error) error {
+	switch {
+	case errors.Is(err, slice.ErrDuplicateKey):
+		return server.Errorf(server.ErrorCodeDuplicateKey, "%s", err)
+	case errors.Is(err, slice.ErrIndexNotFound):
+		return server.Errorf(server.ErrorCodeIndexNotFound, "%s", err)
+	case errors.Is(err, slice.ErrIndexConflict):
+		return server.Errorf(server.ErrorCodeIndexKeySpecsConflict, "%s", err)
+	}
+	return server.Errorf(server.ErrorCodeCannotCreateIndex, "%s", err)
+}
+
+// CreateIndexes is a server.CreateIndexesHandler building indexes of the
+// datasets.
+func (c *Catalog) CreateIndexes(ctx context.Context, req *server.CreateIndexesRequest) (*server.IndexesResult, error) {
+	ds, err := c.lookup(req.Namespace())
+	if err != nil {
+		return nil, err
+	}
+
+	res := &server.IndexesResult{NumIndexesBefore: int32(len(ds.Indexes()))}
+	for _, model := range req.Indexes {
+		if err := ds.CreateIndex(slice.IndexModel(model)); err != nil {
+			return nil, indexError(err)
+		}
+	}
+	res.NumIndexesAfter = int32(len(ds.Indexes()))
+	return res, nil
+}
+
+// DropIndexes is a server.DropIndexesHandler dropping indexes of the
+// datasets.
+func (c *Catalog) DropIndexes(ctx context.Context, req *server.DropIndexesRequest) (*server.IndexesResult, error) {
+	ds, err := c.lookup(req.Namespace())
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := ds.Indexes()
+	res := &server.IndexesResult{NumIndexesBefore: int32(len(indexes))}
+
+	names := req.Names
+	if len(req.Key) > 0 {
+		for _, model := range indexes {
+			if keyEqual(model.Key, req.Key) {
+				names = append(names, model.Name)
+			}
+		}
+		if len(names) == 0 {
+			return nil, server.Errorf(server.ErrorCodeIndexNotFound, "can't find index with key: %v", req.Key)
+		}
+	}
+
+	if len(names) == 0 {
+		ds.DropIndexes()
+	}
+	for _, name := range names {
+		if err := ds.DropIndex(name); err != nil {
+			return nil, indexError(err)
+		}
+	}
+	res.NumIndexesAfter = int32(len(ds.Indexes()))
+	return res, nil
+}
+
+// keyEqual tells if two index key patterns have the same fields in the same
+// order. Values are compared like query values, so that a key given as
+// {a: 1.0} matches an index created as {a: 1}.
+func keyEqual(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key {
+			return false
+		}
+		av, err := rawValue(a[i].Value)
+		if err != nil {
+			return false
+		}
+		bv, err := rawValue(b[i].Value)
+		if err != nil || !match.Equal(av, bv) {
+			return false
+		}
+	}
+	return true
+}
+
+func rawValue(v interface{}) (bson.RawValue, error) {
+	t, b, err := bson.MarshalValue(v)
+	return bson.RawValue{Type: t, Value: b}, err
+}
+
+// ListIndexes is a server.ListIndexesHandler listing the indexes of the
+// datasets.
+func (c *Catalog) ListIndexes(ctx context.Context, req *server.ListIndexesRequest) ([]server.IndexModel, error) {
+	ds, err := c.lookup(req.Namespace())
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := ds.Indexes()
+	models := make([]server.IndexModel, len(indexes))
+	for i, model := range indexes {
+		models[i] = server.IndexModel(model)
+	}
+	return models, nil
+}
+
+// Register makes srv answer queries, aggregations and index commands from
+// the catalog.
+func (c *Catalog) Register(srv *server.Server) {
+	srv.FindHandler = c.Find
+	srv.AggregateHandler = aggregate.Handler(c.Find)
+	srv.CreateIndexesHandler = c.CreateIndexes
+	srv.DropIndexesHandler = c.DropIndexes
+	srv.ListIndexesHandler = c.ListIndexes
+}
@@ -0,0 +1,96 @@
+package catalog_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/orktes/mongache/pkg/catalog"
+	"github.com/orktes/mongache/pkg/server"
+	"github.com/orktes/mongache/pkg/slice"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestCatalog(t *testing.T) {
+	data := make([]bson.M, 1000)
+	for i := range data {
+		data[i] = bson.M{"_id": int32(i), "group": int32(i % 10), "name": fmt.Sprintf("item_%03d", i)}
+	}
+	ds, err := slice.NewDataset(data)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	c := catalog.New()
+	c.Add("foo.items", ds)
+	s := &server.Server{}
+	c.Register(s)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go s.Listen(ln)
+	defer s.Close()
+
+	ctx := context.Background()
+	cli, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+ln.Addr().String()))
+	assert.NoError(t, err)
+	defer cli.Disconnect(ctx)
+
+	coll := cli.Database("foo").Collection("items")
+
+	names, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "group", Value: 1}, {Key: "name", Value: -1}}},
+		{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"group_1_name_-1", "name_1"}, names)
+
+	_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "group", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), server.ErrorCodeDuplicateKey.String())
+	}
+
+	index, err := ds.Explain(bson.M{"group": 3}, bson.D{{Key: "name", Value: 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, "group_1_name_-1", index)
+
+	cur, err := coll.Find(ctx, bson.M{"group": 3, "name": bson.M{"$gte": "item_900"}},
+		options.Find().SetSort(bson.D{{Key: "name", Value: 1}}).SetSkip(1))
+	assert.NoError(t, err)
+	var docs []bson.M
+	assert.NoError(t, cur.All(ctx, &docs))
+	assert.Equal(t, []bson.M{{"_id": int32(913), "group": int32(3), "name": "item_913"}}, docs[:1])
+	assert.Len(t, docs, 9)
+
+	_, err = coll.Indexes().DropOne(ctx, "name_1")
+	assert.NoError(t, err)
+	_, err = coll.Indexes().DropOne(ctx, "name_1")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), server.ErrorCodeIndexNotFound.String())
+	}
+
+	cur, err = coll.Indexes().List(ctx)
+	assert.NoError(t, err)
+	var indexes []bson.M
+	assert.NoError(t, cur.All(ctx, &indexes))
+	if assert.Len(t, indexes, 1) {
+		assert.Equal(t, "group_1_name_-1", indexes[0]["name"])
+	}
+
+	// Keys are matched field by field, comparing numbers by value
+	db := cli.Database("foo")
+	err = db.RunCommand(ctx, bson.D{{Key: "dropIndexes", Value: "items"}, {Key: "index", Value: bson.D{{Key: "name", Value: -1}, {Key: "group", Value: 1}}}}).Err()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), server.ErrorCodeIndexNotFound.String())
+	}
+	err = db.RunCommand(ctx, bson.D{{Key: "dropIndexes", Value: "items"}, {Key: "index", Value: bson.D{{Key: "group", Value: 1.0}, {Key: "name", Value: int64(-1)}}}}).Err()
+	assert.NoError(t, err)
+	assert.Empty(t, ds.Indexes())
+}
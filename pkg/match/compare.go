@@ -0,0 +1,241 @@
+package match
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// canonicalType returns the rank of the type t in MongoDB's comparison
+// order. Values of types with the same rank are compared with each other;
+// numbers of all types, strings and symbols, and null and missing values
+// share a rank.
+func canonicalType(t bsontype.Type) int {
+	switch t {
+	case bsontype.MinKey:
+		return 0
+	case 0, bsontype.Null, bsontype.Undefined:
+		return 1
+	case bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128:
+		return 2
+	case bsontype.String, bsontype.Symbol:
+		return 3
+	case bsontype.EmbeddedDocument:
+		return 4
+	case bsontype.Array:
+		return 5
+	case bsontype.Binary:
+		return 6
+	case bsontype.ObjectID:
+		return 7
+	case bsontype.Boolean:
+		return 8
+	case bsontype.DateTime:
+		return 9
+	case bsontype.Timestamp:
+		return 10
+	case bsontype.Regex:
+		return 11
+	case bsontype.DBPointer:
+		return 12
+	case bsontype.JavaScript:
+		return 13
+	case bsontype.CodeWithScope:
+		return 14
+	case bsontype.MaxKey:
+		return 255
+	default:
+		return 254
+	}
+}
+
+// Compare compares two BSON values in MongoDB's sort order. It returns a
+// negative number when a sorts before b, zero when they are equal and a
+// positive number otherwise. A zero RawValue stands for a missing value and
+// sorts like null.
+func Compare(a, b bson.RawValue) int {
+	if ca, cb := canonicalType(a.Type), canonicalType(b.Type); ca != cb {
+		return ca - cb
+	}
+
+	switch a.Type {
+	case 0, bsontype.Null, bsontype.Undefined, bsontype.MinKey, bsontype.MaxKey:
+		return 0
+	case bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128:
+		return compareNumbers(a, b)
+	case bsontype.String, bsontype.Symbol:
+		return compareStrings(stringValue(a), stringValue(b))
+	case bsontype.EmbeddedDocument:
+		return compareDocuments(a.Document(), b.Document())
+	case bsontype.Array:
+		return compareArrays(a.Array(), b.Array())
+	case bsontype.Binary:
+		subA, dataA := a.Binary()
+		subB, dataB := b.Binary()
+		if len(dataA) != len(dataB) {
+			return len(dataA) - len(dataB)
+		}
+		if subA != subB {
+			return int(subA) - int(subB)
+		}
+		return bytes.Compare(dataA, dataB)
+	case bsontype.ObjectID:
+		oidA, oidB := a.ObjectID(), b.ObjectID()
+		return bytes.Compare(oidA[:], oidB[:])
+	case bsontype.Boolean:
+		return boolInt(a.Boolean()) - boolInt(b.Boolean())
+	case bsontype.DateTime:
+		return compareInt64(a.DateTime(), b.DateTime())
+	case bsontype.Timestamp:
+		ta, ia := a.Timestamp()
+		tb, ib := b.Timestamp()
+		if ta != tb {
+			return compareInt64(int64(ta), int64(tb))
+		}
+		return compareInt64(int64(ia), int64(ib))
+	case bsontype.Regex:
+		patternA, optionsA := a.Regex()
+		patternB, optionsB := b.Regex()
+		if c := compareStrings(patternA, patternB); c != 0 {
+			return c
+		}
+		return compareStrings(optionsA, optionsB)
+	default:
+		return bytes.Compare(a.Value, b.Value)
+	}
+}
+
+// Equal tells if two BSON values are equal in MongoDB's comparison order, in
+// which numbers of different types are equal if they have the same value.
+func Equal(a, b bson.RawValue) bool {
+	return Compare(a, b) == 0
+}
+
+func compareNumbers(a, b bson.RawValue) int {
+	if isInteger(a) && isInteger(b) {
+		return compareInt64(intValue(a), intValue(b))
+	}
+
+	fa, fb := numberValue(a), numberValue(b)
+	switch {
+	case fa < fb:
+		return -1
+	case fa > fb:
+		return 1
+	case fa == fb:
+		return 0
+	}
+
+	// NaN sorts before all other numbers
+	switch {
+	case math.IsNaN(fa) && math.IsNaN(fb):
+		return 0
+	case math.IsNaN(fa):
+		return -1
+	default:
+		return 1
+	}
+}
+
+func isInteger(v bson.RawValue) bool {
+	return v.Type == bsontype.Int32 || v.Type == bsontype.Int64
+}
+
+// intValue returns an integer value as an int64.
+func intValue(v bson.RawValue) int64 {
+	if v.Type == bsontype.Int32 {
+		return int64(v.Int32())
+	}
+	return v.Int64()
+}
+
+// numberValue returns a numeric value as a float64.
+func numberValue(v bson.RawValue) float64 {
+	switch v.Type {
+	case bsontype.Int32:
+		return float64(v.Int32())
+	case bsontype.Int64:
+		return float64(v.Int64())
+	case bsontype.Double:
+		return v.Double()
+	case bsontype.Decimal128:
+		f, err := strconv.ParseFloat(v.Decimal128().String(), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	}
+	return math.NaN()
+}
+
+func isNumber(v bson.RawValue) bool {
+	return canonicalType(v.Type) == canonicalType(bsontype.Double)
+}
+
+func stringValue(v bson.RawValue) string {
+	if v.Type == bsontype.Symbol {
+		return v.Symbol()
+	}
+	return v.StringValue()
+}
+
+// compareDocuments compares documents field by field, comparing the type of
+// the values, then the field names, then the values.
+func compareDocuments(a, b bson.Raw) int {
+	elemsA, _ := a.Elements()
+	elemsB, _ := b.Elements()
+	for i := 0; i < len(elemsA) && i < len(elemsB); i++ {
+		va, vb := elemsA[i].Value(), elemsB[i].Value()
+		if c := canonicalType(va.Type) - canonicalType(vb.Type); c != 0 {
+			return c
+		}
+		if c := compareStrings(elemsA[i].Key(), elemsB[i].Key()); c != 0 {
+			return c
+		}
+		if c := Compare(va, vb); c != 0 {
+			return c
+		}
+	}
+	return len(elemsA) - len(elemsB)
+}
+
+func compareArrays(a, b bson.Raw) int {
+	valuesA, _ := a.Values()
+	valuesB, _ := b.Values()
+	for i := 0; i < len(valuesA) && i < len(valuesB); i++ {
+		if c := Compare(valuesA[i], valuesB[i]); c != 0 {
+			return c
+		}
+	}
+	return len(valuesA) - len(valuesB)
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
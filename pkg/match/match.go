@@ -0,0 +1,248 @@
+// Package match evaluates MongoDB query filters against documents
+package match
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// ErrInvalidFilter is wrapped by the errors of Compile for malformed filters
+var ErrInvalidFilter = errors.New("match: invalid filter")
+
+// Matcher is a compiled filter.
+type Matcher struct {
+	root predicate
+}
+
+// predicate tests a document or an array element.
+type predicate func(doc bson.RawValue) bool
+
+// valuePredicate tests the values a path resolves to in a document.
+type valuePredicate func(values []bson.RawValue) bool
+
+// Compile compiles a filter, a bson.M, bson.D, bson.Raw or any other value
+// marshalling to a BSON document. A nil filter matches every document.
+func Compile(filter interface{}) (*Matcher, error) {
+	if filter == nil {
+		return &Matcher{root: func(bson.RawValue) bool { return true }}, nil
+	}
+
+	doc, err := toRaw(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := compileDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &Matcher{root: root}, nil
+}
+
+// Match tells if doc, a bson.Raw, []byte or any other value marshalling to a
+// BSON document, matches the filter.
+func (m *Matcher) Match(doc interface{}) (bool, error) {
+	raw, err := toRaw(doc)
+	if err != nil {
+		return false, err
+	}
+	return m.MatchRaw(raw), nil
+}
+
+// MatchRaw tells if a BSON document matches the filter.
+func (m *Matcher) MatchRaw(doc bson.Raw) bool {
+	return m.root(bson.RawValue{Type: bsontype.EmbeddedDocument, Value: doc})
+}
+
+func toRaw(v interface{}) (bson.Raw, error) {
+	switch v := v.(type) {
+	case bson.Raw:
+		return v, nil
+	case []byte:
+		return bson.Raw(v), nil
+	}
+	return bson.Marshal(v)
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidFilter, fmt.Sprintf(format, args...))
+}
+
+// compileDocument compiles a filter document, whose fields are all required
+// to match.
+func compileDocument(doc bson.Raw) (predicate, error) {
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	preds := make([]predicate, 0, len(elems))
+	for _, elem := range elems {
+		key, value := elem.Key(), elem.Value()
+
+		var pred predicate
+		switch key {
+		case "$and", "$or", "$nor":
+			pred, err = compileLogical(key, value)
+		case "$comment":
+			continue
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, invalidf("unknown top level operator: %s", key)
+			}
+			pred, err = compileField(key, value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+
+	return func(doc bson.RawValue) bool {
+		for _, pred := range preds {
+			if !pred(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileLogical compiles $and, $or and $nor.
+func compileLogical(op string, value bson.RawValue) (predicate, error) {
+	arr, ok := value.ArrayOK()
+	if !ok {
+		return nil, invalidf("%s must be an array", op)
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, invalidf("%s must be a nonempty array", op)
+	}
+
+	preds := make([]predicate, len(values))
+	for i, v := range values {
+		doc, ok := v.DocumentOK()
+		if !ok {
+			return nil, invalidf("%s entries must be objects", op)
+		}
+		if preds[i], err = compileDocument(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(doc bson.RawValue) bool {
+		for _, pred := range preds {
+			matched := pred(doc)
+			switch {
+			case op == "$and" && !matched:
+				return false
+			case op == "$or" && matched:
+				return true
+			case op == "$nor" && matched:
+				return false
+			}
+		}
+		return op != "$or"
+	}, nil
+}
+
+// compileField compiles the condition on a dotted path.
+func compileField(key string, value bson.RawValue) (predicate, error) {
+	pred, err := compileCondition(value)
+	if err != nil {
+		return nil, err
+	}
+
+	path := strings.Split(key, ".")
+	return func(doc bson.RawValue) bool {
+		return pred(lookup(doc, path))
+	}, nil
+}
+
+// compileCondition compiles the value of a field of a filter: a document of
+// operators, or a value to compare with.
+func compileCondition(value bson.RawValue) (valuePredicate, error) {
+	if doc, ok := value.DocumentOK(); ok && isOperatorDocument(doc) {
+		return compileOperators(doc)
+	}
+	if value.Type == bsontype.Regex {
+		return compileRegexValue(value)
+	}
+	return equals(value), nil
+}
+
+// isOperatorDocument tells if the first field of doc is an operator.
+func isOperatorDocument(doc bson.Raw) bool {
+	elems, err := doc.Elements()
+	return err == nil && len(elems) > 0 && strings.HasPrefix(elems[0].Key(), "$")
+}
+
+// Lookup returns the values a dotted path resolves to in doc, traversing
+// arrays like filters do. Missing fields resolve to a zero RawValue.
+func Lookup(doc bson.Raw, path string) []bson.RawValue {
+	return lookup(bson.RawValue{Type: bsontype.EmbeddedDocument, Value: doc}, strings.Split(path, "."))
+}
+
+// lookup returns the values of a dotted path in a document. Arrays on the
+// path are traversed: the path continues in each of their document elements,
+// and a numeric path component also selects an element by index. A missing
+// field resolves to a zero RawValue.
+func lookup(v bson.RawValue, path []string) []bson.RawValue {
+	if len(path) == 0 {
+		return []bson.RawValue{v}
+	}
+
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		field, err := v.Document().LookupErr(path[0])
+		if err != nil {
+			return []bson.RawValue{{}}
+		}
+		return lookup(field, path[1:])
+	case bsontype.Array:
+		arr := v.Array()
+
+		var values []bson.RawValue
+		if _, err := strconv.Atoi(path[0]); err == nil {
+			if elem, err := arr.LookupErr(path[0]); err == nil {
+				values = append(values, lookup(elem, path[1:])...)
+			}
+		}
+
+		elems, _ := arr.Values()
+		for _, elem := range elems {
+			if elem.Type == bsontype.EmbeddedDocument {
+				values = append(values, lookup(elem, path)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// anyValue tells if f is true for one of values, or for one of the elements
+// of the arrays among them.
+func anyValue(values []bson.RawValue, f func(bson.RawValue) bool) bool {
+	for _, v := range values {
+		if f(v) {
+			return true
+		}
+		if v.Type == bsontype.Array {
+			elems, _ := v.Array().Values()
+			for _, elem := range elems {
+				if f(elem) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package match_test
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/orktes/mongache/pkg/match"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMatch(t *testing.T) {
+	doc := bson.M{
+		"name":  "alice",
+		"age":   int32(42),
+		"score": 7.5,
+		"tags":  bson.A{"a", "b", "c"},
+		"nums":  bson.A{int64(1), int32(5), 9.0},
+		"null":  nil,
+		"address": bson.D{
+			{Key: "city", Value: "Helsinki"},
+			{Key: "zip", Value: "00100"},
+		},
+		"orders": bson.A{
+			bson.M{"item": "x", "qty": int32(2)},
+			bson.M{"item": "y", "qty": int32(10)},
+		},
+		"matrix": bson.A{bson.A{int32(1), int32(2)}, bson.A{int32(3)}},
+	}
+
+	tests := []struct {
+		filter bson.D
+		want   bool
+	}{
+		{bson.D{}, true},
+		{bson.D{{Key: "name", Value: "alice"}}, true},
+		{bson.D{{Key: "name", Value: "bob"}}, false},
+		{bson.D{{Key: "age", Value: 42.0}}, true},
+		{bson.D{{Key: "age", Value: int64(42)}}, true},
+		{bson.D{{Key: "age", Value: bson.M{"$eq": 42}}}, true},
+		{bson.D{{Key: "age", Value: bson.M{"$ne": 42}}}, false},
+		{bson.D{{Key: "age", Value: bson.M{"$gt": 41, "$lt": 43}}}, true},
+		{bson.D{{Key: "age", Value: bson.M{"$gte": 42.5}}}, false},
+		{bson.D{{Key: "age", Value: bson.M{"$lte": 42}}}, true},
+		{bson.D{{Key: "age", Value: bson.M{"$gt": "1"}}}, false},
+		{bson.D{{Key: "age", Value: bson.M{"$gt": primitive.MinKey{}}}}, true},
+		{bson.D{{Key: "name", Value: bson.M{"$gt": "al", "$lt": "b"}}}, true},
+
+		// missing fields and null
+		{bson.D{{Key: "missing", Value: nil}}, true},
+		{bson.D{{Key: "null", Value: nil}}, true},
+		{bson.D{{Key: "age", Value: nil}}, false},
+		{bson.D{{Key: "missing", Value: bson.M{"$ne": nil}}}, false},
+		{bson.D{{Key: "missing", Value: bson.M{"$gte": nil}}}, true},
+		{bson.D{{Key: "missing", Value: bson.M{"$gt": nil}}}, false},
+		{bson.D{{Key: "missing", Value: bson.M{"$exists": false}}}, true},
+		{bson.D{{Key: "null", Value: bson.M{"$exists": true}}}, true},
+		{bson.D{{Key: "address.country", Value: bson.M{"$exists": 1}}}, false},
+
+		// dotted paths and arrays
+		{bson.D{{Key: "address.city", Value: "Helsinki"}}, true},
+		{bson.D{{Key: "address", Value: bson.D{{Key: "city", Value: "Helsinki"}, {Key: "zip", Value: "00100"}}}}, true},
+		{bson.D{{Key: "address", Value: bson.D{{Key: "zip", Value: "00100"}, {Key: "city", Value: "Helsinki"}}}}, false},
+		{bson.D{{Key: "tags", Value: "b"}}, true},
+		{bson.D{{Key: "tags", Value: bson.A{"a", "b", "c"}}}, true},
+		{bson.D{{Key: "tags", Value: bson.A{"a", "b"}}}, false},
+		{bson.D{{Key: "tags.1", Value: "b"}}, true},
+		{bson.D{{Key: "tags.0", Value: "b"}}, false},
+		{bson.D{{Key: "orders.item", Value: "y"}}, true},
+		{bson.D{{Key: "orders.1.qty", Value: 10}}, true},
+		{bson.D{{Key: "orders.qty", Value: bson.M{"$gt": 5}}}, true},
+		{bson.D{{Key: "orders.qty", Value: bson.M{"$gt": 10}}}, false},
+		{bson.D{{Key: "matrix", Value: bson.A{int32(3)}}}, true},
+		{bson.D{{Key: "nums", Value: bson.M{"$gt": 8}}}, true},
+		{bson.D{{Key: "nums", Value: bson.M{"$gt": 1, "$lt": 2}}}, true},
+		{bson.D{{Key: "nums", Value: bson.M{"$elemMatch": bson.M{"$gt": 1, "$lt": 2}}}}, false},
+
+		// $in, $nin and $all
+		{bson.D{{Key: "name", Value: bson.M{"$in": bson.A{"bob", "alice"}}}}, true},
+		{bson.D{{Key: "name", Value: bson.M{"$in": bson.A{primitive.Regex{Pattern: "^ALI", Options: "i"}}}}}, true},
+		{bson.D{{Key: "tags", Value: bson.M{"$in": bson.A{"x", "c"}}}}, true},
+		{bson.D{{Key: "missing", Value: bson.M{"$in": bson.A{nil}}}}, true},
+		{bson.D{{Key: "tags", Value: bson.M{"$nin": bson.A{"x", "c"}}}}, false},
+		{bson.D{{Key: "missing", Value: bson.M{"$nin": bson.A{"x"}}}}, true},
+		{bson.D{{Key: "tags", Value: bson.M{"$all": bson.A{"c", "a"}}}}, true},
+		{bson.D{{Key: "tags", Value: bson.M{"$all": bson.A{"c", "x"}}}}, false},
+		{bson.D{{Key: "tags", Value: bson.M{"$all": bson.A{}}}}, false},
+		{bson.D{{Key: "orders", Value: bson.M{"$all": bson.A{
+			bson.M{"$elemMatch": bson.M{"item": "x"}},
+			bson.M{"$elemMatch": bson.M{"qty": bson.M{"$gte": 10}}},
+		}}}}, true},
+
+		// logical operators
+		{bson.D{{Key: "$and", Value: bson.A{bson.M{"name": "alice"}, bson.M{"age": 42}}}}, true},
+		{bson.D{{Key: "$and", Value: bson.A{bson.M{"name": "alice"}, bson.M{"age": 1}}}}, false},
+		{bson.D{{Key: "$or", Value: bson.A{bson.M{"name": "bob"}, bson.M{"age": 42}}}}, true},
+		{bson.D{{Key: "$or", Value: bson.A{bson.M{"name": "bob"}, bson.M{"age": 1}}}}, false},
+		{bson.D{{Key: "$nor", Value: bson.A{bson.M{"name": "bob"}, bson.M{"age": 1}}}}, true},
+		{bson.D{{Key: "$nor", Value: bson.A{bson.M{"name": "bob"}, bson.M{"age": 42}}}}, false},
+		{bson.D{{Key: "age", Value: bson.M{"$not": bson.M{"$gt": 50}}}}, true},
+		{bson.D{{Key: "name", Value: bson.M{"$not": primitive.Regex{Pattern: "^a"}}}}, false},
+		{bson.D{{Key: "missing", Value: bson.M{"$not": bson.M{"$gt": 50}}}}, true},
+
+		// $type, $regex, $size, $elemMatch and $mod
+		{bson.D{{Key: "age", Value: bson.M{"$type": "int"}}}, true},
+		{bson.D{{Key: "age", Value: bson.M{"$type": 16}}}, true},
+		{bson.D{{Key: "score", Value: bson.M{"$type": "number"}}}, true},
+		{bson.D{{Key: "score", Value: bson.M{"$type": bson.A{"string", "int"}}}}, false},
+		{bson.D{{Key: "tags", Value: bson.M{"$type": "array"}}}, true},
+		{bson.D{{Key: "tags", Value: bson.M{"$type": "string"}}}, true},
+		{bson.D{{Key: "null", Value: bson.M{"$type": "null"}}}, true},
+		{bson.D{{Key: "missing", Value: bson.M{"$type": "null"}}}, false},
+		{bson.D{{Key: "name", Value: bson.M{"$regex": "^AL", "$options": "i"}}}, true},
+		{bson.D{{Key: "name", Value: bson.M{"$regex": "^AL"}}}, false},
+		{bson.D{{Key: "name", Value: bson.M{"$regex": "^a l # first letters\n i [c ]e", "$options": "x"}}}, true},
+		{bson.D{{Key: "name", Value: bson.M{"$regex": "^A L I\\ ce", "$options": "ix"}}}, false},
+		{bson.D{{Key: "address.city", Value: primitive.Regex{Pattern: "hel sin # city\n ki", Options: "xi"}}}, true},
+		{bson.D{{Key: "name", Value: primitive.Regex{Pattern: "ice$"}}}, true},
+		{bson.D{{Key: "tags", Value: primitive.Regex{Pattern: "^c"}}}, true},
+		{bson.D{{Key: "tags", Value: bson.M{"$size": 3}}}, true},
+		{bson.D{{Key: "tags", Value: bson.M{"$size": 2}}}, false},
+		{bson.D{{Key: "name", Value: bson.M{"$size": 5}}}, false},
+		{bson.D{{Key: "orders", Value: bson.M{"$elemMatch": bson.M{"item": "x", "qty": bson.M{"$gt": 5}}}}}, false},
+		{bson.D{{Key: "orders", Value: bson.M{"$elemMatch": bson.M{"item": "y", "qty": bson.M{"$gt": 5}}}}}, true},
+		{bson.D{{Key: "orders", Value: bson.M{"$elemMatch": bson.M{"$or": bson.A{bson.M{"qty": 2}, bson.M{"qty": 3}}}}}}, true},
+		{bson.D{{Key: "age", Value: bson.M{"$mod": bson.A{5, 2}}}}, true},
+		{bson.D{{Key: "score", Value: bson.M{"$mod": bson.A{7, 0}}}}, true},
+		{bson.D{{Key: "nums", Value: bson.M{"$mod": bson.A{4, 1}}}}, true},
+		{bson.D{{Key: "nums", Value: bson.M{"$mod": bson.A{10, 3}}}}, false},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(fmt.Sprint(test.filter), func(t *testing.T) {
+			m, err := match.Compile(test.filter)
+			if !assert.NoError(t, err) {
+				return
+			}
+			matched, err := m.Match(doc)
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, matched)
+		})
+	}
+}
+
+func TestCompileInvalid(t *testing.T) {
+	for _, filter := range []bson.D{
+		{{Key: "$where", Value: "true"}},
+		{{Key: "a", Value: bson.M{"$foo": 1}}},
+		{{Key: "$or", Value: bson.A{}}},
+		{{Key: "$and", Value: "x"}},
+		{{Key: "a", Value: bson.M{"$in": 1}}},
+		{{Key: "a", Value: bson.M{"$in": bson.A{bson.M{"$gt": 1}}}}},
+		{{Key: "a", Value: bson.M{"$mod": bson.A{0, 1}}}},
+		{{Key: "a", Value: bson.M{"$mod": bson.A{1}}}},
+		{{Key: "a", Value: bson.M{"$size": -1}}},
+		{{Key: "a", Value: bson.M{"$type": "nope"}}},
+		{{Key: "a", Value: bson.M{"$regex": "("}}},
+		{{Key: "a", Value: bson.M{"$options": "i"}}},
+		{{Key: "a", Value: bson.M{"$not": 1}}},
+	} {
+		_, err := match.Compile(filter)
+		assert.True(t, errors.Is(err, match.ErrInvalidFilter), "%v: %v", filter, err)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	value := func(v interface{}) bson.RawValue {
+		b, err := bson.Marshal(bson.M{"v": v})
+		assert.NoError(t, err)
+		return bson.Raw(b).Lookup("v")
+	}
+
+	// in ascending sort order
+	ordered := []interface{}{
+		primitive.MinKey{},
+		nil,
+		math.NaN(),
+		int32(-1),
+		0.5,
+		int64(1),
+		"",
+		"a",
+		bson.M{},
+		bson.M{"a": int32(1)},
+		bson.A{},
+		bson.A{int32(1)},
+		primitive.Binary{Data: []byte{1}},
+		primitive.ObjectID{1},
+		false,
+		true,
+		primitive.DateTime(0),
+		primitive.Timestamp{T: 1},
+		primitive.Regex{Pattern: "a"},
+		primitive.MaxKey{},
+	}
+	for i := range ordered {
+		for j := range ordered {
+			c := match.Compare(value(ordered[i]), value(ordered[j]))
+			switch {
+			case i < j:
+				assert.True(t, c < 0, "%v < %v", ordered[i], ordered[j])
+			case i > j:
+				assert.True(t, c > 0, "%v > %v", ordered[i], ordered[j])
+			default:
+				assert.Equal(t, 0, c, "%v == %v", ordered[i], ordered[j])
+			}
+		}
+	}
+
+	assert.True(t, match.Equal(value(int32(2)), value(2.0)))
+	assert.True(t, match.Equal(value(nil), bson.RawValue{}))
+}
@@ -0,0 +1,574 @@
+package match
+
+import (
+	"math"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// typeAliases maps the names accepted by $type to BSON types
+var typeAliases = map[string]bsontype.Type{
+	"double":              bsontype.Double,
+	"string":              bsontype.String,
+	"object":              bsontype.EmbeddedDocument,
+	"array":               bsontype.Array,
+	"binData":             bsontype.Binary,
+	"undefined":           bsontype.Undefined,
+	"objectId":            bsontype.ObjectID,
+	"bool":                bsontype.Boolean,
+	"date":                bsontype.DateTime,
+	"null":                bsontype.Null,
+	"regex":               bsontype.Regex,
+	"dbPointer":           bsontype.DBPointer,
+	"javascript":          bsontype.JavaScript,
+	"symbol":              bsontype.Symbol,
+	"javascriptWithScope": bsontype.CodeWithScope,
+	"int":                 bsontype.Int32,
+	"timestamp":           bsontype.Timestamp,
+	"long":                bsontype.Int64,
+	"decimal":             bsontype.Decimal128,
+	"minKey":              bsontype.MinKey,
+	"maxKey":              bsontype.MaxKey,
+}
+
+// compileOperators compiles a document of operators on a field, all of which
+// are required to match.
+func compileOperators(doc bson.Raw) (valuePredicate, error) {
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	var options bson.RawValue
+	if v, err := doc.LookupErr("$options"); err == nil {
+		if _, err := doc.LookupErr("$regex"); err != nil {
+			return nil, invalidf("$options needs a $regex")
+		}
+		options = v
+	}
+
+	preds := make([]valuePredicate, 0, len(elems))
+	for _, elem := range elems {
+		op, value := elem.Key(), elem.Value()
+
+		var pred valuePredicate
+		switch op {
+		case "$eq":
+			pred = equals(value)
+		case "$ne":
+			pred = not(equals(value))
+		case "$gt", "$gte", "$lt", "$lte":
+			pred = comparison(op, value)
+		case "$in":
+			pred, err = in(value)
+		case "$nin":
+			pred, err = in(value)
+			pred = not(pred)
+		case "$exists":
+			pred = exists(truthy(value))
+		case "$type":
+			pred, err = hasType(value)
+		case "$regex":
+			pred, err = regex(value, options)
+		case "$options":
+			continue
+		case "$size":
+			pred, err = size(value)
+		case "$all":
+			pred, err = all(value)
+		case "$elemMatch":
+			pred, err = elemMatch(value)
+		case "$mod":
+			pred, err = mod(value)
+		case "$not":
+			pred, err = compileNot(value)
+		default:
+			return nil, invalidf("unknown operator: %s", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+
+	return func(values []bson.RawValue) bool {
+		for _, pred := range preds {
+			if !pred(values) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func not(pred valuePredicate) valuePredicate {
+	return func(values []bson.RawValue) bool {
+		return !pred(values)
+	}
+}
+
+func isNull(v bson.RawValue) bool {
+	return v.Type == 0 || v.Type == bsontype.Null || v.Type == bsontype.Undefined
+}
+
+// equals matches values equal to x. null matches null and missing values.
+func equals(x bson.RawValue) valuePredicate {
+	if isNull(x) {
+		return func(values []bson.RawValue) bool {
+			return len(values) == 0 || anyValue(values, isNull)
+		}
+	}
+
+	return func(values []bson.RawValue) bool {
+		return anyValue(values, func(v bson.RawValue) bool {
+			return Equal(v, x)
+		})
+	}
+}
+
+// comparison compiles $gt, $gte, $lt and $lte. Only values of the same
+// canonical type as x are compared, except with MinKey and MaxKey.
+func comparison(op string, x bson.RawValue) valuePredicate {
+	if isNull(x) && (op == "$gte" || op == "$lte") {
+		return equals(x)
+	}
+
+	test := func(c int) bool {
+		switch op {
+		case "$gt":
+			return c > 0
+		case "$gte":
+			return c >= 0
+		case "$lt":
+			return c < 0
+		default:
+			return c <= 0
+		}
+	}
+	crossType := x.Type == bsontype.MinKey || x.Type == bsontype.MaxKey
+
+	return func(values []bson.RawValue) bool {
+		return anyValue(values, func(v bson.RawValue) bool {
+			if v.Type == 0 {
+				return false
+			}
+			if !crossType && canonicalType(v.Type) != canonicalType(x.Type) {
+				return false
+			}
+			return test(Compare(v, x))
+		})
+	}
+}
+
+// in compiles $in, matching values equal to one of the entries of an array
+// or matching one of its regular expressions.
+func in(value bson.RawValue) (valuePredicate, error) {
+	arr, ok := value.ArrayOK()
+	if !ok {
+		return nil, invalidf("$in needs an array")
+	}
+	entries, err := arr.Values()
+	if err != nil {
+		return nil, err
+	}
+
+	preds := make([]valuePredicate, len(entries))
+	for i, entry := range entries {
+		if doc, ok := entry.DocumentOK(); ok && isOperatorDocument(doc) {
+			return nil, invalidf("cannot nest $ under $in")
+		}
+		if preds[i], err = compileEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(values []bson.RawValue) bool {
+		for _, pred := range preds {
+			if pred(values) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// compileEntry compiles an entry of $in or $all: a regular expression or a
+// value to compare with.
+func compileEntry(entry bson.RawValue) (valuePredicate, error) {
+	if entry.Type == bsontype.Regex {
+		return compileRegexValue(entry)
+	}
+	return equals(entry), nil
+}
+
+// truthy tells if a value is true in a boolean context.
+func truthy(v bson.RawValue) bool {
+	switch {
+	case v.Type == bsontype.Boolean:
+		return v.Boolean()
+	case isNumber(v):
+		return numberValue(v) != 0
+	case isNull(v):
+		return false
+	}
+	return true
+}
+
+// exists compiles $exists.
+func exists(want bool) valuePredicate {
+	return func(values []bson.RawValue) bool {
+		found := false
+		for _, v := range values {
+			if v.Type != 0 {
+				found = true
+				break
+			}
+		}
+		return found == want
+	}
+}
+
+// hasType compiles $type, matching values of one of the types given by
+// number or alias. "number" matches values of all numeric types.
+func hasType(value bson.RawValue) (valuePredicate, error) {
+	types := []bson.RawValue{value}
+	if arr, ok := value.ArrayOK(); ok {
+		var err error
+		if types, err = arr.Values(); err != nil {
+			return nil, err
+		}
+	}
+
+	var wanted []bsontype.Type
+	number := false
+	for _, t := range types {
+		switch {
+		case isNumber(t):
+			code := numberValue(t)
+			if code != math.Trunc(code) {
+				return nil, invalidf("invalid numerical type code: %v", code)
+			}
+			wanted = append(wanted, bsontype.Type(int8(code)))
+		case t.Type == bsontype.String && t.StringValue() == "number":
+			number = true
+		case t.Type == bsontype.String:
+			bt, ok := typeAliases[t.StringValue()]
+			if !ok {
+				return nil, invalidf("unknown type name alias: %s", t.StringValue())
+			}
+			wanted = append(wanted, bt)
+		default:
+			return nil, invalidf("type must be represented as a number or a string")
+		}
+	}
+
+	return func(values []bson.RawValue) bool {
+		return anyValue(values, func(v bson.RawValue) bool {
+			if v.Type == 0 {
+				return false
+			}
+			if number && isNumber(v) {
+				return true
+			}
+			for _, t := range wanted {
+				if v.Type == t {
+					return true
+				}
+			}
+			return false
+		})
+	}, nil
+}
+
+// regex compiles $regex with the optional $options.
+func regex(value, options bson.RawValue) (valuePredicate, error) {
+	var pattern, opts string
+	switch value.Type {
+	case bsontype.String:
+		pattern = value.StringValue()
+	case bsontype.Regex:
+		pattern, opts = value.Regex()
+	default:
+		return nil, invalidf("$regex has to be a string")
+	}
+
+	if options.Type != 0 {
+		s, ok := options.StringValueOK()
+		if !ok {
+			return nil, invalidf("$options has to be a string")
+		}
+		opts = s
+	}
+
+	return compileRegex(pattern, opts)
+}
+
+// compileRegexValue compiles a regular expression value.
+func compileRegexValue(value bson.RawValue) (valuePredicate, error) {
+	pattern, options := value.Regex()
+	return compileRegex(pattern, options)
+}
+
+// compileRegex matches strings and symbols matching the pattern, and equal
+// regular expressions.
+func compileRegex(pattern, options string) (valuePredicate, error) {
+	var flags string
+	expr := pattern
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		case 'x':
+			expr = extendedPattern(pattern)
+		default:
+			return nil, invalidf("invalid regex flag: %c", o)
+		}
+	}
+
+	if flags != "" {
+		expr = "(?" + flags + ")" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, invalidf("%s", err)
+	}
+
+	return func(values []bson.RawValue) bool {
+		return anyValue(values, func(v bson.RawValue) bool {
+			switch v.Type {
+			case bsontype.String, bsontype.Symbol:
+				return re.MatchString(stringValue(v))
+			case bsontype.Regex:
+				p, o := v.Regex()
+				return p == pattern && o == options
+			}
+			return false
+		})
+	}, nil
+}
+
+// extendedPattern removes the whitespace and the # comments of a pattern
+// using the 'x' flag, which Go regular expressions do not support. Escaped
+// characters and character classes are kept as is.
+func extendedPattern(pattern string) string {
+	var b strings.Builder
+	inClass, inComment := false, false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case inComment:
+			inComment = c != '\n'
+		case c == '\\' && i+1 < len(pattern):
+			b.WriteByte(c)
+			i++
+			b.WriteByte(pattern[i])
+		case inClass:
+			inClass = c != ']'
+			b.WriteByte(c)
+		case c == '[':
+			inClass = true
+			b.WriteByte(c)
+			// A ] right after the opening bracket is a member of the class
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				i++
+				b.WriteByte('^')
+			}
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				i++
+				b.WriteByte(']')
+			}
+		case c == '#':
+			inComment = true
+		case strings.IndexByte(" \t\n\r\f\v", c) >= 0:
+			// whitespace is ignored
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// size compiles $size, matching arrays with the given number of elements.
+func size(value bson.RawValue) (valuePredicate, error) {
+	if !isNumber(value) {
+		return nil, invalidf("$size needs a number")
+	}
+	n := numberValue(value)
+	if n != math.Trunc(n) || n < 0 {
+		return nil, invalidf("$size must be a whole non-negative number")
+	}
+
+	return func(values []bson.RawValue) bool {
+		for _, v := range values {
+			if v.Type != bsontype.Array {
+				continue
+			}
+			elems, _ := v.Array().Values()
+			if len(elems) == int(n) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// all compiles $all, matching when every entry matches.
+func all(value bson.RawValue) (valuePredicate, error) {
+	arr, ok := value.ArrayOK()
+	if !ok {
+		return nil, invalidf("$all needs an array")
+	}
+	entries, err := arr.Values()
+	if err != nil {
+		return nil, err
+	}
+
+	preds := make([]valuePredicate, len(entries))
+	for i, entry := range entries {
+		if doc, ok := entry.DocumentOK(); ok && isOperatorDocument(doc) {
+			elemMatchValue, err := doc.LookupErr("$elemMatch")
+			if err != nil {
+				return nil, invalidf("no $ expressions in $all except $elemMatch")
+			}
+			preds[i], err = elemMatch(elemMatchValue)
+		} else {
+			preds[i], err = compileEntry(entry)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(values []bson.RawValue) bool {
+		if len(preds) == 0 {
+			return false
+		}
+		for _, pred := range preds {
+			if !pred(values) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// elemMatch compiles $elemMatch, matching arrays with an element matching
+// all the conditions. The conditions are operators applied to the elements,
+// or a filter applied to the document elements.
+func elemMatch(value bson.RawValue) (valuePredicate, error) {
+	doc, ok := value.DocumentOK()
+	if !ok {
+		return nil, invalidf("$elemMatch needs an object")
+	}
+
+	var match predicate
+	if isOperatorDocument(doc) && !isLogicalDocument(doc) {
+		pred, err := compileOperators(doc)
+		if err != nil {
+			return nil, err
+		}
+		match = func(elem bson.RawValue) bool {
+			return pred([]bson.RawValue{elem})
+		}
+	} else {
+		pred, err := compileDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		match = func(elem bson.RawValue) bool {
+			return elem.Type == bsontype.EmbeddedDocument && pred(elem)
+		}
+	}
+
+	return func(values []bson.RawValue) bool {
+		for _, v := range values {
+			if v.Type != bsontype.Array {
+				continue
+			}
+			elems, _ := v.Array().Values()
+			for _, elem := range elems {
+				if match(elem) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// isLogicalDocument tells if the first field of doc is a logical operator.
+func isLogicalDocument(doc bson.Raw) bool {
+	elems, err := doc.Elements()
+	if err != nil || len(elems) == 0 {
+		return false
+	}
+	switch elems[0].Key() {
+	case "$and", "$or", "$nor":
+		return true
+	}
+	return false
+}
+
+// mod compiles $mod, matching numbers whose remainder of the division by a
+// divisor is a given remainder.
+func mod(value bson.RawValue) (valuePredicate, error) {
+	arr, ok := value.ArrayOK()
+	if !ok {
+		return nil, invalidf("malformed mod, needs to be an array")
+	}
+	args, err := arr.Values()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 2 {
+		return nil, invalidf("malformed mod, not enough elements")
+	}
+	if !isNumber(args[0]) || !isNumber(args[1]) {
+		return nil, invalidf("malformed mod, divisor and remainder must be numbers")
+	}
+
+	divisor, remainder := truncate(args[0]), truncate(args[1])
+	if divisor == 0 {
+		return nil, invalidf("divisor cannot be 0")
+	}
+
+	return func(values []bson.RawValue) bool {
+		return anyValue(values, func(v bson.RawValue) bool {
+			return isNumber(v) && truncate(v)%divisor == remainder
+		})
+	}, nil
+}
+
+// truncate returns a number truncated to an int64.
+func truncate(v bson.RawValue) int64 {
+	if isInteger(v) {
+		return intValue(v)
+	}
+	return int64(numberValue(v))
+}
+
+// compileNot compiles $not, matching values not matching a document of
+// operators or a regular expression.
+func compileNot(value bson.RawValue) (valuePredicate, error) {
+	var pred valuePredicate
+	var err error
+	switch value.Type {
+	case bsontype.Regex:
+		pred, err = compileRegexValue(value)
+	case bsontype.EmbeddedDocument:
+		doc := value.Document()
+		if !isOperatorDocument(doc) {
+			return nil, invalidf("$not needs a regex or a document of operators")
+		}
+		pred, err = compileOperators(doc)
+	default:
+		return nil, invalidf("$not needs a regex or a document")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return not(pred), nil
+}
@@ -0,0 +1,170 @@
+package memstore
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/orktes/mongache/pkg/aggregate"
+	"github.com/orktes/mongache/pkg/server"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// readCollection returns the collection name of database db for a read.
+// Reads do not create databases and collections: a missing collection is
+// read as an empty one that is not added to the store.
+func (s *Store) readCollection(db, name string) *Collection {
+	if d, ok := s.LookupDatabase(db); ok {
+		if coll, ok := d.LookupCollection(name); ok {
+			return coll
+		}
+	}
+	return &Collection{name: name}
+}
+
+// Query is a server.QueryHandler answering queries from the store.
+func (s *Store) Query(ctx context.Context, collection string, q bson.M, fields bson.M) (server.Cursor, error) {
+	db, name := collection, ""
+	if i := strings.IndexByte(collection, '.'); i >= 0 {
+		db, name = collection[:i], collection[i+1:]
+	}
+	return s.readCollection(db, name).Find(q, fields, nil)
+}
+
+// Find is a server.FindHandler answering queries from the store.
+func (s *Store) Find(ctx context.Context, req *server.FindRequest) (server.Cursor, error) {
+	cur, err := s.readCollection(req.Database, req.Collection).Find(req.Filter, req.Projection, req.Sort)
+	if err != nil {
+		return nil, err
+	}
+	return cur, cur.Skip(ctx, req.Skip)
+}
+
+// writeError returns the write error of a failed document or statement.
+func writeError(i int, err error) server.WriteError {
+	var serr *server.Error
+	if errors.As(err, &serr) {
+		return server.WriteError{Index: int32(i), Code: serr.Code, Message: serr.Message}
+	}
+	return server.WriteError{Index: int32(i), Code: server.ErrorCodeInternalError, Message: err.Error()}
+}
+
+// Insert is a server.InsertHandler inserting documents into the store.
+func (s *Store) Insert(ctx context.Context, req *server.InsertRequest) (*server.WriteResult, error) {
+	coll := s.Database(req.Database).Collection(req.Collection)
+
+	res := &server.WriteResult{}
+	for i, doc := range req.Documents {
+		if _, err := coll.Insert(doc); err != nil {
+			res.WriteErrors = append(res.WriteErrors, writeError(i, err))
+			if req.Ordered {
+				break
+			}
+			continue
+		}
+		res.N++
+	}
+	return res, nil
+}
+
+// Update is a server.UpdateHandler updating documents of the store.
+// Aggregation pipeline updates are not supported.
+func (s *Store) Update(ctx context.Context, req *server.UpdateRequest) (*server.WriteResult, error) {
+	coll := s.Database(req.Database).Collection(req.Collection)
+
+	res := &server.WriteResult{}
+	for i, stmt := range req.Updates {
+		// A failed statement may have updated some documents already
+		r, err := updateStatement(coll, stmt)
+		if r != nil {
+			res.N += int32(r.Matched)
+			res.NModified += int32(r.Modified)
+		}
+		if err != nil {
+			res.WriteErrors = append(res.WriteErrors, writeError(i, err))
+			if req.Ordered {
+				break
+			}
+			continue
+		}
+
+		if r.UpsertedID != nil {
+			res.N++
+			res.Upserted = append(res.Upserted, server.Upserted{Index: int32(i), ID: r.UpsertedID})
+		}
+	}
+	return res, nil
+}
+
+func updateStatement(coll *Collection, stmt server.UpdateStatement) (*UpdateResult, error) {
+	update, ok := stmt.Update.DocumentOK()
+	if !ok {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "update must be a document, got %s", stmt.Update.Type)
+	}
+	return coll.Update(stmt.Filter, update, UpdateOptions{Multi: stmt.Multi, Upsert: stmt.Upsert})
+}
+
+// Delete is a server.DeleteHandler deleting documents of the store.
+func (s *Store) Delete(ctx context.Context, req *server.DeleteRequest) (*server.WriteResult, error) {
+	coll := s.Database(req.Database).Collection(req.Collection)
+
+	res := &server.WriteResult{}
+	for i, stmt := range req.Deletes {
+		n, err := coll.Delete(stmt.Filter, int(stmt.Limit))
+		res.N += int32(n)
+		if err != nil {
+			res.WriteErrors = append(res.WriteErrors, writeError(i, err))
+			if req.Ordered {
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+type countCommand struct {
+	Query bson.M `bson:"query"`
+	Skip  int64  `bson:"skip"`
+	Limit int64  `bson:"limit"`
+}
+
+// Count implements the count command.
+func (s *Store) Count(ctx context.Context, cmd *server.Command) (bson.D, error) {
+	name, ok := cmd.Argument().StringValueOK()
+	if !ok {
+		return nil, server.Errorf(server.ErrorCodeInvalidNamespace, "collection name has invalid type %s", cmd.Argument().Type)
+	}
+
+	var args countCommand
+	if err := bson.Unmarshal(cmd.Doc, &args); err != nil {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "%s", err)
+	}
+
+	n, err := s.readCollection(cmd.Database, name).Count(args.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	count := int64(n) - args.Skip
+	if count < 0 {
+		count = 0
+	}
+	if args.Limit < 0 {
+		args.Limit = -args.Limit
+	}
+	if args.Limit != 0 && count > args.Limit {
+		count = args.Limit
+	}
+	return bson.D{{Key: "n", Value: int32(count)}}, nil
+}
+
+// Register makes srv answer queries, aggregations, writes and counts from
+// the store.
+func (s *Store) Register(srv *server.Server) {
+	srv.FindHandler = s.Find
+	srv.AggregateHandler = aggregate.Handler(s.Find)
+	srv.InsertHandler = s.Insert
+	srv.UpdateHandler = s.Update
+	srv.DeleteHandler = s.Delete
+	srv.RegisterCommand("count", s.Count)
+}
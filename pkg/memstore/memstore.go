@@ -0,0 +1,348 @@
+// Package memstore implements in-memory MongoDB databases that can back a
+// server.Server
+package memstore
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/orktes/mongache/pkg/match"
+	"github.com/orktes/mongache/pkg/server"
+	"github.com/orktes/mongache/pkg/slice"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Store holds databases. The zero value is an empty store.
+type Store struct {
+	mu  sync.RWMutex
+	dbs map[string]*Database
+}
+
+// New returns an empty store.
+func New() *Store {
+	return &Store{}
+}
+
+// Database returns the database name, creating it if needed.
+func (s *Store) Database(name string) *Database {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dbs == nil {
+		s.dbs = map[string]*Database{}
+	}
+	db, ok := s.dbs[name]
+	if !ok {
+		db = &Database{name: name, collections: map[string]*Collection{}}
+		s.dbs[name] = db
+	}
+	return db
+}
+
+// LookupDatabase returns the database name. It reports false if the store
+// has no such database.
+func (s *Store) LookupDatabase(name string) (*Database, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db, ok := s.dbs[name]
+	return db, ok
+}
+
+// DatabaseNames returns the names of the databases of the store, sorted.
+func (s *Store) DatabaseNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.dbs))
+	for name := range s.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Database holds collections.
+type Database struct {
+	name string
+
+	mu          sync.RWMutex
+	collections map[string]*Collection
+}
+
+// Name returns the name of the database.
+func (db *Database) Name() string {
+	return db.name
+}
+
+// Collection returns the collection name, creating it if needed.
+func (db *Database) Collection(name string) *Collection {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	coll, ok := db.collections[name]
+	if !ok {
+		coll = &Collection{name: name, ids: map[string]struct{}{}}
+		db.collections[name] = coll
+	}
+	return coll
+}
+
+// LookupCollection returns the collection name. It reports false if the
+// database has no such collection.
+func (db *Database) LookupCollection(name string) (*Collection, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	coll, ok := db.collections[name]
+	return coll, ok
+}
+
+// CollectionNames returns the names of the collections of the database,
+// sorted.
+func (db *Database) CollectionNames() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	names := make([]string, 0, len(db.collections))
+	for name := range db.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Drop removes the collection name. It reports whether the collection
+// existed.
+func (db *Database) Drop(name string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, ok := db.collections[name]
+	delete(db.collections, name)
+	return ok
+}
+
+// Collection holds documents in insertion order.
+type Collection struct {
+	name string
+
+	mu   sync.RWMutex
+	docs []bson.Raw
+	ids  map[string]struct{} // keys of the _id of the documents
+}
+
+// Name returns the name of the collection.
+func (c *Collection) Name() string {
+	return c.name
+}
+
+// idKey returns the key of an _id in the index of the collection.
+func idKey(id bson.RawValue) string {
+	return string(id.Type) + string(id.Value)
+}
+
+// withID returns doc with an ObjectId _id prepended when it has none.
+func withID(doc bson.Raw) (bson.Raw, error) {
+	if _, err := doc.LookupErr("_id"); err == nil {
+		return doc, nil
+	}
+
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	d := bson.D{{Key: "_id", Value: primitive.NewObjectID()}}
+	for _, elem := range elems {
+		d = append(d, bson.E{Key: elem.Key(), Value: elem.Value()})
+	}
+	return bson.Marshal(d)
+}
+
+func toDocument(v interface{}) (bson.Raw, error) {
+	switch v := v.(type) {
+	case bson.Raw:
+		return v, nil
+	case []byte:
+		return bson.Raw(v), nil
+	}
+	return bson.Marshal(v)
+}
+
+// insertLocked inserts a document. c.mu must be held.
+func (c *Collection) insertLocked(v interface{}) (bson.RawValue, error) {
+	doc, err := toDocument(v)
+	if err != nil {
+		return bson.RawValue{}, server.Errorf(server.ErrorCodeBadValue, "invalid document: %s", err)
+	}
+	if doc, err = withID(doc); err != nil {
+		return bson.RawValue{}, server.Errorf(server.ErrorCodeBadValue, "invalid document: %s", err)
+	}
+
+	id := doc.Lookup("_id")
+	if id.Type == bson.TypeArray {
+		return bson.RawValue{}, server.Errorf(server.ErrorCodeBadValue, "can't use an array for _id")
+	}
+	key := idKey(id)
+	if _, ok := c.ids[key]; ok {
+		return bson.RawValue{}, server.Errorf(server.ErrorCodeDuplicateKey, "E11000 duplicate key error collection: %s index: _id_ dup key: { _id: %s }", c.name, id)
+	}
+
+	c.ids[key] = struct{}{}
+	c.docs = append(c.docs, doc)
+	return id, nil
+}
+
+// Insert inserts documents, bson.Raw or values marshalling to BSON
+// documents, generating an ObjectId _id for documents without one. It stops
+// at the first document that can't be inserted, and returns the _id of the
+// inserted documents.
+func (c *Collection) Insert(docs ...interface{}) ([]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ids := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		id, err := c.insertLocked(doc)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// snapshot returns the documents matching filter.
+func (c *Collection) snapshot(filter interface{}) ([]bson.Raw, error) {
+	matcher, err := compile(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var docs []bson.Raw
+	for _, doc := range c.docs {
+		if matcher.MatchRaw(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+func compile(filter interface{}) (*match.Matcher, error) {
+	m, err := match.Compile(filter)
+	if err != nil {
+		return nil, server.Errorf(server.ErrorCodeBadValue, "%s", err)
+	}
+	return m, nil
+}
+
+// Find returns a cursor over the documents matching filter, sorted and
+// projected. The cursor iterates over a snapshot of the collection.
+func (c *Collection) Find(filter, projection interface{}, sortBy bson.D) (*slice.Cursor, error) {
+	docs, err := c.snapshot(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := slice.NewQueryCursor(docs, nil, projection, sortBy)
+	if err != nil {
+		return nil, server.Errorf(server.ErrorCodeBadValue, "%s", err)
+	}
+	return cur, nil
+}
+
+// Count returns the number of documents matching filter.
+func (c *Collection) Count(filter interface{}) (int, error) {
+	docs, err := c.snapshot(filter)
+	return len(docs), err
+}
+
+// Delete deletes up to limit documents matching filter, all of them when
+// limit is zero. It returns the number of deleted documents.
+func (c *Collection) Delete(filter interface{}, limit int) (int, error) {
+	matcher, err := compile(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	kept := c.docs[:0]
+	for _, doc := range c.docs {
+		if (limit == 0 || n < limit) && matcher.MatchRaw(doc) {
+			delete(c.ids, idKey(doc.Lookup("_id")))
+			n++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	for i := len(kept); i < len(c.docs); i++ {
+		c.docs[i] = nil
+	}
+	c.docs = kept
+	return n, nil
+}
+
+// UpdateOptions configures an update.
+type UpdateOptions struct {
+	Multi  bool // update all matching documents instead of the first
+	Upsert bool // insert a document when none matches
+}
+
+// UpdateResult is the outcome of an update.
+type UpdateResult struct {
+	Matched    int
+	Modified   int
+	UpsertedID interface{} // _id of the inserted document, nil if none was
+}
+
+// Update applies an update document of operators or a replacement document
+// to the documents matching filter.
+func (c *Collection) Update(filter, update interface{}, opts UpdateOptions) (*UpdateResult, error) {
+	matcher, err := compile(filter)
+	if err != nil {
+		return nil, err
+	}
+	upd, err := toDocument(update)
+	if err != nil {
+		return nil, server.Errorf(server.ErrorCodeFailedToParse, "invalid update: %s", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := &UpdateResult{}
+	for i, doc := range c.docs {
+		if !matcher.MatchRaw(doc) {
+			continue
+		}
+
+		res.Matched++
+		updated, err := applyUpdate(doc, upd)
+		if err != nil {
+			return res, err
+		}
+		if !bytesEqual(doc, updated) {
+			c.docs[i] = updated
+			res.Modified++
+		}
+		if !opts.Multi {
+			break
+		}
+	}
+
+	if res.Matched == 0 && opts.Upsert {
+		doc, err := upsertDocument(filter, upd)
+		if err != nil {
+			return res, err
+		}
+		id, err := c.insertLocked(doc)
+		if err != nil {
+			return res, err
+		}
+		res.UpsertedID = id
+	}
+	return res, nil
+}
+
+func bytesEqual(a, b bson.Raw) bool {
+	return string(a) == string(b)
+}
@@ -0,0 +1,226 @@
+package memstore_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/orktes/mongache/pkg/memstore"
+	"github.com/orktes/mongache/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func findAll(t *testing.T, coll *memstore.Collection, filter interface{}) []bson.M {
+	cur, err := coll.Find(filter, bson.M{"_id": 0}, bson.D{{Key: "n", Value: 1}})
+	if !assert.NoError(t, err) {
+		return nil
+	}
+
+	var docs []bson.M
+	for {
+		v, err := cur.Next(context.Background())
+		if err != nil {
+			break
+		}
+		var doc bson.M
+		assert.NoError(t, bson.Unmarshal(v.([]byte), &doc))
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func TestCollection(t *testing.T) {
+	coll := memstore.New().Database("db").Collection("c")
+
+	ids, err := coll.Insert(bson.M{"n": 1}, bson.M{"_id": "b", "n": 2})
+	assert.NoError(t, err)
+	if assert.Len(t, ids, 2) {
+		assert.Equal(t, bson.TypeObjectID, ids[0].(bson.RawValue).Type)
+		assert.Equal(t, "b", ids[1].(bson.RawValue).StringValue())
+	}
+
+	_, err = coll.Insert(bson.M{"_id": "b"})
+	assert.Equal(t, server.ErrorCodeDuplicateKey, err.(*server.Error).Code)
+
+	n, err := coll.Count(bson.M{"n": bson.M{"$gte": 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	res, err := coll.Update(bson.M{"_id": "b"}, bson.M{"_id": "c"}, memstore.UpdateOptions{})
+	assert.Equal(t, server.ErrorCodeImmutableField, err.(*server.Error).Code)
+	assert.Equal(t, 1, res.Matched)
+
+	res, err = coll.Update(bson.M{"n": 3, "tag": bson.M{"$eq": "x"}}, bson.M{"$inc": bson.M{"count": 1}}, memstore.UpdateOptions{Upsert: true})
+	assert.NoError(t, err)
+	assert.NotNil(t, res.UpsertedID)
+
+	n, err = coll.Delete(bson.M{"n": bson.M{"$lt": 3}}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []bson.M{
+		{"n": int32(2)},
+		{"n": int32(3), "tag": "x", "count": int32(1)},
+	}, findAll(t, coll, nil))
+}
+
+func TestUpdateOperators(t *testing.T) {
+	tests := []struct {
+		update interface{}
+		want   bson.M
+		code   server.ErrorCode
+	}{
+		{bson.M{"$set": bson.M{"a.b": 1, "n": 2}}, bson.M{"n": int32(2), "tags": bson.A{"x", "y"}, "a": bson.M{"b": int32(1)}}, 0},
+		{bson.M{"$set": bson.M{"tags.3": "z"}}, bson.M{"n": int32(1), "tags": bson.A{"x", "y", nil, "z"}}, 0},
+		{bson.M{"$set": bson.M{"n.x": 1}}, nil, server.ErrorCodeBadValue},
+		{bson.M{"$unset": bson.M{"tags": ""}}, bson.M{"n": int32(1)}, 0},
+		{bson.M{"$inc": bson.M{"n": 1.5, "m": int64(2)}}, bson.M{"n": 2.5, "m": int64(2), "tags": bson.A{"x", "y"}}, 0},
+		{bson.M{"$inc": bson.M{"tags": 1}}, nil, server.ErrorCodeTypeMismatch},
+		{bson.M{"$push": bson.M{"tags": "x"}}, bson.M{"n": int32(1), "tags": bson.A{"x", "y", "x"}}, 0},
+		{bson.M{"$push": bson.M{"tags": bson.M{"$each": bson.A{"z", "w"}}}}, bson.M{"n": int32(1), "tags": bson.A{"x", "y", "z", "w"}}, 0},
+		{bson.M{"$push": bson.M{"n": 1}}, nil, server.ErrorCodeBadValue},
+		{bson.M{"$addToSet": bson.M{"tags": bson.M{"$each": bson.A{"y", "z"}}}}, bson.M{"n": int32(1), "tags": bson.A{"x", "y", "z"}}, 0},
+		{bson.M{"$pull": bson.M{"tags": "x"}}, bson.M{"n": int32(1), "tags": bson.A{"y"}}, 0},
+		{bson.M{"$pull": bson.M{"tags": bson.M{"$in": bson.A{"x", "y"}}}}, bson.M{"n": int32(1), "tags": bson.A{}}, 0},
+		{bson.M{"$rename": bson.M{"tags": "labels"}}, bson.M{"n": int32(1), "labels": bson.A{"x", "y"}}, 0},
+		{bson.M{"$set": bson.M{"_id": 2}}, nil, server.ErrorCodeImmutableField},
+		{bson.M{"$foo": bson.M{"n": 1}}, nil, server.ErrorCodeFailedToParse},
+		{bson.M{"m": 1}, bson.M{"m": int32(1)}, 0},
+	}
+
+	for _, test := range tests {
+		coll := memstore.New().Database("db").Collection("c")
+		_, err := coll.Insert(bson.M{"_id": 1, "n": 1, "tags": bson.A{"x", "y"}})
+		assert.NoError(t, err)
+
+		_, err = coll.Update(nil, test.update, memstore.UpdateOptions{})
+		if test.code != 0 {
+			if assert.IsType(t, &server.Error{}, err, "%v", test.update) {
+				assert.Equal(t, test.code, err.(*server.Error).Code, "%v", test.update)
+			}
+			continue
+		}
+		assert.NoError(t, err, "%v", test.update)
+		assert.Equal(t, []bson.M{test.want}, findAll(t, coll, nil), "%v", test.update)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	store := memstore.New()
+	ctx := context.Background()
+
+	cur, err := store.Find(ctx, &server.FindRequest{Database: "db", Collection: "missing", Filter: bson.M{"n": 1}})
+	if assert.NoError(t, err) {
+		_, err = cur.Next(ctx)
+		assert.Equal(t, io.EOF, err)
+	}
+	_, err = store.Query(ctx, "db.missing", nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, store.DatabaseNames())
+
+	_, err = store.Database("db").Collection("c").Insert(bson.M{"n": 1}, bson.M{"n": "x"}, bson.M{"n": 2})
+	assert.NoError(t, err)
+
+	inc, _ := bson.Marshal(bson.M{"$inc": bson.M{"n": 1}})
+	res, err := store.Update(ctx, &server.UpdateRequest{
+		Database:   "db",
+		Collection: "c",
+		Updates:    []server.UpdateStatement{{Update: bson.RawValue{Type: bson.TypeEmbeddedDocument, Value: inc}, Multi: true}},
+		Ordered:    true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), res.N)
+	assert.Equal(t, int32(1), res.NModified)
+	if assert.Len(t, res.WriteErrors, 1) {
+		assert.Equal(t, server.ErrorCodeTypeMismatch, res.WriteErrors[0].Code)
+	}
+}
+
+func TestServer(t *testing.T) {
+	store := memstore.New()
+	s := &server.Server{}
+	store.Register(s)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go s.Listen(ln)
+	defer s.Close()
+
+	ctx := context.Background()
+	cli, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+ln.Addr().String()))
+	assert.NoError(t, err)
+	defer cli.Disconnect(ctx)
+
+	coll := cli.Database("foo").Collection("test")
+
+	insertRes, err := coll.InsertMany(ctx, []interface{}{
+		bson.M{"name": "a", "n": 1},
+		bson.M{"name": "b", "n": 2},
+		bson.M{"name": "c", "n": 3},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, insertRes.InsertedIDs, 3) {
+		assert.IsType(t, primitive.ObjectID{}, insertRes.InsertedIDs[0])
+	}
+
+	_, err = coll.InsertOne(ctx, bson.M{"_id": insertRes.InsertedIDs[0]})
+	if writeErr, ok := err.(mongo.WriteException); assert.True(t, ok, "%v", err) && assert.Len(t, writeErr.WriteErrors, 1) {
+		assert.Equal(t, int(server.ErrorCodeDuplicateKey), writeErr.WriteErrors[0].Code)
+	}
+
+	updateRes, err := coll.UpdateMany(ctx, bson.M{"n": bson.M{"$gte": 2}}, bson.M{"$inc": bson.M{"n": 10}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), updateRes.MatchedCount)
+	assert.Equal(t, int64(2), updateRes.ModifiedCount)
+
+	updateRes, err = coll.UpdateOne(ctx, bson.M{"name": "d"}, bson.M{"$set": bson.M{"n": 4}}, options.Update().SetUpsert(true))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), updateRes.MatchedCount)
+	assert.IsType(t, primitive.ObjectID{}, updateRes.UpsertedID)
+
+	cur, err := coll.Find(ctx, bson.M{"n": bson.M{"$gt": 1}},
+		options.Find().SetSort(bson.D{{Key: "n", Value: -1}}).SetSkip(1).SetProjection(bson.M{"_id": 0}))
+	assert.NoError(t, err)
+	var docs []bson.M
+	assert.NoError(t, cur.All(ctx, &docs))
+	assert.Equal(t, []bson.M{
+		{"name": "b", "n": int32(12)},
+		{"name": "d", "n": int32(4)},
+	}, docs)
+
+	var res bson.M
+	assert.NoError(t, cli.Database("foo").RunCommand(ctx, bson.D{{Key: "count", Value: "test"}, {Key: "query", Value: bson.M{"n": bson.M{"$gt": 1}}}}).Decode(&res))
+	assert.EqualValues(t, 3, res["n"])
+	assert.NoError(t, cli.Database("foo").RunCommand(ctx, bson.D{{Key: "count", Value: "test"}, {Key: "limit", Value: 2}}).Decode(&res))
+	assert.EqualValues(t, 2, res["n"])
+
+	n, err := coll.CountDocuments(ctx, bson.M{"n": bson.M{"$gt": 1}}, options.Count().SetSkip(1))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	cur, err = coll.Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"n": bson.M{"$gt": 1}}},
+		bson.M{"$sort": bson.M{"name": 1}},
+		bson.M{"$project": bson.M{"_id": "$name", "big": bson.M{"$gt": bson.A{"$n", 10}}}},
+	}, options.Aggregate().SetBatchSize(1))
+	assert.NoError(t, err)
+	docs = nil
+	assert.NoError(t, cur.All(ctx, &docs))
+	assert.Equal(t, []bson.M{
+		{"_id": "b", "big": true},
+		{"_id": "c", "big": true},
+		{"_id": "d", "big": false},
+	}, docs)
+
+	deleteRes, err := coll.DeleteMany(ctx, bson.M{"n": bson.M{"$gt": 10}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), deleteRes.DeletedCount)
+
+	n, err = coll.EstimatedDocumentCount(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
@@ -0,0 +1,505 @@
+package memstore
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/orktes/mongache/pkg/match"
+	"github.com/orktes/mongache/pkg/server"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// isOperatorDocument tells if the first field of doc is an operator.
+func isOperatorDocument(doc bson.Raw) bool {
+	elems, err := doc.Elements()
+	return err == nil && len(elems) > 0 && strings.HasPrefix(elems[0].Key(), "$")
+}
+
+// applyUpdate returns doc updated with an update document of operators or
+// replaced by a replacement document. The _id of doc can't change.
+func applyUpdate(doc, update bson.Raw) (bson.Raw, error) {
+	id := doc.Lookup("_id")
+
+	var updated bson.D
+	if !isOperatorDocument(update) {
+		elems, err := update.Elements()
+		if err != nil {
+			return nil, err
+		}
+		updated = bson.D{{Key: "_id", Value: id}}
+		for _, elem := range elems {
+			if elem.Key() == "_id" {
+				continue
+			}
+			if strings.HasPrefix(elem.Key(), "$") {
+				return nil, server.Errorf(server.ErrorCodeFailedToParse, "the replacement document can't contain the operator %s", elem.Key())
+			}
+			updated = append(updated, bson.E{Key: elem.Key(), Value: elem.Value()})
+		}
+		if newID, err := update.LookupErr("_id"); err == nil && !match.Equal(newID, id) {
+			return nil, errImmutableID()
+		}
+	} else {
+		if err := bson.Unmarshal(doc, &updated); err != nil {
+			return nil, err
+		}
+		var err error
+		if updated, err = applyOperators(updated, update); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := bson.Marshal(updated)
+	if err != nil {
+		return nil, err
+	}
+	if newID, err := bson.Raw(b).LookupErr("_id"); id.Type != 0 && (err != nil || !match.Equal(newID, id)) {
+		return nil, errImmutableID()
+	}
+	return b, nil
+}
+
+func errImmutableID() error {
+	return server.Errorf(server.ErrorCodeImmutableField, "Performing an update on the path '_id' would modify the immutable field '_id'")
+}
+
+// applyOperators applies the operators of an update document.
+func applyOperators(doc bson.D, update bson.Raw) (bson.D, error) {
+	ops, err := update.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range ops {
+		args, ok := op.Value().DocumentOK()
+		if !ok {
+			return nil, server.Errorf(server.ErrorCodeFailedToParse, "Modifiers operate on fields but we found type %s instead", op.Value().Type)
+		}
+		fields, err := args.Elements()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, field := range fields {
+			path := strings.Split(field.Key(), ".")
+			value := field.Value()
+
+			var v interface{} = doc
+			switch op.Key() {
+			case "$set":
+				v, err = setValue(v, path, value)
+			case "$unset":
+				v = unsetValue(v, path)
+			case "$inc":
+				v, err = inc(v, path, value)
+			case "$push":
+				v, err = push(v, path, value, false)
+			case "$addToSet":
+				v, err = push(v, path, value, true)
+			case "$pull":
+				v, err = pull(v, path, value)
+			case "$rename":
+				v, err = rename(v, path, value)
+			default:
+				return nil, server.Errorf(server.ErrorCodeFailedToParse, "Unknown modifier: %s", op.Key())
+			}
+			if err != nil {
+				return nil, err
+			}
+			doc = v.(bson.D)
+		}
+	}
+	return doc, nil
+}
+
+// getValue returns the value of a path in a document or array.
+func getValue(container interface{}, path []string) (interface{}, bool) {
+	var v interface{}
+	switch c := container.(type) {
+	case bson.D:
+		found := false
+		for _, e := range c {
+			if e.Key == path[0] {
+				v, found = e.Value, true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	case bson.A:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(c) {
+			return nil, false
+		}
+		v = c[i]
+	default:
+		return nil, false
+	}
+
+	if len(path) == 1 {
+		return v, true
+	}
+	return getValue(v, path[1:])
+}
+
+// setValue sets the value of a path in a document or array, creating the
+// missing documents on the path, and returns the updated container.
+func setValue(container interface{}, path []string, value interface{}) (interface{}, error) {
+	switch c := container.(type) {
+	case bson.D:
+		for i, e := range c {
+			if e.Key != path[0] {
+				continue
+			}
+			if len(path) == 1 {
+				c[i].Value = value
+				return c, nil
+			}
+			v, err := setValue(e.Value, path[1:], value)
+			c[i].Value = v
+			return c, err
+		}
+
+		if len(path) == 1 {
+			return append(c, bson.E{Key: path[0], Value: value}), nil
+		}
+		v, err := setValue(bson.D{}, path[1:], value)
+		return append(c, bson.E{Key: path[0], Value: v}), err
+	case bson.A:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 {
+			return c, server.Errorf(server.ErrorCodeBadValue, "cannot create field '%s' in an array", path[0])
+		}
+		for len(c) <= i {
+			c = append(c, nil)
+		}
+		if len(path) == 1 {
+			c[i] = value
+			return c, nil
+		}
+
+		elem := c[i]
+		if elem == nil {
+			elem = bson.D{}
+		}
+		v, err := setValue(elem, path[1:], value)
+		c[i] = v
+		return c, err
+	}
+	return container, server.Errorf(server.ErrorCodeBadValue, "cannot create field '%s' in element %v", path[0], container)
+}
+
+// unsetValue removes a path from a document. Array elements are set to null
+// rather than removed.
+func unsetValue(container interface{}, path []string) interface{} {
+	switch c := container.(type) {
+	case bson.D:
+		for i, e := range c {
+			if e.Key != path[0] {
+				continue
+			}
+			if len(path) == 1 {
+				return append(c[:i:i], c[i+1:]...)
+			}
+			c[i].Value = unsetValue(e.Value, path[1:])
+			return c
+		}
+	case bson.A:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(c) {
+			return c
+		}
+		if len(path) == 1 {
+			c[i] = nil
+		} else {
+			c[i] = unsetValue(c[i], path[1:])
+		}
+	}
+	return container
+}
+
+// rawValue returns a value as a bson.RawValue.
+func rawValue(v interface{}) (bson.RawValue, error) {
+	if rv, ok := v.(bson.RawValue); ok {
+		return rv, nil
+	}
+	b, err := bson.Marshal(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return bson.RawValue{}, err
+	}
+	return bson.Raw(b).Lookup("v"), nil
+}
+
+// inc adds a number to the number of a path, setting it when missing.
+func inc(doc interface{}, path []string, delta bson.RawValue) (interface{}, error) {
+	if !delta.IsNumber() {
+		return doc, server.Errorf(server.ErrorCodeTypeMismatch, "Cannot increment with non-numeric argument")
+	}
+
+	current, ok := getValue(doc, path)
+	if !ok {
+		return setValue(doc, path, delta)
+	}
+	cur, err := rawValue(current)
+	if err != nil {
+		return doc, err
+	}
+	if !cur.IsNumber() {
+		return doc, server.Errorf(server.ErrorCodeTypeMismatch, "Cannot apply $inc to a value of non-numeric type")
+	}
+
+	return setValue(doc, path, add(cur, delta))
+}
+
+// add adds two numbers, widening int32 to int64 on overflow and to float64
+// when either is a double.
+func add(a, b bson.RawValue) interface{} {
+	if a.Type == bson.TypeDouble || b.Type == bson.TypeDouble || a.Type == bson.TypeDecimal128 || b.Type == bson.TypeDecimal128 {
+		return toFloat(a) + toFloat(b)
+	}
+
+	sum := toInt(a) + toInt(b)
+	if a.Type == bson.TypeInt32 && b.Type == bson.TypeInt32 && sum >= math.MinInt32 && sum <= math.MaxInt32 {
+		return int32(sum)
+	}
+	return sum
+}
+
+func toInt(v bson.RawValue) int64 {
+	if v.Type == bson.TypeInt32 {
+		return int64(v.Int32())
+	}
+	return v.Int64()
+}
+
+func toFloat(v bson.RawValue) float64 {
+	switch v.Type {
+	case bson.TypeInt32:
+		return float64(v.Int32())
+	case bson.TypeInt64:
+		return float64(v.Int64())
+	case bson.TypeDecimal128:
+		f, _ := strconv.ParseFloat(v.Decimal128().String(), 64)
+		return f
+	}
+	return v.Double()
+}
+
+// arrayValue returns the array of a path, an empty array when the path is
+// missing.
+func arrayValue(doc interface{}, path []string, op string) (bson.A, error) {
+	current, ok := getValue(doc, path)
+	if !ok {
+		return bson.A{}, nil
+	}
+	arr, ok := current.(bson.A)
+	if !ok {
+		return nil, server.Errorf(server.ErrorCodeBadValue, "The field '%s' must be an array to apply %s", strings.Join(path, "."), op)
+	}
+	return arr, nil
+}
+
+// push appends a value, or the values of $each, to the array of a path.
+// With unique, values already in the array are skipped.
+func push(doc interface{}, path []string, value bson.RawValue, unique bool) (interface{}, error) {
+	op := "$push"
+	if unique {
+		op = "$addToSet"
+	}
+	arr, err := arrayValue(doc, path, op)
+	if err != nil {
+		return doc, err
+	}
+
+	values := []bson.RawValue{value}
+	if spec, ok := value.DocumentOK(); ok {
+		if each, err := spec.LookupErr("$each"); err == nil {
+			eachArr, ok := each.ArrayOK()
+			if !ok {
+				return doc, server.Errorf(server.ErrorCodeBadValue, "The argument to $each in %s must be an array", op)
+			}
+			if values, err = eachArr.Values(); err != nil {
+				return doc, err
+			}
+		}
+	}
+
+	for _, v := range values {
+		if unique && contains(arr, v) {
+			continue
+		}
+		arr = append(arr, v)
+	}
+	return setValue(doc, path, arr)
+}
+
+func contains(arr bson.A, v bson.RawValue) bool {
+	for _, elem := range arr {
+		if rv, err := rawValue(elem); err == nil && match.Equal(rv, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// pull removes the elements matching a condition from the array of a path.
+// The condition is a value, a document of operators or a filter on document
+// elements.
+func pull(doc interface{}, path []string, cond bson.RawValue) (interface{}, error) {
+	current, ok := getValue(doc, path)
+	if !ok {
+		return doc, nil
+	}
+	arr, ok := current.(bson.A)
+	if !ok {
+		return doc, server.Errorf(server.ErrorCodeBadValue, "Cannot apply $pull to a non-array value")
+	}
+
+	matches, err := pullMatcher(cond)
+	if err != nil {
+		return doc, err
+	}
+
+	kept := bson.A{}
+	for _, elem := range arr {
+		rv, err := rawValue(elem)
+		if err != nil {
+			return doc, err
+		}
+		if !matches(rv) {
+			kept = append(kept, elem)
+		}
+	}
+	return setValue(doc, path, kept)
+}
+
+func pullMatcher(cond bson.RawValue) (func(bson.RawValue) bool, error) {
+	condDoc, isDoc := cond.DocumentOK()
+	switch {
+	case isDoc && !isOperatorDocument(condDoc):
+		m, err := compile(condDoc)
+		if err != nil {
+			return nil, err
+		}
+		return func(elem bson.RawValue) bool {
+			return elem.Type == bson.TypeEmbeddedDocument && m.MatchRaw(elem.Document())
+		}, nil
+	case isDoc:
+		m, err := compile(bson.D{{Key: "v", Value: cond}})
+		if err != nil {
+			return nil, err
+		}
+		return func(elem bson.RawValue) bool {
+			ok, err := m.Match(bson.D{{Key: "v", Value: elem}})
+			return err == nil && ok
+		}, nil
+	}
+	return func(elem bson.RawValue) bool {
+		return match.Equal(elem, cond)
+	}, nil
+}
+
+// rename moves the value of a path to the path named by target.
+func rename(doc interface{}, path []string, target bson.RawValue) (interface{}, error) {
+	to, ok := target.StringValueOK()
+	if !ok || to == "" {
+		return doc, server.Errorf(server.ErrorCodeBadValue, "The 'to' field for $rename must be a string")
+	}
+	if to == strings.Join(path, ".") {
+		return doc, server.Errorf(server.ErrorCodeBadValue, "The source and target field for $rename must differ")
+	}
+
+	v, ok := getValue(doc, path)
+	if !ok {
+		return doc, nil
+	}
+	return setValue(unsetValue(doc, path), strings.Split(to, "."), v)
+}
+
+// upsertDocument builds the document inserted by an upsert: the equality
+// conditions of the filter with the update applied, or the replacement
+// document.
+func upsertDocument(filter interface{}, update bson.Raw) (bson.Raw, error) {
+	var base interface{} = bson.D{}
+	if filter != nil {
+		f, err := toDocument(filter)
+		if err != nil {
+			return nil, err
+		}
+		elems, err := f.Elements()
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range elems {
+			key, value := elem.Key(), elem.Value()
+			if strings.HasPrefix(key, "$") {
+				continue
+			}
+			if d, ok := value.DocumentOK(); ok && isOperatorDocument(d) {
+				eq, err := d.LookupErr("$eq")
+				if err != nil {
+					continue
+				}
+				value = eq
+			}
+			if base, err = setValue(base, strings.Split(key, "."), value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !isOperatorDocument(update) {
+		doc, err := withoutID(update)
+		if err != nil {
+			return nil, err
+		}
+		if id, ok := getValue(base, []string{"_id"}); ok {
+			return prependID(doc, id)
+		}
+		if id, err := update.LookupErr("_id"); err == nil {
+			return prependID(doc, id)
+		}
+		return doc, nil
+	}
+
+	b, err := bson.Marshal(base)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if doc, err = applyOperators(doc, update); err != nil {
+		return nil, err
+	}
+	return bson.Marshal(doc)
+}
+
+func withoutID(doc bson.Raw) (bson.Raw, error) {
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	d := bson.D{}
+	for _, elem := range elems {
+		if elem.Key() != "_id" {
+			d = append(d, bson.E{Key: elem.Key(), Value: elem.Value()})
+		}
+	}
+	return bson.Marshal(d)
+}
+
+func prependID(doc bson.Raw, id interface{}) (bson.Raw, error) {
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	d := bson.D{{Key: "_id", Value: id}}
+	for _, elem := range elems {
+		d = append(d, bson.E{Key: elem.Key(), Value: elem.Value()})
+	}
+	return bson.Marshal(d)
+}
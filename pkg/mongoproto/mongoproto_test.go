@@ -2,15 +2,28 @@ package mongoproto_test
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"path/filepath"
 	"testing"
+	"testing/quick"
 
 	"github.com/orktes/mongache/pkg/mongoproto"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 var testCorpusPath = "workdir/corpus/mongo*"
 
+// testCorpusInvalid lists the corpus files that are not messages and the
+// error they are rejected with.
+var testCorpusInvalid = map[string]error{
+	// continuation of the reply in mongo01245, has no header of its own
+	"mongo01246": mongoproto.ErrInvalidSize,
+}
+
 func TestWiresharkPcapExamples(t *testing.T) {
 	paths, err := filepath.Glob(testCorpusPath)
 	if err != nil {
@@ -24,9 +37,365 @@ func TestWiresharkPcapExamples(t *testing.T) {
 			continue
 		}
 		_, err = mongoproto.OpFromReader(bytes.NewReader(r))
+		if expected, ok := testCorpusInvalid[filepath.Base(path)]; ok {
+			assert.Equal(t, expected, err, path)
+			continue
+		}
 		if err != nil {
 			t.Log(path)
 			t.Fatal(err)
 		}
 	}
 }
+
+func TestOpMsgRoundTrip(t *testing.T) {
+	body, _ := bson.Marshal(bson.D{{Key: "insert", Value: "test"}, {Key: "$db", Value: "foo"}})
+	doc1, _ := bson.Marshal(bson.D{{Key: "a", Value: int32(1)}})
+	doc2, _ := bson.Marshal(bson.D{{Key: "a", Value: int32(2)}})
+
+	for _, flags := range []mongoproto.OpMsgFlags{0, mongoproto.OpMsgChecksumPresent | mongoproto.OpMsgExhaustAllowed} {
+		op := &mongoproto.OpMsgV2{
+			Header: mongoproto.MsgHeader{RequestID: 7},
+			Flags:  flags,
+			Body:   body,
+			Sequences: []mongoproto.OpMsgDocumentSequence{
+				{Identifier: "documents", Documents: [][]byte{doc1, doc2}},
+			},
+		}
+
+		buf := &bytes.Buffer{}
+		n, err := op.WriteTo(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(buf.Len()), n)
+		assert.Equal(t, int32(buf.Len()), op.Header.MessageLength)
+
+		res, err := mongoproto.OpFromReader(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, op, res)
+	}
+}
+
+func TestOpMsgChecksumMismatch(t *testing.T) {
+	body, _ := bson.Marshal(bson.D{{Key: "ping", Value: int32(1)}})
+	op := &mongoproto.OpMsgV2{Flags: mongoproto.OpMsgChecksumPresent, Body: body}
+
+	buf := &bytes.Buffer{}
+	_, err := op.WriteTo(buf)
+	assert.NoError(t, err)
+
+	b := buf.Bytes()
+	b[len(b)-1] ^= 0xff
+
+	_, err = mongoproto.OpFromReader(bytes.NewReader(b))
+	assert.Equal(t, mongoproto.ErrInvalidChecksum, err)
+}
+
+func TestOpCompressedRoundTrip(t *testing.T) {
+	body, _ := bson.Marshal(bson.D{{Key: "find", Value: "test"}, {Key: "$db", Value: "foo"}})
+
+	for _, compressor := range []mongoproto.CompressorID{
+		mongoproto.CompressorNoop,
+		mongoproto.CompressorSnappy,
+		mongoproto.CompressorZlib,
+		mongoproto.CompressorZstd,
+	} {
+		op := &mongoproto.OpMsgV2{
+			Header: mongoproto.MsgHeader{RequestID: 3, ResponseTo: 2},
+			Body:   body,
+		}
+
+		compressed, err := mongoproto.Compress(op, compressor)
+		assert.NoError(t, err)
+
+		buf := &bytes.Buffer{}
+		_, err = compressed.WriteTo(buf)
+		assert.NoError(t, err)
+
+		res, err := mongoproto.OpFromReader(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, compressed, res)
+
+		decompressed, err := res.(*mongoproto.OpCompressed).Decompress()
+		assert.NoError(t, err)
+		assert.Equal(t, op, decompressed, compressor.String())
+	}
+}
+
+type wireOp interface {
+	mongoproto.Op
+	io.WriterTo
+}
+
+func randomHeader(r *rand.Rand) mongoproto.MsgHeader {
+	return mongoproto.MsgHeader{RequestID: r.Int31(), ResponseTo: r.Int31()}
+}
+
+func randomNamespace(r *rand.Rand) string {
+	name := make([]byte, 1+r.Intn(16))
+	for i := range name {
+		name[i] = byte('a' + r.Intn(26))
+	}
+	return "db." + string(name)
+}
+
+func randomDocument(r *rand.Rand) []byte {
+	doc := bson.D{}
+	for i := r.Intn(4); i >= 0; i-- {
+		doc = append(doc, bson.E{Key: string(rune('a' + i)), Value: r.Int63()})
+	}
+	b, _ := bson.Marshal(doc)
+	return b
+}
+
+func randomDocuments(r *rand.Rand, min int) [][]byte {
+	n := min + r.Intn(4)
+	if n == 0 {
+		return nil
+	}
+	docs := make([][]byte, n)
+	for i := range docs {
+		docs[i] = randomDocument(r)
+	}
+	return docs
+}
+
+// randomOps returns one of each op type that has an encoder, filled with
+// random values.
+func randomOps(r *rand.Rand) []wireOp {
+	query := &mongoproto.OpQuery{
+		Header:             randomHeader(r),
+		Flags:              mongoproto.OpQueryFlags(r.Int31()),
+		FullCollectionName: randomNamespace(r),
+		NumberToSkip:       r.Int31(),
+		NumberToReturn:     r.Int31(),
+		Query:              randomDocument(r),
+	}
+	if r.Intn(2) == 0 {
+		query.ReturnFieldsSelector = randomDocument(r)
+	}
+
+	docs := randomDocuments(r, 0)
+	cursorIDs := make([]int64, 1+r.Intn(4))
+	for i := range cursorIDs {
+		cursorIDs[i] = r.Int63()
+	}
+	body := make([]byte, 1+r.Intn(64))
+	r.Read(body)
+
+	return []wireOp{
+		query,
+		&mongoproto.OpReply{
+			Header:         randomHeader(r),
+			Flags:          mongoproto.OpReplyFlags(r.Int31()),
+			CursorID:       r.Int63(),
+			StartingFrom:   r.Int31(),
+			NumberReturned: int32(len(docs)),
+			Documents:      docs,
+		},
+		&mongoproto.OpGetMore{
+			Header:             randomHeader(r),
+			FullCollectionName: randomNamespace(r),
+			NumberToReturn:     r.Int31(),
+			CursorID:           r.Int63(),
+		},
+		&mongoproto.OpInsert{
+			Header:             randomHeader(r),
+			Flags:              mongoproto.OpInsertFlags(r.Int31()),
+			FullCollectionName: randomNamespace(r),
+			Documents:          randomDocuments(r, 1),
+		},
+		&mongoproto.OpUpdate{
+			Header:             randomHeader(r),
+			Flags:              mongoproto.OpUpdateFlags(r.Int31()),
+			FullCollectionName: randomNamespace(r),
+			Selector:           randomDocument(r),
+			Update:             randomDocument(r),
+		},
+		&mongoproto.OpDelete{
+			Header:             randomHeader(r),
+			Flags:              mongoproto.OpDeleteFlags(r.Int31()),
+			FullCollectionName: randomNamespace(r),
+			Selector:           randomDocument(r),
+		},
+		&mongoproto.OpKillCursors{
+			Header:    randomHeader(r),
+			CursorIDs: cursorIDs,
+		},
+		&mongoproto.OpUnknown{
+			Header: mongoproto.MsgHeader{RequestID: r.Int31(), OpCode: mongoproto.OpCode(1000)},
+			Body:   body,
+		},
+	}
+}
+
+func TestOpRoundTrip(t *testing.T) {
+	f := func(seed int64) bool {
+		for _, op := range randomOps(rand.New(rand.NewSource(seed))) {
+			buf := &bytes.Buffer{}
+			n, err := op.WriteTo(buf)
+			if !assert.NoError(t, err) ||
+				!assert.Equal(t, int64(buf.Len()), n) {
+				return false
+			}
+
+			res, err := mongoproto.OpFromReader(buf)
+			if !assert.NoError(t, err, op.OpCode().String()) ||
+				!assert.Equal(t, op, res) ||
+				!assert.Zero(t, buf.Len(), "trailing bytes") {
+				return false
+			}
+		}
+		return true
+	}
+
+	if err := quick.Check(f, &quick.Config{Rand: rand.New(rand.NewSource(1))}); err != nil {
+		t.Error(err)
+	}
+}
+
+type countingWriter struct {
+	writes int
+	n      int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	w.n += len(b)
+	return len(b), nil
+}
+
+func testDocuments(n int) [][]byte {
+	docs := make([][]byte, n)
+	for i := range docs {
+		docs[i], _ = bson.Marshal(bson.M{"foo": fmt.Sprintf("bar_%d", i)})
+	}
+	return docs
+}
+
+func TestOpWriteToSingleWrite(t *testing.T) {
+	docs := testDocuments(3000)
+	for _, op := range []wireOp{
+		&mongoproto.OpReply{NumberReturned: int32(len(docs)), Documents: docs},
+		&mongoproto.OpMsgV2{
+			Flags:     mongoproto.OpMsgChecksumPresent,
+			Body:      docs[0],
+			Sequences: []mongoproto.OpMsgDocumentSequence{{Identifier: "documents", Documents: docs}},
+		},
+	} {
+		w := &countingWriter{}
+		n, err := op.WriteTo(w)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, w.writes, op.OpCode().String())
+		assert.Equal(t, int64(w.n), n)
+	}
+}
+
+func BenchmarkOpReplyWriteTo(b *testing.B) {
+	docs := testDocuments(3000)
+	op := &mongoproto.OpReply{NumberReturned: int32(len(docs)), Documents: docs}
+	w := &countingWriter{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := op.WriteTo(w); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(w.n / b.N))
+}
+
+func BenchmarkOpMsgWriteTo(b *testing.B) {
+	batch := bson.A{}
+	for _, doc := range testDocuments(3000) {
+		batch = append(batch, bson.Raw(doc))
+	}
+	body, _ := bson.Marshal(bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "firstBatch", Value: batch},
+			{Key: "id", Value: int64(0)},
+			{Key: "ns", Value: "foo.test"},
+		}},
+		{Key: "ok", Value: 1.0},
+	})
+	op := &mongoproto.OpMsgV2{Body: body}
+	w := &countingWriter{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := op.WriteTo(w); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(w.n / b.N))
+}
+
+func TestOpFromReaderFrameValidation(t *testing.T) {
+	query, _ := bson.Marshal(bson.M{"a": int32(1)})
+	encode := func(op wireOp) []byte {
+		buf := &bytes.Buffer{}
+		op.WriteTo(buf)
+		return buf.Bytes()
+	}
+	withLength := func(b []byte, length int32) []byte {
+		b = append([]byte{}, b...)
+		b[0], b[1], b[2], b[3] = byte(length), byte(length>>8), byte(length>>16), byte(length>>24)
+		return b
+	}
+	next := encode(&mongoproto.OpGetMore{FullCollectionName: "foo.test", CursorID: 1})
+
+	t.Run("too large", func(t *testing.T) {
+		b := encode(&mongoproto.OpQuery{FullCollectionName: "foo.test", Query: query})
+		_, err := mongoproto.OpFromReaderLimit(bytes.NewReader(b), int32(len(b)-1))
+		assert.Equal(t, mongoproto.ErrMessageTooLarge, err)
+	})
+
+	t.Run("shorter than header", func(t *testing.T) {
+		b := withLength(encode(&mongoproto.OpGetMore{FullCollectionName: "foo.test"}), 4)
+		_, err := mongoproto.OpFromReader(bytes.NewReader(b))
+		assert.Equal(t, mongoproto.ErrInvalidSize, err)
+	})
+
+	t.Run("short body", func(t *testing.T) {
+		b := encode(&mongoproto.OpGetMore{FullCollectionName: "foo.test"})
+		b = withLength(b[:len(b)-4], int32(len(b)-4))
+		r := bytes.NewReader(append(b, next...))
+
+		_, err := mongoproto.OpFromReader(r)
+		assert.Equal(t, mongoproto.ErrShortMessage, err)
+
+		op, err := mongoproto.OpFromReader(r)
+		assert.NoError(t, err)
+		assert.Equal(t, mongoproto.OpCodeGetMore, op.OpCode())
+	})
+
+	t.Run("trailing bytes", func(t *testing.T) {
+		b := encode(&mongoproto.OpGetMore{FullCollectionName: "foo.test"})
+		b = withLength(append(b, 1, 2, 3), int32(len(b)+3))
+		r := bytes.NewReader(append(b, next...))
+
+		_, err := mongoproto.OpFromReader(r)
+		assert.Equal(t, mongoproto.ErrTrailingBytes, err)
+
+		op, err := mongoproto.OpFromReader(r)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), op.(*mongoproto.OpGetMore).CursorID)
+	})
+
+	t.Run("kill cursors count", func(t *testing.T) {
+		b := encode(&mongoproto.OpKillCursors{CursorIDs: []int64{1}})
+		b[mongoproto.MsgHeaderLen+4] = 0xff
+		b[mongoproto.MsgHeaderLen+5] = 0xff
+		b[mongoproto.MsgHeaderLen+6] = 0xff
+		_, err := mongoproto.OpFromReader(bytes.NewReader(b))
+		assert.Equal(t, mongoproto.ErrInvalidSize, err)
+	})
+
+	t.Run("document larger than message", func(t *testing.T) {
+		b := encode(&mongoproto.OpInsert{FullCollectionName: "foo.test", Documents: [][]byte{query}})
+		b = withLength(b[:len(b)-1], int32(len(b)-1))
+		_, err := mongoproto.OpFromReader(bytes.NewReader(b))
+		assert.Equal(t, mongoproto.ErrShortMessage, err)
+	})
+}
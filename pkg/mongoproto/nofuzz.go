@@ -22,10 +22,6 @@ func (op *OpGetMore) fromWire(b []byte) {
 	op.CursorID = getInt64(b, 4)
 }
 
-func (op *OpGetMore) toWire() []byte {
-	return nil
-}
-
 func (op *OpReply) fromWire(b []byte) {
 	if len(b) < 20 {
 		return
@@ -48,25 +44,9 @@ func (op *OpReply) fromWire(b []byte) {
 	}
 }
 
-func (op *OpQuery) toWire() []byte {
-	return nil
-}
-
-func (op *OpReply) toWire() []byte {
-	return nil
-}
-
-func (op *OpInsert) toWire() []byte {
-	return nil
-}
-
 func (op *OpUnknown) fromWire(b []byte) {
 }
 
-func (op *OpUnknown) toWire() []byte {
-	return nil
-}
-
 func readCString(b []byte) string {
 	for i := 0; i < len(b); i++ {
 		if b[i] == 0 {
@@ -84,7 +64,7 @@ func (c OpCode) IsMutation() bool {
 
 // HasResponse tells us if the operation will have a response from the server.
 func (c OpCode) HasResponse() bool {
-	return c == OpCodeQuery || c == OpCodeGetMore
+	return c == OpCodeQuery || c == OpCodeGetMore || c == OpCodeMsg
 }
 
 // CopyMessage copies reads & writes an entire message.
@@ -1,7 +1,18 @@
 package mongoproto
 
 import (
+	"errors"
 	"io"
+	"io/ioutil"
+)
+
+// DefaultMaxMessageSize is the largest message OpFromReader accepts.
+const DefaultMaxMessageSize = maximumMessageSize
+
+var (
+	ErrMessageTooLarge = errors.New("mongoproto: message exceeds the maximum message size")
+	ErrShortMessage    = errors.New("mongoproto: message ends before the op is complete")
+	ErrTrailingBytes   = errors.New("mongoproto: message has trailing bytes after the op")
 )
 
 // Op is a Mongo operation
@@ -10,33 +21,70 @@ type Op interface {
 	FromReader(io.Reader) error
 }
 
-// OpFromReader reads an Op from an io.Reader
+// OpFromReader reads an Op from an io.Reader. Messages larger than
+// DefaultMaxMessageSize are rejected.
 func OpFromReader(r io.Reader) (Op, error) {
+	return OpFromReaderLimit(r, DefaultMaxMessageSize)
+}
+
+// OpFromReaderLimit reads an Op of at most maxSize bytes from an io.Reader.
+//
+// The op is decoded from exactly MessageLength bytes. When the op is shorter
+// or longer than its header claims, ErrShortMessage or ErrTrailingBytes is
+// returned after the rest of the message has been discarded, so that r is
+// positioned at the start of the next message. Any other error leaves r at an
+// unknown position and the stream should be closed.
+func OpFromReaderLimit(r io.Reader, maxSize int32) (Op, error) {
 	msg, err := ReadHeader(r)
 	if err != nil {
 		return nil, err
 	}
-	m := *msg
+	if msg.MessageLength < MsgHeaderLen {
+		return nil, ErrInvalidSize
+	}
+	if msg.MessageLength > maxSize {
+		return nil, ErrMessageTooLarge
+	}
 
-	var result Op
+	lr := &io.LimitedReader{R: r, N: int64(msg.MessageLength - MsgHeaderLen)}
+	result := newOp(*msg)
+	err = result.FromReader(lr)
+	switch {
+	case (err == io.EOF || err == io.ErrUnexpectedEOF) && lr.N == 0:
+		err = ErrShortMessage
+	case err == nil && lr.N > 0:
+		err = ErrTrailingBytes
+	}
+	if err == ErrShortMessage || err == ErrTrailingBytes {
+		if _, derr := io.Copy(ioutil.Discard, lr); derr != nil {
+			return result, derr
+		}
+	}
+	return result, err
+}
+
+// newOp returns an empty Op for the message described by m.
+func newOp(m MsgHeader) Op {
 	switch m.OpCode {
 	case OpCodeQuery:
-		result = &OpQuery{Header: m}
+		return &OpQuery{Header: m}
 	case OpCodeReply:
-		result = &OpReply{Header: m}
+		return &OpReply{Header: m}
 	case OpCodeGetMore:
-		result = &OpGetMore{Header: m}
+		return &OpGetMore{Header: m}
 	case OpCodeInsert:
-		result = &OpInsert{Header: m}
+		return &OpInsert{Header: m}
 	case OpCodeDelete:
-		result = &OpDelete{Header: m}
+		return &OpDelete{Header: m}
 	case OpCodeUpdate:
-		result = &OpUpdate{Header: m}
+		return &OpUpdate{Header: m}
 	case OpCodeKillCursors:
-		result = &OpKillCursors{Header: m}
+		return &OpKillCursors{Header: m}
+	case OpCodeCompressed:
+		return &OpCompressed{Header: m}
+	case OpCodeMsg:
+		return &OpMsgV2{Header: m}
 	default:
-		result = &OpUnknown{Header: m}
+		return &OpUnknown{Header: m}
 	}
-	err = result.FromReader(r)
-	return result, err
 }
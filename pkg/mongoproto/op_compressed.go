@@ -0,0 +1,250 @@
+package mongoproto
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressorID identifies the algorithm used to compress an OpCompressed.
+type CompressorID uint8
+
+// The compressors defined by the wire protocol
+const (
+	CompressorNoop   = CompressorID(0)
+	CompressorSnappy = CompressorID(1)
+	CompressorZlib   = CompressorID(2)
+	CompressorZstd   = CompressorID(3)
+)
+
+var ErrUnknownCompressor = errors.New("mongoproto: unknown compressor")
+
+// String returns the name used for the compressor in the handshake.
+func (c CompressorID) String() string {
+	switch c {
+	case CompressorNoop:
+		return "noop"
+	case CompressorSnappy:
+		return "snappy"
+	case CompressorZlib:
+		return "zlib"
+	case CompressorZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", c)
+	}
+}
+
+// CompressorByName returns the compressor with the given handshake name.
+func CompressorByName(name string) (CompressorID, bool) {
+	switch name {
+	case "noop":
+		return CompressorNoop, true
+	case "snappy":
+		return CompressorSnappy, true
+	case "zlib":
+		return CompressorZlib, true
+	case "zstd":
+		return CompressorZstd, true
+	}
+	return 0, false
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maximumMessageSize))
+	})
+	return zstdErr
+}
+
+// OpCompressed wraps another op compressed with one of the supported
+// compressors.
+// https://github.com/mongodb/specifications/blob/master/source/compression/OP_COMPRESSED.rst
+type OpCompressed struct {
+	Header            MsgHeader
+	OriginalOpCode    OpCode       // the opcode of the wrapped op
+	UncompressedSize  int32        // size of the wrapped op excluding its header
+	CompressorID      CompressorID // the compressor used
+	CompressedMessage []byte       // the wrapped op excluding its header
+}
+
+func (op *OpCompressed) String() string {
+	return fmt.Sprintf("OpCompressed %v %v (%d -> %d bytes)", op.OriginalOpCode, op.CompressorID, op.UncompressedSize, len(op.CompressedMessage))
+}
+
+func (op *OpCompressed) OpCode() OpCode {
+	return OpCodeCompressed
+}
+
+func (op *OpCompressed) FromReader(r io.Reader) error {
+	if op.Header.MessageLength < MsgHeaderLen+9 {
+		return ErrInvalidSize
+	}
+
+	var b [9]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	op.OriginalOpCode = OpCode(getInt32(b[:], 0))
+	op.UncompressedSize = getInt32(b[:], 4)
+	op.CompressorID = CompressorID(b[8])
+
+	op.CompressedMessage = make([]byte, op.Header.MessageLength-MsgHeaderLen-9)
+	_, err := io.ReadFull(r, op.CompressedMessage)
+	return err
+}
+
+// WriteTo writes the message to w. The MessageLength and OpCode of the header
+// are computed.
+func (op *OpCompressed) WriteTo(w io.Writer) (int64, error) {
+	m := newWireMessage(MsgHeaderLen + 9 + len(op.CompressedMessage))
+	m.appendInt32(int32(op.OriginalOpCode))
+	m.appendInt32(op.UncompressedSize)
+	m.appendByte(byte(op.CompressorID))
+	m.appendBytes(op.CompressedMessage)
+	return m.writeTo(w, &op.Header, OpCodeCompressed)
+}
+
+// Compress encodes op and wraps it into an OpCompressed using the given
+// compressor. The RequestID and ResponseTo of op are kept.
+func Compress(op interface {
+	Op
+	io.WriterTo
+}, compressor CompressorID) (*OpCompressed, error) {
+	buf := &bytes.Buffer{}
+	if _, err := op.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	if buf.Len() < MsgHeaderLen {
+		return nil, ErrInvalidSize
+	}
+
+	var header MsgHeader
+	header.fromWire(buf.Bytes())
+	body := buf.Bytes()[MsgHeaderLen:]
+
+	compressed, err := compress(compressor, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OpCompressed{
+		Header: MsgHeader{
+			RequestID:  header.RequestID,
+			ResponseTo: header.ResponseTo,
+		},
+		OriginalOpCode:    header.OpCode,
+		UncompressedSize:  int32(len(body)),
+		CompressorID:      compressor,
+		CompressedMessage: compressed,
+	}, nil
+}
+
+// Decompress returns the op wrapped in the message.
+func (op *OpCompressed) Decompress() (Op, error) {
+	if op.UncompressedSize < 0 || op.UncompressedSize > maximumMessageSize {
+		return nil, ErrInvalidSize
+	}
+
+	body, err := decompress(op.CompressorID, op.CompressedMessage, int(op.UncompressedSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != int(op.UncompressedSize) {
+		return nil, ErrInvalidSize
+	}
+
+	header := MsgHeader{
+		MessageLength: MsgHeaderLen + op.UncompressedSize,
+		RequestID:     op.Header.RequestID,
+		ResponseTo:    op.Header.ResponseTo,
+		OpCode:        op.OriginalOpCode,
+	}
+	if header.OpCode == OpCodeCompressed {
+		return nil, ErrInvalidSize
+	}
+
+	r := bytes.NewReader(body)
+	result := newOp(header)
+	if err := result.FromReader(r); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrShortMessage
+	} else if err != nil {
+		return nil, err
+	}
+	if r.Len() > 0 {
+		return nil, ErrTrailingBytes
+	}
+	return result, nil
+}
+
+func compress(compressor CompressorID, b []byte) ([]byte, error) {
+	switch compressor {
+	case CompressorNoop:
+		return b, nil
+	case CompressorSnappy:
+		return snappy.Encode(nil, b), nil
+	case CompressorZlib:
+		buf := &bytes.Buffer{}
+		w := zlib.NewWriter(buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressorZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(b, make([]byte, 0, len(b))), nil
+	}
+	return nil, ErrUnknownCompressor
+}
+
+func decompress(compressor CompressorID, b []byte, size int) ([]byte, error) {
+	switch compressor {
+	case CompressorNoop:
+		return b, nil
+	case CompressorSnappy:
+		n, err := snappy.DecodedLen(b)
+		if err != nil {
+			return nil, err
+		}
+		if n != size {
+			return nil, ErrInvalidSize
+		}
+		return snappy.Decode(nil, b)
+	case CompressorZlib:
+		r, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(io.LimitReader(r, int64(size)+1))
+	case CompressorZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(b, make([]byte, 0, size))
+	}
+	return nil, ErrUnknownCompressor
+}
@@ -46,26 +46,33 @@ func (op *OpDelete) OpCode() OpCode {
 
 func (op *OpDelete) FromReader(r io.Reader) error {
 	var b [4]byte
-	_, err := io.ReadFull(r, b[:])
-	if err != nil {
+	// ZERO
+	if _, err := io.ReadFull(r, b[:]); err != nil {
 		return err
 	}
-	op.Flags = OpDeleteFlags(getInt32(b[:], 0))
 	name, err := readCStringFromReader(r)
 	if err != nil {
 		return err
 	}
 	op.FullCollectionName = string(name)
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	op.Flags = OpDeleteFlags(getInt32(b[:], 0))
 	op.Selector, err = ReadDocument(r)
 	if err != nil {
 		return err
 	}
-	if int(op.Header.MessageLength) > len(op.Selector)+len(op.FullCollectionName)+1+8+MsgHeaderLen {
-		data, err := ReadDocument(r)
-		if err != nil {
-			return err
-		}
-		op.Selector = append(op.Selector, data...)
-	}
 	return nil
 }
+
+// WriteTo writes the op to w. The MessageLength and OpCode of the header are
+// computed.
+func (op *OpDelete) WriteTo(w io.Writer) (int64, error) {
+	m := newWireMessage(MsgHeaderLen + 4 + len(op.FullCollectionName) + 1 + 4 + len(op.Selector))
+	m.appendInt32(0) // ZERO
+	m.appendCString(op.FullCollectionName)
+	m.appendInt32(int32(op.Flags))
+	m.appendBytes(op.Selector)
+	return m.writeTo(w, &op.Header, OpCodeDelete)
+}
@@ -32,3 +32,14 @@ func (op *OpGetMore) FromReader(r io.Reader) error {
 	op.CursorID = getInt64(b[:], 4)
 	return nil
 }
+
+// WriteTo writes the op to w. The MessageLength and OpCode of the header are
+// computed.
+func (op *OpGetMore) WriteTo(w io.Writer) (int64, error) {
+	m := newWireMessage(MsgHeaderLen + 4 + len(op.FullCollectionName) + 1 + 12)
+	m.appendInt32(0) // ZERO
+	m.appendCString(op.FullCollectionName)
+	m.appendInt32(op.NumberToReturn)
+	m.appendInt64(op.CursorID)
+	return m.writeTo(w, &op.Header, OpCodeGetMore)
+}
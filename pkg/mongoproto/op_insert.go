@@ -57,14 +57,29 @@ func (op *OpInsert) FromReader(r io.Reader) error {
 	op.FullCollectionName = string(name)
 	op.Documents = make([][]byte, 0)
 
-	docLen := 0
-	for len(name)+1+4+docLen < int(op.Header.MessageLength)-MsgHeaderLen {
+	remaining := int(op.Header.MessageLength) - MsgHeaderLen - 4 - len(name) - 1
+	for remaining > 0 {
 		doc, err := ReadDocument(r)
 		if err != nil {
 			return err
 		}
-		docLen += len(doc)
+		if len(doc) < 5 || len(doc) > remaining {
+			return ErrInvalidSize
+		}
+		remaining -= len(doc)
 		op.Documents = append(op.Documents, doc)
 	}
 	return nil
 }
+
+// WriteTo writes the op to w. The MessageLength and OpCode of the header are
+// computed.
+func (op *OpInsert) WriteTo(w io.Writer) (int64, error) {
+	m := newWireMessage(MsgHeaderLen + 4 + len(op.FullCollectionName) + 1 + docLen(op.Documents))
+	m.appendInt32(int32(op.Flags))
+	m.appendCString(op.FullCollectionName)
+	for _, doc := range op.Documents {
+		m.appendBytes(doc)
+	}
+	return m.writeTo(w, &op.Header, OpCodeInsert)
+}
@@ -14,7 +14,7 @@ type OpKillCursors struct {
 }
 
 func (op *OpKillCursors) OpCode() OpCode {
-	return OpCodeUpdate
+	return OpCodeKillCursors
 }
 
 func (op *OpKillCursors) String() string {
@@ -32,6 +32,9 @@ func (op *OpKillCursors) FromReader(r io.Reader) error {
 
 	// number of cursor ids
 	num := getInt32(b[:], 4)
+	if num < 0 || int64(num)*8 > int64(op.Header.MessageLength)-MsgHeaderLen-8 {
+		return ErrInvalidSize
+	}
 
 	curIDBuf := make([]byte, num*8)
 
@@ -46,3 +49,15 @@ func (op *OpKillCursors) FromReader(r io.Reader) error {
 
 	return nil
 }
+
+// WriteTo writes the op to w. The MessageLength and OpCode of the header are
+// computed.
+func (op *OpKillCursors) WriteTo(w io.Writer) (int64, error) {
+	m := newWireMessage(MsgHeaderLen + 8 + 8*len(op.CursorIDs))
+	m.appendInt32(0) // ZERO
+	m.appendInt32(int32(len(op.CursorIDs)))
+	for _, id := range op.CursorIDs {
+		m.appendInt64(id)
+	}
+	return m.writeTo(w, &op.Header, OpCodeKillCursors)
+}
@@ -1,5 +1,13 @@
 package mongoproto
 
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
 // OpMsg sends a diagnostic message to the database. The database sends back a fixed response.
 // OpMsg is Deprecated
 // http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/#op-msg
@@ -7,3 +15,189 @@ type OpMsg struct {
 	Header  MsgHeader
 	Message string
 }
+
+const (
+	OpMsgChecksumPresent OpMsgFlags = 1 << 0  // The message ends with 4 bytes containing a CRC-32C checksum.
+	OpMsgMoreToCome      OpMsgFlags = 1 << 1  // Another message will follow this one without further action from the receiver. The receiver must not send a reply.
+	OpMsgExhaustAllowed  OpMsgFlags = 1 << 16 // The client is prepared for multiple replies to this request using the moreToCome bit.
+)
+
+type OpMsgFlags uint32
+
+const (
+	OpMsgSectionBody             = 0 // A single BSON document.
+	OpMsgSectionDocumentSequence = 1 // An identifier followed by zero or more BSON documents.
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// OpMsgDocumentSequence is a kind 1 section of an OpMsgV2.
+type OpMsgDocumentSequence struct {
+	Identifier string   // the command argument the documents belong to, e.g. "documents"
+	Documents  [][]byte // documents in the sequence
+}
+
+// OpMsgV2 is the extensible message format used by MongoDB 3.6 and newer for
+// both requests and replies.
+// https://docs.mongodb.com/manual/reference/mongodb-wire-protocol/#op_msg
+type OpMsgV2 struct {
+	Header    MsgHeader
+	Flags     OpMsgFlags
+	Body      []byte                  // the kind 0 section
+	Sequences []OpMsgDocumentSequence // the kind 1 sections
+	Checksum  uint32                  // only set when OpMsgChecksumPresent is set
+}
+
+func (op *OpMsgV2) String() string {
+	var body interface{}
+	if err := bson.Unmarshal(op.Body, &body); err != nil {
+		return "(error unmarshalling)"
+	}
+	asJSON, err := bson.MarshalExtJSON(body, false, false)
+	if err != nil {
+		return fmt.Sprintf("json marshal err: %#v - %v", op, err)
+	}
+	return fmt.Sprintf("OpMsg %v %v", op.Flags, string(asJSON))
+}
+
+func (op *OpMsgV2) OpCode() OpCode {
+	return OpCodeMsg
+}
+
+func (op *OpMsgV2) FromReader(r io.Reader) error {
+	if op.Header.MessageLength < MsgHeaderLen+5 {
+		return ErrInvalidSize
+	}
+	b := make([]byte, op.Header.MessageLength-MsgHeaderLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+
+	op.Flags = OpMsgFlags(getInt32(b, 0))
+	sections := b[4:]
+	if op.Flags&OpMsgChecksumPresent != 0 {
+		if len(sections) < 4 {
+			return ErrInvalidSize
+		}
+		op.Checksum = uint32(getInt32(sections, len(sections)-4))
+		sections = sections[:len(sections)-4]
+
+		crc := crc32.New(castagnoliTable)
+		crc.Write(op.Header.toWire())
+		crc.Write(b[:len(b)-4])
+		if crc.Sum32() != op.Checksum {
+			return ErrInvalidChecksum
+		}
+	}
+
+	op.Body = nil
+	op.Sequences = nil
+	for len(sections) > 0 {
+		kind := sections[0]
+		sections = sections[1:]
+		switch kind {
+		case OpMsgSectionBody:
+			if op.Body != nil {
+				return ErrInvalidSection
+			}
+			doc, err := sliceDocument(sections)
+			if err != nil {
+				return err
+			}
+			op.Body = doc
+			sections = sections[len(doc):]
+		case OpMsgSectionDocumentSequence:
+			if len(sections) < 4 {
+				return ErrInvalidSection
+			}
+			size := getInt32(sections, 0)
+			if size < 5 || int(size) > len(sections) {
+				return ErrInvalidSection
+			}
+			seq := sections[4:size]
+			sections = sections[size:]
+
+			identifier := readCString(seq)
+			if len(identifier) == len(seq) || seq[len(identifier)] != 0 {
+				return ErrInvalidSection
+			}
+			seq = seq[len(identifier)+1:]
+
+			sequence := OpMsgDocumentSequence{Identifier: identifier}
+			for len(seq) > 0 {
+				doc, err := sliceDocument(seq)
+				if err != nil {
+					return err
+				}
+				sequence.Documents = append(sequence.Documents, doc)
+				seq = seq[len(doc):]
+			}
+			op.Sequences = append(op.Sequences, sequence)
+		default:
+			return ErrInvalidSection
+		}
+	}
+
+	if op.Body == nil {
+		return ErrInvalidSection
+	}
+	return nil
+}
+
+// WriteTo writes the message to w. The MessageLength and OpCode of the header
+// and the checksum (if OpMsgChecksumPresent is set) are computed.
+func (op *OpMsgV2) WriteTo(w io.Writer) (int64, error) {
+	length := MsgHeaderLen + 4 + 1 + len(op.Body)
+	for _, seq := range op.Sequences {
+		length += 1 + 4 + len(seq.Identifier) + 1 + docLen(seq.Documents)
+	}
+	checksum := op.Flags&OpMsgChecksumPresent != 0
+	if checksum {
+		length += 4
+	}
+
+	m := newWireMessage(length)
+	defer m.release()
+
+	m.appendInt32(int32(op.Flags))
+	m.appendByte(OpMsgSectionBody)
+	m.appendBytes(op.Body)
+	for _, seq := range op.Sequences {
+		m.appendByte(OpMsgSectionDocumentSequence)
+		m.appendInt32(int32(4 + len(seq.Identifier) + 1 + docLen(seq.Documents)))
+		m.appendCString(seq.Identifier)
+		for _, doc := range seq.Documents {
+			m.appendBytes(doc)
+		}
+	}
+
+	b := m.finish(&op.Header, OpCodeMsg, length)
+	if checksum {
+		op.Checksum = crc32.Checksum(b, castagnoliTable)
+		m.appendInt32(int32(op.Checksum))
+		b = m.b
+	}
+
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// sliceDocument returns the BSON document at the start of b without copying.
+func sliceDocument(b []byte) ([]byte, error) {
+	if len(b) < 4 {
+		return nil, ErrInvalidSize
+	}
+	size := getInt32(b, 0)
+	if size < 5 || int(size) > len(b) || size > maximumDocumentSize {
+		return nil, ErrInvalidSize
+	}
+	return b[:size], maybeCheckBSON(b[:size])
+}
+
+func docLen(docs [][]byte) int {
+	n := 0
+	for _, doc := range docs {
+		n += len(doc)
+	}
+	return n
+}
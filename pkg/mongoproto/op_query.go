@@ -80,3 +80,16 @@ func (op *OpQuery) FromReader(r io.Reader) error {
 	}
 	return nil
 }
+
+// WriteTo writes the op to w. The MessageLength and OpCode of the header are
+// computed.
+func (op *OpQuery) WriteTo(w io.Writer) (int64, error) {
+	m := newWireMessage(MsgHeaderLen + 4 + len(op.FullCollectionName) + 1 + 8 + len(op.Query) + len(op.ReturnFieldsSelector))
+	m.appendInt32(int32(op.Flags))
+	m.appendCString(op.FullCollectionName)
+	m.appendInt32(op.NumberToSkip)
+	m.appendInt32(op.NumberToReturn)
+	m.appendBytes(op.Query)
+	m.appendBytes(op.ReturnFieldsSelector)
+	return m.writeTo(w, &op.Header, OpCodeQuery)
+}
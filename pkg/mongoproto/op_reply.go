@@ -1,7 +1,6 @@
 package mongoproto
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -60,6 +59,9 @@ func (op *OpReply) FromReader(r io.Reader) error {
 	op.CursorID = getInt64(b[:], 4)
 	op.StartingFrom = getInt32(b[:], 12)
 	op.NumberReturned = getInt32(b[:], 16)
+	if op.NumberReturned < 0 {
+		return ErrInvalidSize
+	}
 	for i := int32(0); i < op.NumberReturned; i++ {
 		doc, err := ReadDocument(r)
 		if err != nil {
@@ -70,38 +72,16 @@ func (op *OpReply) FromReader(r io.Reader) error {
 	return nil
 }
 
+// WriteTo writes the op to w. The MessageLength and OpCode of the header are
+// computed.
 func (op *OpReply) WriteTo(w io.Writer) (int64, error) {
-	written, err := op.Header.WriteTo(w)
-	if err != nil {
-		return written, err
-	}
-	r := leWriter{w: w}
-	if err := r.Write(op.Flags); err != nil {
-		return written, err
-	}
-	written += 4
-
-	if err := r.Write(op.CursorID); err != nil {
-		return written, err
-	}
-	written += 8
-
-	if err := r.Write(op.StartingFrom); err != nil {
-		return written, err
-	}
-	written += 4
-
-	if r.Write(op.NumberReturned); err != nil {
-		return written, err
-	}
-	written += 4
-
+	m := newWireMessage(MsgHeaderLen + 20 + docLen(op.Documents))
+	m.appendInt32(int32(op.Flags))
+	m.appendInt64(op.CursorID)
+	m.appendInt32(op.StartingFrom)
+	m.appendInt32(op.NumberReturned)
 	for _, doc := range op.Documents {
-		n, err := io.Copy(w, bytes.NewReader(doc))
-		written += n
-		if err != nil {
-			return written, err
-		}
+		m.appendBytes(doc)
 	}
-	return written, nil
+	return m.writeTo(w, &op.Header, OpCodeReply)
 }
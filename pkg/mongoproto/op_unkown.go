@@ -26,3 +26,10 @@ func (op *OpUnknown) FromReader(r io.Reader) error {
 	_, err := io.ReadFull(r, op.Body)
 	return err
 }
+
+// WriteTo writes the op to w. The MessageLength of the header is computed.
+func (op *OpUnknown) WriteTo(w io.Writer) (int64, error) {
+	m := newWireMessage(MsgHeaderLen + len(op.Body))
+	m.appendBytes(op.Body)
+	return m.writeTo(w, &op.Header, op.Header.OpCode)
+}
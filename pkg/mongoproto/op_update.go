@@ -59,29 +59,38 @@ func (op *OpUpdate) String() string {
 
 func (op *OpUpdate) FromReader(r io.Reader) error {
 	var b [4]byte
-	_, err := io.ReadFull(r, b[:])
-	if err != nil {
+	// ZERO
+	if _, err := io.ReadFull(r, b[:]); err != nil {
 		return err
 	}
-	op.Flags = OpUpdateFlags(getInt32(b[:], 0))
 	name, err := readCStringFromReader(r)
 	if err != nil {
 		return err
 	}
 	op.FullCollectionName = string(name)
-	op.Selector, err = ReadDocument(r)
-	if err != nil {
+	if _, err := io.ReadFull(r, b[:]); err != nil {
 		return err
 	}
-	var selectorExtra []byte
-	selectorExtra, err = ReadDocument(r)
+	op.Flags = OpUpdateFlags(getInt32(b[:], 0))
+	op.Selector, err = ReadDocument(r)
 	if err != nil {
 		return err
 	}
-	op.Selector = append(op.Selector, selectorExtra...)
 	op.Update, err = ReadDocument(r)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// WriteTo writes the op to w. The MessageLength and OpCode of the header are
+// computed.
+func (op *OpUpdate) WriteTo(w io.Writer) (int64, error) {
+	m := newWireMessage(MsgHeaderLen + 4 + len(op.FullCollectionName) + 1 + 4 + len(op.Selector) + len(op.Update))
+	m.appendInt32(0) // ZERO
+	m.appendCString(op.FullCollectionName)
+	m.appendInt32(int32(op.Flags))
+	m.appendBytes(op.Selector)
+	m.appendBytes(op.Update)
+	return m.writeTo(w, &op.Header, OpCodeUpdate)
+}
@@ -28,6 +28,10 @@ func (c OpCode) String() string {
 		return "delete"
 	case OpCodeKillCursors:
 		return "kill_cursors"
+	case OpCodeCompressed:
+		return "compressed"
+	case OpCodeMsg:
+		return "msg"
 	default:
 		return fmt.Sprintf("UNKNOWN(%d)", c)
 	}
@@ -45,4 +49,6 @@ const (
 	OpCodeGetMore     = OpCode(2005)
 	OpCodeDelete      = OpCode(2006)
 	OpCodeKillCursors = OpCode(2007)
+	OpCodeCompressed  = OpCode(2012)
+	OpCodeMsg         = OpCode(2013)
 )
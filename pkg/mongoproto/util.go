@@ -1,17 +1,20 @@
 package mongoproto
 
 import (
-	"encoding/binary"
 	"errors"
 	"io"
+	"sync"
 )
 
 var (
-	ErrInvalidSize = errors.New("mongoproto: got invalid document size")
+	ErrInvalidSize     = errors.New("mongoproto: got invalid document size")
+	ErrInvalidSection  = errors.New("mongoproto: got invalid OP_MSG section")
+	ErrInvalidChecksum = errors.New("mongoproto: OP_MSG checksum mismatch")
 )
 
 const (
 	maximumDocumentSize = 16 * 1024 * 1024 // 16MB max
+	maximumMessageSize  = 48000000         // 48MB max
 )
 
 // ReadDocument read an entire BSON document. This document can be used with
@@ -28,6 +31,10 @@ func ReadDocument(r io.Reader) ([]byte, error) {
 	if size > maximumDocumentSize {
 		return nil, ErrInvalidSize
 	}
+	if lr, ok := r.(*io.LimitedReader); ok && int64(size)-4 > lr.N {
+		// don't allocate more than the message can hold
+		return nil, ErrShortMessage
+	}
 
 	doc := make([]byte, size)
 	if size == 0 {
@@ -87,15 +94,80 @@ func getInt64(b []byte, pos int) int64 {
 		(int64(b[pos+7]) << 56)
 }
 
-type leWriter struct {
-	w   io.Writer
-	err error
+// maxPooledMessageSize is the capacity above which message buffers are
+// released to the garbage collector instead of being pooled.
+const maxPooledMessageSize = 4 << 20
+
+var wireMessagePool = sync.Pool{
+	New: func() interface{} {
+		return &wireMessage{}
+	},
+}
+
+// wireMessage builds a message in a pooled buffer so that it can be written
+// with a single write.
+type wireMessage struct {
+	b []byte
 }
 
-func (l *leWriter) Write(data interface{}) error {
-	if l.err != nil {
-		return l.err
+// newWireMessage returns a message with room for the header reserved. size
+// is a hint for the final size of the message.
+func newWireMessage(size int) *wireMessage {
+	m := wireMessagePool.Get().(*wireMessage)
+	if cap(m.b) < size {
+		m.b = make([]byte, MsgHeaderLen, size)
+	} else {
+		m.b = m.b[:MsgHeaderLen]
 	}
-	l.err = binary.Write(l.w, binary.LittleEndian, data)
-	return l.err
+	return m
+}
+
+// release returns the message to the pool. The message must not be used
+// afterwards.
+func (m *wireMessage) release() {
+	if cap(m.b) > maxPooledMessageSize {
+		return
+	}
+	wireMessagePool.Put(m)
+}
+
+func (m *wireMessage) appendByte(b byte) {
+	m.b = append(m.b, b)
+}
+
+func (m *wireMessage) appendInt32(i int32) {
+	m.b = append(m.b, byte(i), byte(i>>8), byte(i>>16), byte(i>>24))
+}
+
+func (m *wireMessage) appendInt64(i int64) {
+	m.appendInt32(int32(i))
+	m.appendInt32(int32(i >> 32))
+}
+
+func (m *wireMessage) appendCString(s string) {
+	m.b = append(m.b, s...)
+	m.b = append(m.b, 0)
+}
+
+func (m *wireMessage) appendBytes(b []byte) {
+	m.b = append(m.b, b...)
+}
+
+// finish completes the header with the message length and opcode and returns
+// the encoded message. length is the final length of the message, which may
+// exceed the bytes appended so far if the caller appends a trailer such as
+// a checksum.
+func (m *wireMessage) finish(header *MsgHeader, opCode OpCode, length int) []byte {
+	header.MessageLength = int32(length)
+	header.OpCode = opCode
+	copy(m.b, header.toWire())
+	return m.b
+}
+
+// writeTo completes the header, writes the message to w with a single write
+// and releases the message.
+func (m *wireMessage) writeTo(w io.Writer, header *MsgHeader, opCode OpCode) (int64, error) {
+	defer m.release()
+	n, err := w.Write(m.finish(header, opCode, len(m.b)))
+	return int64(n), err
 }
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func init() {
+	builtinCommands["aggregate"] = cmdAggregate
+}
+
+// AggregateRequest describes an aggregate command.
+type AggregateRequest struct {
+	Database     string
+	Collection   string // empty for aggregations on the database
+	Pipeline     []bson.Raw
+	BatchSize    int32
+	AllowDiskUse bool
+	Hint         interface{} // index name or key pattern
+	Comment      interface{}
+	MaxTimeMS    int64
+	Collation    bson.M
+	ReadConcern  bson.M
+}
+
+// Namespace returns the "dbname.collectionname" namespace of the request.
+func (req *AggregateRequest) Namespace() string {
+	if req.Collection == "" {
+		return req.Database + ".$cmd.aggregate"
+	}
+	return req.Database + "." + req.Collection
+}
+
+// AggregateHandler runs aggregation pipelines. The returned cursor is read
+// in batches like the cursor of a FindHandler.
+type AggregateHandler func(ctx context.Context, req *AggregateRequest) (Cursor, error)
+
+type aggregateCommand struct {
+	Pipeline     []bson.Raw  `bson:"pipeline"`
+	Cursor       *bson.Raw   `bson:"cursor"`
+	Explain      bool        `bson:"explain"`
+	AllowDiskUse bool        `bson:"allowDiskUse"`
+	Hint         interface{} `bson:"hint"`
+	Comment      interface{} `bson:"comment"`
+	MaxTimeMS    int64       `bson:"maxTimeMS"`
+	Collation    bson.M      `bson:"collation"`
+	ReadConcern  bson.M      `bson:"readConcern"`
+}
+
+func cmdAggregate(ctx context.Context, cmd *Command) (bson.D, error) {
+	handler := cmd.client.server.AggregateHandler
+	if handler == nil {
+		return nil, Errorf(ErrorCodeCommandNotSupported, "aggregate is not supported by this server")
+	}
+
+	req := &AggregateRequest{Database: cmd.Database}
+	if arg := cmd.Argument(); arg.Type == bson.TypeString {
+		req.Collection = arg.StringValue()
+	} else if n, ok := asInt64(arg); !ok || n != 1 {
+		return nil, Errorf(ErrorCodeInvalidNamespace, "aggregate must be a collection name or 1")
+	}
+
+	var args aggregateCommand
+	if err := bson.Unmarshal(cmd.Doc, &args); err != nil {
+		return nil, &Error{Code: ErrorCodeFailedToParse, Message: err.Error()}
+	}
+	if args.Explain {
+		return nil, Errorf(ErrorCodeCommandNotSupported, "explain is not supported by this server")
+	}
+	if args.Cursor == nil {
+		return nil, Errorf(ErrorCodeFailedToParse, "The 'cursor' option is required, except for aggregate with the explain argument")
+	}
+	batchSize, _ := asInt64(args.Cursor.Lookup("batchSize"))
+
+	req.Pipeline = args.Pipeline
+	req.BatchSize = int32(batchSize)
+	req.AllowDiskUse = args.AllowDiskUse
+	req.Hint = args.Hint
+	req.Comment = args.Comment
+	req.MaxTimeMS = args.MaxTimeMS
+	req.Collation = args.Collation
+	req.ReadConcern = args.ReadConcern
+
+	cur, err := handler(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &serverCursor{
+		Cursor:    cur,
+		ns:        req.Namespace(),
+		owner:     cmd.client,
+		principal: cmd.client.principal(),
+	}
+	return cmd.client.cursorReply(ctx, sc, "firstBatch", req.BatchSize, false)
+}
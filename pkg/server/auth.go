@@ -0,0 +1,389 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/xdg/scram"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func init() {
+	builtinCommands["saslStart"] = cmdSaslStart
+	builtinCommands["saslContinue"] = cmdSaslContinue
+	builtinCommands["logout"] = cmdLogout
+}
+
+// The authentication mechanisms supported by the server
+const (
+	MechanismSCRAMSHA1   = "SCRAM-SHA-1"
+	MechanismSCRAMSHA256 = "SCRAM-SHA-256"
+)
+
+// Iteration counts used by NewCredential, the defaults of mongod
+const (
+	scramSHA1Iterations   = 10000
+	scramSHA256Iterations = 15000
+)
+
+// commands that can be run without authenticating
+var authFreeCommands = map[string]bool{
+	"hello":        true,
+	"isMaster":     true,
+	"ismaster":     true,
+	"buildInfo":    true,
+	"buildinfo":    true,
+	"ping":         true,
+	"whatsmyuri":   true,
+	"saslStart":    true,
+	"saslContinue": true,
+	"logout":       true,
+	"authenticate": true,
+	"getLastError": true,
+	"getlasterror": true,
+}
+
+// Role is a role granted to a user.
+type Role struct {
+	Name     string `bson:"role"`
+	Database string `bson:"db"`
+}
+
+// User is an authenticated user.
+type User struct {
+	Name     string
+	Database string // database the user authenticates against
+	Roles    []Role
+}
+
+// Credential holds what the server needs to authenticate a user. Only the
+// mechanisms with credentials are available to the user.
+type Credential struct {
+	User        User
+	SCRAMSHA1   *scram.StoredCredentials
+	SCRAMSHA256 *scram.StoredCredentials
+}
+
+// mechanisms returns the names of the mechanisms available to the user.
+func (cred *Credential) mechanisms() []string {
+	var mechs []string
+	if cred.SCRAMSHA1 != nil {
+		mechs = append(mechs, MechanismSCRAMSHA1)
+	}
+	if cred.SCRAMSHA256 != nil {
+		mechs = append(mechs, MechanismSCRAMSHA256)
+	}
+	return mechs
+}
+
+// NewCredential derives the SCRAM-SHA-1 and SCRAM-SHA-256 credentials of a
+// user from its password.
+func NewCredential(user User, password string) (*Credential, error) {
+	// SCRAM-SHA-1 uses the password digest of MONGODB-CR
+	digest := md5.Sum([]byte(user.Name + ":mongo:" + password))
+	sha1Client, err := scram.SHA1.NewClientUnprepped(user.Name, hex.EncodeToString(digest[:]), "")
+	if err != nil {
+		return nil, err
+	}
+	sha256Client, err := scram.SHA256.NewClient(user.Name, password, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sha1Salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+	sha256Salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+
+	sha1Cred := sha1Client.GetStoredCredentials(scram.KeyFactors{Salt: sha1Salt, Iters: scramSHA1Iterations})
+	sha256Cred := sha256Client.GetStoredCredentials(scram.KeyFactors{Salt: sha256Salt, Iters: scramSHA256Iterations})
+	return &Credential{
+		User:        user,
+		SCRAMSHA1:   &sha1Cred,
+		SCRAMSHA256: &sha256Cred,
+	}, nil
+}
+
+func newSalt() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return string(b[:]), nil
+}
+
+// CredentialStore looks up the credentials of users. When Server.Credentials
+// is set, clients must authenticate before running any other command than
+// the handshake.
+type CredentialStore interface {
+	// Credential returns the credential of the user name of the database db,
+	// or nil if there is no such user.
+	Credential(ctx context.Context, db, name string) (*Credential, error)
+}
+
+// MemoryCredentialStore is a CredentialStore holding credentials in memory.
+type MemoryCredentialStore struct {
+	mu    sync.RWMutex
+	users map[string]*Credential
+}
+
+// AddUser adds a user authenticating with password, replacing any user with
+// the same name and database.
+func (m *MemoryCredentialStore) AddUser(user User, password string) error {
+	cred, err := NewCredential(user, password)
+	if err != nil {
+		return err
+	}
+
+	m.AddCredential(cred)
+	return nil
+}
+
+// AddCredential adds the credential of a user, replacing any user with the
+// same name and database. Users of the "$external" database authenticated
+// with MONGODB-X509 need no SCRAM credentials.
+func (m *MemoryCredentialStore) AddCredential(cred *Credential) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.users == nil {
+		m.users = map[string]*Credential{}
+	}
+	m.users[cred.User.Database+"."+cred.User.Name] = cred
+}
+
+// Credential implements CredentialStore.
+func (m *MemoryCredentialStore) Credential(ctx context.Context, db, name string) (*Credential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.users[db+"."+name], nil
+}
+
+type userKey struct{}
+
+// UserFromContext returns the user authenticated on the connection of a
+// request. ok is false when the connection is not authenticated.
+func UserFromContext(ctx context.Context) (user *User, ok bool) {
+	user, ok = ctx.Value(userKey{}).(*User)
+	return user, ok
+}
+
+// withUser returns a context carrying the user authenticated on the
+// connection, if any.
+func (c *client) withUser(ctx context.Context) context.Context {
+	if c.user == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, userKey{}, c.user)
+}
+
+// authRequired tells if clients must authenticate.
+func (s *Server) authRequired() bool {
+	return s.Credentials != nil
+}
+
+// checkAuthenticated fails requests on connections that must authenticate
+// and have not.
+func (c *client) checkAuthenticated() error {
+	if c.server.authRequired() && c.user == nil {
+		return Errorf(ErrorCodeUnauthorized, "command requires authentication")
+	}
+	return nil
+}
+
+// supportedMechanisms returns the mechanisms available to a "db.user" user
+// for the saslSupportedMechs field of the handshake.
+func (s *Server) supportedMechanisms(ctx context.Context, user string) []string {
+	db, name := splitNamespace(user)
+	cred, err := s.Credentials.Credential(ctx, db, name)
+	if err != nil || cred == nil {
+		return nil
+	}
+	return cred.mechanisms()
+}
+
+// saslConversation is an authentication in progress on a connection.
+type saslConversation struct {
+	id   int32
+	conv *scram.ServerConversation
+	cred *Credential
+
+	// the client does not send the final empty saslContinue
+	skipEmptyExchange bool
+}
+
+type saslStartCommand struct {
+	Mechanism string `bson:"mechanism"`
+	Payload   []byte `bson:"payload"`
+	Options   struct {
+		SkipEmptyExchange bool `bson:"skipEmptyExchange"`
+	} `bson:"options"`
+}
+
+type saslContinueCommand struct {
+	ConversationID int32  `bson:"conversationId"`
+	Payload        []byte `bson:"payload"`
+}
+
+func errAuthenticationFailed() error {
+	return Errorf(ErrorCodeAuthenticationFailed, "Authentication failed.")
+}
+
+// saslStart starts a conversation authenticating against the database db.
+func (c *client) saslStart(ctx context.Context, db string, args *saslStartCommand) (bson.D, error) {
+	store := c.server.Credentials
+	if store == nil {
+		return nil, Errorf(ErrorCodeMechanismUnavailable, "authentication is not enabled")
+	}
+
+	var hashGen scram.HashGeneratorFcn
+	switch args.Mechanism {
+	case MechanismSCRAMSHA1:
+		hashGen = scram.SHA1
+	case MechanismSCRAMSHA256:
+		hashGen = scram.SHA256
+	default:
+		return nil, Errorf(ErrorCodeMechanismUnavailable, "Received authentication for mechanism %s which is unknown or not enabled", args.Mechanism)
+	}
+
+	sasl := &saslConversation{
+		id:                c.nextConversationID(),
+		skipEmptyExchange: args.Options.SkipEmptyExchange,
+	}
+	scramServer, err := hashGen.NewServer(func(name string) (scram.StoredCredentials, error) {
+		cred, err := store.Credential(ctx, db, name)
+		if err != nil {
+			return scram.StoredCredentials{}, err
+		}
+		if cred == nil {
+			return scram.StoredCredentials{}, fmt.Errorf("unknown user %s", name)
+		}
+
+		stored := cred.SCRAMSHA256
+		if args.Mechanism == MechanismSCRAMSHA1 {
+			stored = cred.SCRAMSHA1
+		}
+		if stored == nil {
+			return scram.StoredCredentials{}, fmt.Errorf("mechanism %s is not available for user %s", args.Mechanism, name)
+		}
+
+		sasl.cred = cred
+		return *stored, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sasl.conv = scramServer.NewConversation()
+
+	payload, err := sasl.conv.Step(string(args.Payload))
+	if err != nil {
+		c.sasl = nil
+		return nil, errAuthenticationFailed()
+	}
+	c.sasl = sasl
+
+	return saslReply(sasl.id, false, payload), nil
+}
+
+// saslContinue advances the conversation in progress.
+func (c *client) saslContinue(ctx context.Context, args *saslContinueCommand) (bson.D, error) {
+	sasl := c.sasl
+	if sasl == nil || sasl.id != args.ConversationID {
+		return nil, Errorf(ErrorCodeProtocolError, "No SASL session state found")
+	}
+
+	if sasl.conv.Done() {
+		// The client acknowledged the server's final message
+		c.sasl = nil
+		return saslReply(sasl.id, true, ""), nil
+	}
+
+	payload, err := sasl.conv.Step(string(args.Payload))
+	if err != nil || !sasl.conv.Valid() {
+		c.sasl = nil
+		return nil, errAuthenticationFailed()
+	}
+
+	user := sasl.cred.User
+	c.user = &user
+
+	done := sasl.skipEmptyExchange
+	if done {
+		c.sasl = nil
+	}
+	return saslReply(sasl.id, done, payload), nil
+}
+
+func (c *client) nextConversationID() int32 {
+	c.conversationCounter++
+	return c.conversationCounter
+}
+
+func saslReply(id int32, done bool, payload string) bson.D {
+	return bson.D{
+		{Key: "conversationId", Value: id},
+		{Key: "done", Value: done},
+		{Key: "payload", Value: primitive.Binary{Data: []byte(payload)}},
+	}
+}
+
+func cmdSaslStart(ctx context.Context, cmd *Command) (bson.D, error) {
+	var args saslStartCommand
+	if err := bson.Unmarshal(cmd.Doc, &args); err != nil {
+		return nil, &Error{Code: ErrorCodeFailedToParse, Message: err.Error()}
+	}
+
+	return cmd.client.saslStart(ctx, cmd.Database, &args)
+}
+
+func cmdSaslContinue(ctx context.Context, cmd *Command) (bson.D, error) {
+	var args saslContinueCommand
+	if err := bson.Unmarshal(cmd.Doc, &args); err != nil {
+		return nil, &Error{Code: ErrorCodeFailedToParse, Message: err.Error()}
+	}
+
+	return cmd.client.saslContinue(ctx, &args)
+}
+
+func cmdLogout(ctx context.Context, cmd *Command) (bson.D, error) {
+	cmd.client.user = nil
+	cmd.client.sasl = nil
+	return bson.D{}, nil
+}
+
+// speculativeAuthenticate runs the saslStart embedded in a handshake. Like
+// mongod, failures are not reported and the client falls back to a regular
+// authentication.
+func (c *client) speculativeAuthenticate(ctx context.Context, doc bson.Raw) (bson.D, bool) {
+	db, _ := doc.Lookup("db").StringValueOK()
+
+	if _, err := doc.LookupErr("authenticate"); err == nil {
+		var args authenticateCommand
+		if err := bson.Unmarshal(doc, &args); err != nil {
+			return nil, false
+		}
+		reply, err := c.authenticateX509(ctx, db, &args)
+		return reply, err == nil
+	}
+
+	var args saslStartCommand
+	if err := bson.Unmarshal(doc, &args); err != nil {
+		return nil, false
+	}
+
+	// Drivers skip the empty exchange of speculative authentication
+	args.Options.SkipEmptyExchange = true
+	reply, err := c.saslStart(ctx, db, &args)
+	if err != nil {
+		return nil, false
+	}
+	return reply, true
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Actions authorized for legacy operations. Commands are authorized with
+// the name of the command as the action.
+const (
+	ActionFind        = "find"
+	ActionGetMore     = "getMore"
+	ActionKillCursors = "killCursors"
+	ActionInsert      = "insert"
+	ActionUpdate      = "update"
+	ActionDelete      = "delete"
+)
+
+// Principal is what the server knows about the client making a request.
+type Principal struct {
+	// RemoteAddr is the network address of the client.
+	RemoteAddr net.Addr
+	// User is the user authenticated on the connection, nil if the
+	// connection is not authenticated.
+	User *User
+}
+
+// same tells if two principals are the same client: the same user, or the
+// same host when neither is authenticated.
+func (p Principal) same(other Principal) bool {
+	if p.User != nil || other.User != nil {
+		return p.User != nil && other.User != nil &&
+			p.User.Name == other.User.Name && p.User.Database == other.User.Database
+	}
+	return remoteHost(p.RemoteAddr) == remoteHost(other.RemoteAddr)
+}
+
+func remoteHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Authorizer decides whether principals may run actions on namespaces.
+type Authorizer interface {
+	// Authorize returns nil to allow principal to run action on namespace,
+	// a "dbname.collectionname" namespace or a database name for commands
+	// not targeting a collection. Errors are reported to the client as
+	// Unauthorized unless they are an *Error.
+	Authorize(ctx context.Context, principal Principal, action, namespace string) error
+}
+
+// AuthorizerFunc is a function implementing Authorizer.
+type AuthorizerFunc func(ctx context.Context, principal Principal, action, namespace string) error
+
+// Authorize implements Authorizer.
+func (f AuthorizerFunc) Authorize(ctx context.Context, principal Principal, action, namespace string) error {
+	return f(ctx, principal, action, namespace)
+}
+
+// principal returns the principal of the connection.
+func (c *client) principal() Principal {
+	return Principal{RemoteAddr: c.conn.RemoteAddr(), User: c.user}
+}
+
+// authorize asks the Authorizer of the server whether the connection may run
+// action on namespace.
+func (c *client) authorize(ctx context.Context, action, namespace string) error {
+	authorizer := c.server.Authorizer
+	if authorizer == nil {
+		return nil
+	}
+
+	err := authorizer.Authorize(ctx, c.principal(), action, namespace)
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return Errorf(ErrorCodeUnauthorized, "not authorized on %s to execute %s: %s", namespace, action, err)
+}
+
+// checkCursorOwner fails requests on cursors opened by other principals.
+func (c *client) checkCursorOwner(sc *serverCursor) error {
+	if !sc.principal.same(c.principal()) {
+		return Errorf(ErrorCodeUnauthorized, "cursor id %d was not created by the same principal", sc.id)
+	}
+	return nil
+}
+
+// namespace returns the namespace authorized for the command: the collection
+// it targets, or its database.
+func (cmd *Command) namespace() string {
+	key := cmd.Name
+	if cmd.Name == "getMore" {
+		key = "collection"
+	}
+	if coll, ok := cmd.Doc.Lookup(key).StringValueOK(); ok && coll != "" {
+		return cmd.Database + "." + coll
+	}
+	return cmd.Database
+}
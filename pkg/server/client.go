@@ -2,10 +2,10 @@ package server
 
 import (
 	"context"
-	"fmt"
-	"io"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/orktes/mongache/pkg/mongoproto"
 	"go.mongodb.org/mongo-driver/bson"
@@ -14,9 +14,48 @@ import (
 const defaultReturnSize = 1000
 
 type client struct {
+	id           int32 // connectionId reported by hello
 	server       *Server
 	conn         net.Conn
 	requestCount int32
+
+	mu      sync.Mutex
+	active  bool // processing a request
+	closing bool
+
+	// compressor used for replies to the request being processed, nil when
+	// the request was not compressed
+	compressor *mongoproto.CompressorID
+
+	// outcome of the last legacy write and the legacy write held back for
+	// the getLastError acknowledging it, see processInsert
+	lastWrite    *lastWrite
+	pendingWrite legacyWrite
+
+	// user authenticated on the connection and the authentication in
+	// progress, see saslStart
+	user                *User
+	sasl                *saslConversation
+	conversationCounter int32
+}
+
+// setActive marks the connection as processing a request or idle. It
+// reports false if the connection is being closed.
+func (c *client) setActive(active bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active = active
+	return !c.closing
+}
+
+// closeIfIdle closes the connection unless it is processing a request.
+func (c *client) closeIfIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.active && !c.closing {
+		c.closing = true
+		c.conn.Close()
+	}
 }
 
 func (c *client) reqID() int32 {
@@ -24,202 +63,271 @@ func (c *client) reqID() int32 {
 }
 
 func (c *client) processKillCursors(ctx context.Context, killCursorsOp *mongoproto.OpKillCursors) error {
+	// OP_KILL_CURSORS has no reply to report the error in
+	if c.checkAuthenticated() != nil {
+		return nil
+	}
 
 	for _, curID := range killCursorsOp.CursorIDs {
-		cur, ok := c.server.getCursor(curID)
-		if ok {
-			c.server.removeCursor(curID)
-			if err := cur.Close(ctx); err != nil {
-				return err
+		if cur, ok := c.server.getCursor(curID); ok {
+			if c.authorize(ctx, ActionKillCursors, cur.ns) != nil || c.checkCursorOwner(cur) != nil {
+				continue
 			}
 		}
+
+		if _, err := c.killCursor(ctx, curID); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (c *client) processGetMore(ctx context.Context, getMoreOp *mongoproto.OpGetMore) error {
-	reqID := c.reqID()
-	cursorID := int64(0)
-	start := int32(0)
-
-	var flags mongoproto.OpReplyFlags
-	var docs [][]byte
-
-	cur, ok := c.server.getCursor(getMoreOp.CursorID)
+// killCursor unregisters and closes a cursor. It reports whether the cursor
+// was found, and fails if the cursor was opened by another principal.
+func (c *client) killCursor(ctx context.Context, id int64) (bool, error) {
+	cur, ok := c.server.getCursor(id)
 	if !ok {
-		flags = mongoproto.OpReplyCursorNotFound
-	} else {
-		var err error
-		start, err = cur.Position(ctx)
-		if err != nil {
-			return err
-		}
+		return false, nil
+	}
+	if err := c.checkCursorOwner(cur); err != nil {
+		return true, err
+	}
 
-		closeCursor := getMoreOp.NumberToReturn < 0
+	c.server.removeCursor(id)
+	return true, cur.Close(ctx)
+}
 
-		numReturn := getMoreOp.NumberToReturn
-		if closeCursor {
-			numReturn = -numReturn
-		}
+func (c *client) processGetMore(ctx context.Context, getMoreOp *mongoproto.OpGetMore) error {
+	if err := c.checkAuthenticated(); err != nil {
+		return c.replyQueryFailure(getMoreOp.Header.RequestID, err)
+	}
+	if err := c.authorize(ctx, ActionGetMore, getMoreOp.FullCollectionName); err != nil {
+		return c.replyQueryFailure(getMoreOp.Header.RequestID, err)
+	}
 
-		if numReturn == 0 {
-			numReturn = defaultReturnSize
-		}
+	cur, ok := c.server.getCursor(getMoreOp.CursorID)
+	if !ok {
+		return c.writeReply(getMoreOp.Header.RequestID, &mongoproto.OpReply{
+			Flags: mongoproto.OpReplyCursorNotFound,
+		})
+	}
+	if err := c.checkCursorOwner(cur); err != nil {
+		return c.replyQueryFailure(getMoreOp.Header.RequestID, err)
+	}
 
-		for i := int32(0); i < numReturn; i++ {
-			v, err := cur.Next(ctx)
-			if err != nil {
-				// TODO figure out what to do here
-				if err == io.EOF {
-					closeCursor = true
-				}
+	start, err := cur.Position(ctx)
+	if err != nil {
+		return c.replyQueryFailure(getMoreOp.Header.RequestID, err)
+	}
 
-				break
-			}
+	closeCursor := getMoreOp.NumberToReturn < 0
 
-			b, ok := v.([]byte)
-			if !ok {
-				b, err = bson.Marshal(v)
-				if err != nil {
-					return err
-				}
-			}
+	numReturn := getMoreOp.NumberToReturn
+	if closeCursor {
+		numReturn = -numReturn
+	}
 
-			docs = append(docs, b)
-		}
+	docs, exhausted, err := cur.nextBatch(ctx, numReturn)
+	if err != nil {
+		c.killCursor(ctx, getMoreOp.CursorID)
+		return c.replyQueryFailure(getMoreOp.Header.RequestID, c.requestError(ctx, err))
+	}
 
-		if closeCursor {
-			c.server.removeCursor(getMoreOp.CursorID)
-			if err := cur.Close(ctx); err != nil {
-				return err
-			}
-		} else {
-			cursorID = getMoreOp.CursorID
+	cursorID := getMoreOp.CursorID
+	if closeCursor || exhausted {
+		cursorID = 0
+		if _, err := c.killCursor(ctx, getMoreOp.CursorID); err != nil {
+			return c.replyQueryFailure(getMoreOp.Header.RequestID, err)
 		}
 	}
 
-	reply := mongoproto.OpReply{
-		Header: mongoproto.MsgHeader{
-			RequestID:     reqID,
-			ResponseTo:    getMoreOp.Header.RequestID,
-			MessageLength: 36 + docLen(docs),
-			OpCode:        mongoproto.OpCodeReply,
-		},
+	return c.writeReply(getMoreOp.Header.RequestID, &mongoproto.OpReply{
 		Documents:      docs,
 		StartingFrom:   start,
 		NumberReturned: int32(len(docs)),
-		Flags:          flags,
 		CursorID:       cursorID,
-	}
-	_, err := reply.WriteTo(c.conn)
-	return err
+	})
 }
 
 func (c *client) processQuery(ctx context.Context, queryOp *mongoproto.OpQuery) error {
-	reqID := c.reqID()
-	cursorID := int64(0)
+	if isCommandNamespace(queryOp.FullCollectionName) {
+		return c.processQueryCommand(ctx, queryOp)
+	}
 
-	var docs [][]byte
+	if err := c.checkAuthenticated(); err != nil {
+		return c.replyQueryFailure(queryOp.Header.RequestID, err)
+	}
+	if err := c.authorize(ctx, ActionFind, queryOp.FullCollectionName); err != nil {
+		return c.replyQueryFailure(queryOp.Header.RequestID, err)
+	}
 
-	collectionName := queryOp.FullCollectionName
+	req, err := findRequestFromQuery(queryOp)
+	if err != nil {
+		return c.replyQueryFailure(queryOp.Header.RequestID, &Error{Code: ErrorCodeFailedToParse, Message: err.Error()})
+	}
 
-	if collectionName == "admin.$cmd" {
-		println(queryOp.String())
+	ctx, cancel := withMaxTime(ctx, req.MaxTimeMS)
+	defer cancel()
 
-		b, err := bson.Marshal(map[string]interface{}{"maxWireVersion": 2, "minWireVersion": 2, "ok": 1, "ismaster": true, "readOnly": true})
-		if err != nil {
-			return err
-		}
+	cur, err := c.server.findHandler()(ctx, req)
+	if err != nil {
+		return c.replyQueryFailure(queryOp.Header.RequestID, c.requestError(ctx, err))
+	}
 
-		docs = append(docs, b)
-	} else {
+	sc := c.newCursor(cur, req)
 
-		var query bson.M
-		err := bson.Unmarshal(queryOp.Query, &query)
-		if err != nil {
-			return err
-		}
+	docs, exhausted, err := sc.nextBatch(ctx, req.BatchSize)
+	if err != nil {
+		cur.Close(ctx)
+		return c.replyQueryFailure(queryOp.Header.RequestID, c.requestError(ctx, err))
+	}
 
-		var fields bson.M
-		if len(queryOp.ReturnFieldsSelector) > 0 {
-			err = bson.Unmarshal(queryOp.ReturnFieldsSelector, &fields)
-			if err != nil {
-				return err
-			}
-		}
+	cursorID := int64(0)
+	if queryOp.NumberToReturn < 0 || exhausted {
+		cur.Close(ctx)
+	} else {
+		cursorID = c.server.storeCursor(sc)
+	}
 
-		cur, err := c.server.Handler(queryOp.FullCollectionName, query, fields)
-		if err != nil {
-			return err
-		}
+	return c.writeReply(queryOp.Header.RequestID, &mongoproto.OpReply{
+		Documents:      docs,
+		NumberReturned: int32(len(docs)),
+		CursorID:       cursorID,
+	})
+}
 
-		cur.Skip(ctx, queryOp.NumberToSkip)
+// processQueryCommand runs a command sent as an OP_QUERY against a "db.$cmd"
+// namespace.
+func (c *client) processQueryCommand(ctx context.Context, queryOp *mongoproto.OpQuery) error {
+	cmd, err := parseQueryCommand(queryOp)
+	if err != nil {
+		return c.replyQueryFailure(queryOp.Header.RequestID, &Error{Code: ErrorCodeFailedToParse, Message: err.Error()})
+	}
 
-		closeCursor := queryOp.NumberToReturn < 0
+	b, err := c.runCommand(ctx, cmd)
+	if err != nil {
+		return err
+	}
 
-		numReturn := queryOp.NumberToReturn
-		if closeCursor {
-			numReturn = -numReturn
-		}
-		if numReturn == 0 {
-			numReturn = defaultReturnSize
-		}
+	return c.writeReply(queryOp.Header.RequestID, &mongoproto.OpReply{
+		Documents:      [][]byte{b},
+		NumberReturned: 1,
+	})
+}
 
-		for i := int32(0); i < numReturn; i++ {
-			v, err := cur.Next(ctx)
-			if err != nil {
-				// TODO figure out what to do here
-				if err == io.EOF {
-					closeCursor = true
-				}
+// writeReply sends an OP_REPLY to the client.
+func (c *client) writeReply(responseTo int32, reply *mongoproto.OpReply) error {
+	reply.Header = mongoproto.MsgHeader{
+		RequestID:  c.reqID(),
+		ResponseTo: responseTo,
+	}
+	return c.writeOp(reply)
+}
 
-				break
-			}
+// replyQueryFailure sends an OP_REPLY with the OpReplyQueryFailure flag set
+// describing err.
+func (c *client) replyQueryFailure(responseTo int32, err error) error {
+	b, err := bson.Marshal(asError(err).queryFailureReply())
+	if err != nil {
+		return err
+	}
 
-			b, ok := v.([]byte)
-			if !ok {
-				b, err = bson.Marshal(v)
-				if err != nil {
-					return err
-				}
-			}
+	return c.writeReply(responseTo, &mongoproto.OpReply{
+		Flags:          mongoproto.OpReplyQueryFailure,
+		Documents:      [][]byte{b},
+		NumberReturned: 1,
+	})
+}
 
-			docs = append(docs, b)
-		}
+func (c *client) processMsg(ctx context.Context, msgOp *mongoproto.OpMsgV2) error {
+	var b []byte
+	cmd, err := parseMsgCommand(msgOp)
+	if err != nil {
+		b, err = bson.Marshal((&Error{Code: ErrorCodeFailedToParse, Message: err.Error()}).commandReply())
+	} else {
+		b, err = c.runCommand(ctx, cmd)
+	}
+	if err != nil {
+		return err
+	}
 
-		if closeCursor {
-			cur.Close(ctx)
-		} else {
-			cursorID = c.server.storeCursor(cur)
-		}
+	if msgOp.Flags&mongoproto.OpMsgMoreToCome != 0 {
+		return nil
 	}
 
-	reply := mongoproto.OpReply{
+	reply := mongoproto.OpMsgV2{
 		Header: mongoproto.MsgHeader{
-			RequestID:     reqID,
-			ResponseTo:    queryOp.Header.RequestID,
-			MessageLength: 36 + docLen(docs),
-			OpCode:        mongoproto.OpCodeReply,
+			RequestID:  c.reqID(),
+			ResponseTo: msgOp.Header.RequestID,
 		},
-		Documents:      docs,
-		NumberReturned: int32(len(docs)),
-		CursorID:       cursorID,
+		Body: b,
 	}
-
-	_, err := reply.WriteTo(c.conn)
-	return err
+	return c.writeOp(&reply)
 }
 
 func (c *client) process(ctx context.Context) error {
+	// A legacy write held back is applied even if the client disconnects
+	parent := ctx
+	defer func() {
+		c.flushWrite(c.withUser(parent), nil)
+	}()
+
+	// Requests are aborted when the client disconnects
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ops := make(chan mongoproto.Op)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			op, err := mongoproto.OpFromReaderLimit(c.conn, c.server.maxMessageSize())
+			if err != nil {
+				readErr <- err
+				cancel()
+				return
+			}
+
+			select {
+			case ops <- op:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
 	for {
+		var wait <-chan time.Time
+		if c.pendingWrite != nil {
+			wait = time.After(getLastErrorWait)
+		}
 
-		op, err := mongoproto.OpFromReader(c.conn)
-		if err != nil {
+		var op mongoproto.Op
+		select {
+		case op = <-ops:
+		case err := <-readErr:
 			return err
+		case <-wait:
+			if !c.setActive(true) {
+				return nil
+			}
+			c.flushWrite(c.withUser(ctx), nil)
+			c.setActive(false)
+			continue
 		}
 
-		fmt.Printf("%#v\n", op)
+		if !c.setActive(true) {
+			return nil
+		}
+
+		ctx := c.withUser(ctx)
+		op, err := c.decompress(ctx, op)
+		if err != nil {
+			return err
+		}
+		if c.pendingWrite != nil {
+			c.flushWrite(ctx, getLastErrorConcern(op))
+		}
 
 		switch v := op.(type) {
 		case *mongoproto.OpGetMore:
@@ -234,21 +342,63 @@ func (c *client) process(ctx context.Context) error {
 			if err := c.processKillCursors(ctx, v); err != nil {
 				return err
 			}
+		case *mongoproto.OpMsgV2:
+			if err := c.processMsg(ctx, v); err != nil {
+				return err
+			}
+		case *mongoproto.OpInsert:
+			if err := c.processInsert(ctx, v); err != nil {
+				return err
+			}
+		case *mongoproto.OpUpdate:
+			if err := c.processUpdate(ctx, v); err != nil {
+				return err
+			}
+		case *mongoproto.OpDelete:
+			if err := c.processDelete(ctx, v); err != nil {
+				return err
+			}
+		}
+
+		c.setActive(false)
+		if c.server.shuttingDown() {
+			return nil
 		}
 	}
 
 }
 
-func (c *client) close(ctx context.Context) error {
-
-	return nil
+// withMaxTime returns a context that expires after maxTimeMS milliseconds.
+// A maxTimeMS of zero means no time limit.
+func withMaxTime(ctx context.Context, maxTimeMS int64) (context.Context, context.CancelFunc) {
+	if maxTimeMS <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(maxTimeMS)*time.Millisecond)
 }
 
-func docLen(docs [][]byte) int32 {
-	c := int32(0)
-	for _, doc := range docs {
-		c += int32(len(doc))
+// requestError converts an error caused by the request context being done
+// into the error MongoDB reports in that case.
+func (c *client) requestError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return Errorf(ErrorCodeMaxTimeMSExpired, "operation exceeded time limit")
+	case context.Canceled:
+		if c.server.ctx.Err() != nil {
+			return Errorf(ErrorCodeInterruptedAtShutdown, "interrupted at shutdown")
+		}
+		return Errorf(ErrorCodeInterrupted, "operation was interrupted")
 	}
+	return err
+}
 
-	return c
+// close closes the connection and the cursors it opened.
+func (c *client) close(ctx context.Context) error {
+	c.conn.Close()
+	return c.server.closeCursors(ctx, func(sc *serverCursor) bool {
+		return sc.owner == c
+	})
 }
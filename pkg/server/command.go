@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/orktes/mongache/pkg/mongoproto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+const cmdCollection = "$cmd"
+
+// maxWriteBatchSize is the largest number of statements in a write command.
+const maxWriteBatchSize = 100000
+
+var errEmptyCommand = errors.New("empty command document")
+
+// Command is a database command received either as an OP_QUERY against a
+// "db.$cmd" namespace or as the body of an OP_MSG.
+type Command struct {
+	// Name is the first key of the command document, e.g. "find".
+	Name string
+	// Database is the database the command was sent to.
+	Database string
+	// Doc is the full command document. Document sequences of an OP_MSG are
+	// merged into it as arrays.
+	Doc bson.Raw
+
+	client *client
+}
+
+// CommandFunc implements a database command. The returned document is sent to
+// the client with "ok: 1" appended unless it already contains an "ok" field.
+type CommandFunc func(ctx context.Context, cmd *Command) (bson.D, error)
+
+var builtinCommands = map[string]CommandFunc{}
+
+func init() {
+	builtinCommands["ping"] = cmdPing
+	builtinCommands["buildInfo"] = cmdBuildInfo
+	builtinCommands["buildinfo"] = cmdBuildInfo
+	builtinCommands["whatsmyuri"] = cmdWhatsMyURI
+	builtinCommands["endSessions"] = cmdEndSessions
+}
+
+// RegisterCommand registers fn as the implementation of the command name.
+// Registering a command with the name of a built-in command replaces it.
+func (s *Server) RegisterCommand(name string, fn CommandFunc) {
+	s.commandsMutex.Lock()
+	defer s.commandsMutex.Unlock()
+	if s.commands == nil {
+		s.commands = map[string]CommandFunc{}
+	}
+	s.commands[name] = fn
+}
+
+func (s *Server) command(name string) (CommandFunc, bool) {
+	s.commandsMutex.RLock()
+	fn, ok := s.commands[name]
+	s.commandsMutex.RUnlock()
+	if ok {
+		return fn, true
+	}
+
+	fn, ok = builtinCommands[name]
+	return fn, ok
+}
+
+// isCommandNamespace tells if a "db.collection" namespace targets commands.
+func isCommandNamespace(ns string) bool {
+	return strings.HasSuffix(ns, "."+cmdCollection)
+}
+
+// parseQueryCommand parses a command sent as an OP_QUERY.
+func parseQueryCommand(queryOp *mongoproto.OpQuery) (*Command, error) {
+	doc := bson.Raw(queryOp.Query)
+	// Legacy drivers wrap the command when sending read preferences
+	if v, err := doc.LookupErr("$query"); err == nil {
+		if d, ok := v.DocumentOK(); ok {
+			doc = d
+		}
+	}
+
+	cmd := &Command{
+		Database: strings.TrimSuffix(queryOp.FullCollectionName, "."+cmdCollection),
+		Doc:      doc,
+	}
+	return cmd, cmd.parseName()
+}
+
+// parseMsgCommand parses a command sent as an OP_MSG.
+func parseMsgCommand(msgOp *mongoproto.OpMsgV2) (*Command, error) {
+	doc := bson.Raw(msgOp.Body)
+	if len(msgOp.Sequences) > 0 {
+		elems, err := doc.Elements()
+		if err != nil {
+			return nil, err
+		}
+
+		idx, b := bsoncore.AppendDocumentStart(nil)
+		for _, elem := range elems {
+			b = append(b, elem...)
+		}
+		for _, seq := range msgOp.Sequences {
+			var aidx int32
+			aidx, b = bsoncore.AppendArrayElementStart(b, seq.Identifier)
+			for i, d := range seq.Documents {
+				b = bsoncore.AppendDocumentElement(b, strconv.Itoa(i), d)
+			}
+			if b, err = bsoncore.AppendArrayEnd(b, aidx); err != nil {
+				return nil, err
+			}
+		}
+		if b, err = bsoncore.AppendDocumentEnd(b, idx); err != nil {
+			return nil, err
+		}
+		doc = b
+	}
+
+	cmd := &Command{Doc: doc}
+	if db, ok := doc.Lookup("$db").StringValueOK(); ok {
+		cmd.Database = db
+	}
+	return cmd, cmd.parseName()
+}
+
+func (cmd *Command) parseName() error {
+	elem, err := cmd.Doc.IndexErr(0)
+	if err != nil {
+		return errEmptyCommand
+	}
+	cmd.Name = elem.Key()
+	return nil
+}
+
+// Argument returns the value of the command's first element, e.g. the
+// collection name of a "find" command.
+func (cmd *Command) Argument() bson.RawValue {
+	return cmd.Doc.Index(0).Value()
+}
+
+// RemoteAddr returns the address of the client that sent the command.
+func (cmd *Command) RemoteAddr() string {
+	return cmd.client.conn.RemoteAddr().String()
+}
+
+// runCommand executes a command and returns the encoded reply document.
+func (c *client) runCommand(ctx context.Context, cmd *Command) ([]byte, error) {
+	cmd.client = c
+
+	maxTimeMS, _ := asInt64(cmd.Doc.Lookup("maxTimeMS"))
+	ctx, cancel := withMaxTime(ctx, maxTimeMS)
+	defer cancel()
+
+	var reply bson.D
+	fn, ok := c.server.command(cmd.Name)
+	if !ok {
+		reply = Errorf(ErrorCodeCommandNotFound, "no such command: '%s'", cmd.Name).commandReply()
+	} else if err := c.checkCommand(ctx, cmd); err != nil {
+		reply = asError(err).commandReply()
+	} else {
+		var err error
+		reply, err = fn(ctx, cmd)
+		if err != nil {
+			reply = asError(c.requestError(ctx, err)).commandReply()
+		}
+	}
+
+	hasOK := false
+	for _, e := range reply {
+		if e.Key == "ok" {
+			hasOK = true
+			break
+		}
+	}
+	if !hasOK {
+		reply = append(reply, bson.E{Key: "ok", Value: 1.0})
+	}
+
+	return bson.Marshal(reply)
+}
+
+// checkCommand checks that the connection may run cmd. The commands of the
+// handshake and of authentication are neither authenticated nor authorized.
+func (c *client) checkCommand(ctx context.Context, cmd *Command) error {
+	if authFreeCommands[cmd.Name] {
+		return nil
+	}
+	if err := c.checkAuthenticated(); err != nil {
+		return err
+	}
+	return c.authorize(ctx, cmd.Name, cmd.namespace())
+}
+
+// asInt64 returns the value of a numeric BSON value as an int64.
+func asInt64(v bson.RawValue) (int64, bool) {
+	switch v.Type {
+	case bsontype.Int32:
+		return int64(v.Int32()), true
+	case bsontype.Int64:
+		return v.Int64(), true
+	case bsontype.Double:
+		return int64(v.Double()), true
+	}
+	return 0, false
+}
+
+func cmdPing(ctx context.Context, cmd *Command) (bson.D, error) {
+	return bson.D{}, nil
+}
+
+func cmdBuildInfo(ctx context.Context, cmd *Command) (bson.D, error) {
+	return bson.D{
+		{Key: "version", Value: "3.6.0"},
+		{Key: "versionArray", Value: bson.A{int32(3), int32(6), int32(0), int32(0)}},
+		{Key: "bits", Value: int32(64)},
+		{Key: "maxBsonObjectSize", Value: int32(16 * 1024 * 1024)},
+	}, nil
+}
+
+func cmdWhatsMyURI(ctx context.Context, cmd *Command) (bson.D, error) {
+	return bson.D{{Key: "you", Value: cmd.RemoteAddr()}}, nil
+}
+
+func cmdEndSessions(ctx context.Context, cmd *Command) (bson.D, error) {
+	return bson.D{}, nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"io"
+
+	"github.com/orktes/mongache/pkg/mongoproto"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type wireOp interface {
+	mongoproto.Op
+	io.WriterTo
+}
+
+// compressorEnabled tells if the server accepts messages compressed with id.
+func (s *Server) compressorEnabled(id mongoproto.CompressorID) bool {
+	for _, name := range s.Compressors {
+		if c, ok := mongoproto.CompressorByName(name); ok && c == id {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateCompressors returns the compressors listed in the "compression"
+// field of a handshake that are enabled on the server, in the client's order
+// of preference.
+func (s *Server) negotiateCompressors(requested bson.RawValue) bson.A {
+	names := bson.A{}
+
+	arr, ok := requested.ArrayOK()
+	if !ok {
+		return names
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return names
+	}
+
+	for _, v := range values {
+		name, ok := v.StringValueOK()
+		if !ok {
+			continue
+		}
+		if id, ok := mongoproto.CompressorByName(name); ok && s.compressorEnabled(id) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// decompress returns the op wrapped in an OP_COMPRESSED message and sets the
+// compressor of the replies, or returns op as is when it is not compressed.
+// Messages compressed with a compressor that is not enabled are answered
+// with an error and nil is returned.
+func (c *client) decompress(ctx context.Context, op mongoproto.Op) (mongoproto.Op, error) {
+	c.compressor = nil
+	compressed, ok := op.(*mongoproto.OpCompressed)
+	if !ok {
+		return op, nil
+	}
+
+	if !c.server.compressorEnabled(compressed.CompressorID) {
+		return nil, c.replyCompressorNotEnabled(ctx, compressed)
+	}
+	if compressed.UncompressedSize > c.server.maxMessageSize()-mongoproto.MsgHeaderLen {
+		return nil, mongoproto.ErrMessageTooLarge
+	}
+
+	op, err := compressed.Decompress()
+	if err != nil {
+		return nil, err
+	}
+	c.compressor = &compressed.CompressorID
+	return op, nil
+}
+
+// replyCompressorNotEnabled answers a message compressed with a compressor
+// that is not enabled with an uncompressed error in the reply format of the
+// wrapped op. Legacy writes record the error for getLastError.
+func (c *client) replyCompressorNotEnabled(ctx context.Context, op *mongoproto.OpCompressed) error {
+	err := Errorf(ErrorCodeProtocolError, "compressor %v is not enabled", op.CompressorID)
+
+	switch op.OriginalOpCode {
+	case mongoproto.OpCodeQuery, mongoproto.OpCodeGetMore:
+		return c.replyQueryFailure(op.Header.RequestID, err)
+	case mongoproto.OpCodeMsg:
+		b, merr := bson.Marshal(err.commandReply())
+		if merr != nil {
+			return merr
+		}
+		return c.writeOp(&mongoproto.OpMsgV2{
+			Header: mongoproto.MsgHeader{
+				RequestID:  c.reqID(),
+				ResponseTo: op.Header.RequestID,
+			},
+			Body: b,
+		})
+	case mongoproto.OpCodeInsert, mongoproto.OpCodeUpdate, mongoproto.OpCodeDelete:
+		update := op.OriginalOpCode == mongoproto.OpCodeUpdate
+		c.deferWrite(ctx, func(ctx context.Context, wc *WriteConcern) *lastWrite {
+			return &lastWrite{err: err, update: update}
+		})
+	}
+	return nil
+}
+
+// writeOp sends an op to the client. The op is compressed when the request
+// it answers was compressed.
+func (c *client) writeOp(op wireOp) error {
+	if c.compressor != nil {
+		compressed, err := mongoproto.Compress(op, *c.compressor)
+		if err != nil {
+			return err
+		}
+		op = compressed
+	}
+
+	_, err := op.WriteTo(c.conn)
+	return err
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/orktes/mongache/pkg/mongoproto"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DefaultCursorTimeout is the time after which idle cursors are closed when
+// Server.CursorTimeout is not set.
+const DefaultCursorTimeout = 10 * time.Minute
+
+// Cursor iterates over the results of a query
+type Cursor interface {
+	Next(ctx context.Context) (interface{}, error)
+	Skip(ctx context.Context, n int32) error
+	Position(ctx context.Context) (int32, error)
+	Close(ctx context.Context) error
+}
+
+// serverCursor is a Cursor registered with the server so that it can be
+// continued with getMore requests.
+type serverCursor struct {
+	Cursor
+
+	id        int64     // set when the cursor is registered, never changed after
+	ns        string    // "dbname.collectionname"
+	limit     int32     // maximum number of documents to return, 0 for no limit
+	returned  int32     // number of documents returned so far
+	owner     *client   // connection that opened the cursor
+	principal Principal // client that opened the cursor
+	noTimeout bool      // exempt from the idle timeout
+	lastUsed  int64     // unix nanoseconds, accessed atomically
+
+	// mu serializes batch reads and Close, as cursors may be continued,
+	// killed and reaped from different connections
+	mu     sync.Mutex
+	closed bool
+}
+
+// newCursor wraps a Cursor returned by a handler for the request req.
+func (c *client) newCursor(cur Cursor, req *FindRequest) *serverCursor {
+	return &serverCursor{
+		Cursor:    cur,
+		ns:        req.Namespace(),
+		limit:     req.Limit,
+		owner:     c,
+		principal: c.principal(),
+		noTimeout: req.Flags&mongoproto.OpQueryNoCursorTimeout != 0,
+	}
+}
+
+func (sc *serverCursor) touch() {
+	atomic.StoreInt64(&sc.lastUsed, time.Now().UnixNano())
+}
+
+func (sc *serverCursor) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&sc.lastUsed))
+}
+
+// Position returns the position of the underlying cursor.
+func (sc *serverCursor) Position(ctx context.Context) (int32, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.Cursor.Position(ctx)
+}
+
+// Close closes the underlying cursor once, waiting for a batch being read
+// to complete.
+func (sc *serverCursor) Close(ctx context.Context) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed {
+		return nil
+	}
+	sc.closed = true
+	return sc.Cursor.Close(ctx)
+}
+
+// nextBatch reads up to n documents from the cursor. exhausted is set when
+// the cursor has no more documents or its limit has been reached. Any other
+// error from the underlying cursor is returned and the batch discarded.
+// Reading from a closed cursor fails with CursorNotFound.
+func (sc *serverCursor) nextBatch(ctx context.Context, n int32) (docs [][]byte, exhausted bool, err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	defer sc.touch()
+	if sc.closed {
+		return nil, false, Errorf(ErrorCodeCursorNotFound, "cursor id %d not found", sc.id)
+	}
+
+	if n <= 0 {
+		n = defaultReturnSize
+	}
+	if sc.limit > 0 && sc.limit-sc.returned < n {
+		n = sc.limit - sc.returned
+	}
+
+	for i := int32(0); i < n; i++ {
+		v, err := sc.Next(ctx)
+		if err == io.EOF {
+			exhausted = true
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		b, ok := v.([]byte)
+		if !ok {
+			b, err = bson.Marshal(v)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+
+		docs = append(docs, b)
+	}
+
+	sc.returned += int32(len(docs))
+	if sc.limit > 0 && sc.returned >= sc.limit {
+		exhausted = true
+	}
+
+	return docs, exhausted, nil
+}
+
+// cursorStore holds the cursors that can be continued with getMore. The
+// members of a ReplicaSet share a store.
+type cursorStore struct {
+	mu        sync.RWMutex
+	idCounter int64
+	cursors   map[int64]*serverCursor
+}
+
+func newCursorStore() *cursorStore {
+	return &cursorStore{cursors: map[int64]*serverCursor{}}
+}
+
+func (s *Server) storeCursor(c *serverCursor) int64 {
+	c.id = atomic.AddInt64(&s.cursors.idCounter, 1)
+	c.touch()
+	s.cursors.mu.Lock()
+	defer s.cursors.mu.Unlock()
+	s.cursors.cursors[c.id] = c
+	return c.id
+}
+
+func (s *Server) removeCursor(id int64) {
+	s.cursors.mu.Lock()
+	defer s.cursors.mu.Unlock()
+	delete(s.cursors.cursors, id)
+}
+
+func (s *Server) getCursor(id int64) (*serverCursor, bool) {
+	s.cursors.mu.RLock()
+	defer s.cursors.mu.RUnlock()
+	c, ok := s.cursors.cursors[id]
+	if ok {
+		c.touch()
+	}
+	return c, ok
+}
+
+// cursorTimeout returns the idle timeout of cursors.
+func (s *Server) cursorTimeout() time.Duration {
+	if s.CursorTimeout > 0 {
+		return s.CursorTimeout
+	}
+	return DefaultCursorTimeout
+}
+
+// reap periodically closes cursors that have been idle for longer than
+// timeout until ctx is done. A store has a single reaper, started by the
+// Server or ReplicaSet that created it.
+func (cs *cursorStore) reap(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			cs.closeCursors(ctx, func(c *serverCursor) bool {
+				return !c.noTimeout && now.Sub(c.idleSince()) > timeout
+			})
+		}
+	}
+}
+
+// closeCursors unregisters and closes all cursors matching fn.
+func (cs *cursorStore) closeCursors(ctx context.Context, fn func(c *serverCursor) bool) error {
+	var expired []*serverCursor
+	cs.mu.Lock()
+	for id, c := range cs.cursors {
+		if fn(c) {
+			expired = append(expired, c)
+			delete(cs.cursors, id)
+		}
+	}
+	cs.mu.Unlock()
+
+	var err error
+	for _, c := range expired {
+		if cerr := c.Close(ctx); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeCursors unregisters and closes all cursors of the store of the
+// server matching fn.
+func (s *Server) closeCursors(ctx context.Context, fn func(c *serverCursor) bool) error {
+	return s.cursors.closeCursors(ctx, fn)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrorCode is a MongoDB server error code.
+// https://github.com/mongodb/mongo/blob/master/src/mongo/base/error_codes.yml
+type ErrorCode int32
+
+// String returns the code name of the error code.
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Location%d", int32(c))
+}
+
+// Error codes reported by the server
+const (
+	ErrorCodeInternalError         = ErrorCode(1)
+	ErrorCodeBadValue              = ErrorCode(2)
+	ErrorCodeUnknownError          = ErrorCode(8)
+	ErrorCodeFailedToParse         = ErrorCode(9)
+	ErrorCodeUserNotFound          = ErrorCode(11)
+	ErrorCodeUnauthorized          = ErrorCode(13)
+	ErrorCodeTypeMismatch          = ErrorCode(14)
+	ErrorCodeProtocolError         = ErrorCode(17)
+	ErrorCodeAuthenticationFailed  = ErrorCode(18)
+	ErrorCodeIllegalOperation      = ErrorCode(20)
+	ErrorCodeNamespaceNotFound     = ErrorCode(26)
+	ErrorCodeIndexNotFound         = ErrorCode(27)
+	ErrorCodeCursorNotFound        = ErrorCode(43)
+	ErrorCodeNamespaceExists       = ErrorCode(48)
+	ErrorCodeMaxTimeMSExpired      = ErrorCode(50)
+	ErrorCodeCommandNotFound       = ErrorCode(59)
+	ErrorCodeWriteConcernFailed    = ErrorCode(64)
+	ErrorCodeImmutableField        = ErrorCode(66)
+	ErrorCodeCannotCreateIndex     = ErrorCode(67)
+	ErrorCodeInvalidOptions        = ErrorCode(72)
+	ErrorCodeInvalidNamespace      = ErrorCode(73)
+	ErrorCodeIndexKeySpecsConflict = ErrorCode(86)
+	ErrorCodeOperationFailed       = ErrorCode(96)
+	ErrorCodeCommandNotSupported   = ErrorCode(115)
+	ErrorCodeMechanismUnavailable  = ErrorCode(334)
+	ErrorCodeNotWritablePrimary    = ErrorCode(10107)
+	ErrorCodeDuplicateKey          = ErrorCode(11000)
+	ErrorCodeInterruptedAtShutdown = ErrorCode(11600)
+	ErrorCodeInterrupted           = ErrorCode(11601)
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrorCodeInternalError:         "InternalError",
+	ErrorCodeBadValue:              "BadValue",
+	ErrorCodeUnknownError:          "UnknownError",
+	ErrorCodeFailedToParse:         "FailedToParse",
+	ErrorCodeUserNotFound:          "UserNotFound",
+	ErrorCodeUnauthorized:          "Unauthorized",
+	ErrorCodeTypeMismatch:          "TypeMismatch",
+	ErrorCodeProtocolError:         "ProtocolError",
+	ErrorCodeAuthenticationFailed:  "AuthenticationFailed",
+	ErrorCodeIllegalOperation:      "IllegalOperation",
+	ErrorCodeNamespaceNotFound:     "NamespaceNotFound",
+	ErrorCodeIndexNotFound:         "IndexNotFound",
+	ErrorCodeCursorNotFound:        "CursorNotFound",
+	ErrorCodeNamespaceExists:       "NamespaceExists",
+	ErrorCodeMaxTimeMSExpired:      "MaxTimeMSExpired",
+	ErrorCodeCommandNotFound:       "CommandNotFound",
+	ErrorCodeWriteConcernFailed:    "WriteConcernFailed",
+	ErrorCodeImmutableField:        "ImmutableField",
+	ErrorCodeCannotCreateIndex:     "CannotCreateIndex",
+	ErrorCodeInvalidOptions:        "InvalidOptions",
+	ErrorCodeInvalidNamespace:      "InvalidNamespace",
+	ErrorCodeIndexKeySpecsConflict: "IndexKeySpecsConflict",
+	ErrorCodeOperationFailed:       "OperationFailed",
+	ErrorCodeCommandNotSupported:   "CommandNotSupported",
+	ErrorCodeMechanismUnavailable:  "MechanismUnavailable",
+	ErrorCodeNotWritablePrimary:    "NotWritablePrimary",
+	ErrorCodeDuplicateKey:          "DuplicateKey",
+	ErrorCodeInterruptedAtShutdown: "InterruptedAtShutdown",
+	ErrorCodeInterrupted:           "Interrupted",
+}
+
+// Error is an error reported to the client with a MongoDB error code.
+// Handlers can return an *Error to control the code the client receives;
+// other errors are reported as UnknownError.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Errorf returns an *Error with the given code and a formatted message.
+func Errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Code, e.Code, e.Message)
+}
+
+// asError converts any error to an *Error.
+func asError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: ErrorCodeUnknownError, Message: err.Error()}
+}
+
+// commandReply returns the reply document of a failed command.
+func (e *Error) commandReply() bson.D {
+	return bson.D{
+		{Key: "ok", Value: 0.0},
+		{Key: "errmsg", Value: e.Message},
+		{Key: "code", Value: int32(e.Code)},
+		{Key: "codeName", Value: e.Code.String()},
+	}
+}
+
+// queryFailureReply returns the document of an OP_REPLY with the
+// OpReplyQueryFailure flag set.
+func (e *Error) queryFailureReply() bson.D {
+	return bson.D{
+		{Key: "$err", Value: e.Message},
+		{Key: "code", Value: int32(e.Code)},
+	}
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/orktes/mongache/pkg/mongoproto"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func init() {
+	builtinCommands["find"] = cmdFind
+	builtinCommands["getMore"] = cmdGetMore
+	builtinCommands["killCursors"] = cmdKillCursors
+}
+
+// FindRequest describes a query received from a client either as a legacy
+// OP_QUERY or as a find command.
+type FindRequest struct {
+	Database    string
+	Collection  string
+	Filter      bson.M
+	Projection  bson.M
+	Sort        bson.D
+	Skip        int32 // number of documents the handler should skip
+	Limit       int32 // maximum number of documents to return, 0 for no limit
+	BatchSize   int32
+	Hint        interface{} // index name or key pattern
+	Comment     interface{}
+	MaxTimeMS   int64
+	Collation   bson.M
+	ReadConcern bson.M
+	Flags       mongoproto.OpQueryFlags
+}
+
+// Namespace returns the "dbname.collectionname" namespace of the request.
+func (req *FindRequest) Namespace() string {
+	return req.Database + "." + req.Collection
+}
+
+// FindHandler answers queries. The handler is responsible for skipping
+// req.Skip documents, and may apply the filter, projection, sort and limit
+// itself. The server stops returning documents once req.Limit is reached.
+//
+// ctx is cancelled when the request completes, the client disconnects, the
+// server shuts down or req.MaxTimeMS elapses. The returned cursor must use
+// the context passed to its methods instead.
+type FindHandler func(ctx context.Context, req *FindRequest) (Cursor, error)
+
+// Find adapts a QueryHandler to a FindHandler. Skip is applied to the cursor
+// returned by the QueryHandler. A QueryHandler receives no sort, so req.Sort
+// is dropped and documents are returned in the order of the cursor; use a
+// FindHandler to support sorted queries.
+func (h QueryHandler) Find(ctx context.Context, req *FindRequest) (Cursor, error) {
+	cur, err := h(ctx, req.Namespace(), req.Filter, req.Projection)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cur.Skip(ctx, req.Skip); err != nil {
+		cur.Close(ctx)
+		return nil, err
+	}
+
+	return cur, nil
+}
+
+// findHandler returns the handler answering queries, failing them with
+// CommandNotSupported when neither FindHandler nor Handler is set.
+func (s *Server) findHandler() FindHandler {
+	if s.FindHandler != nil {
+		return s.FindHandler
+	}
+	if s.Handler != nil {
+		return s.Handler.Find
+	}
+	return func(ctx context.Context, req *FindRequest) (Cursor, error) {
+		return nil, Errorf(ErrorCodeCommandNotSupported, "find is not supported by this server")
+	}
+}
+
+// splitNamespace splits a "dbname.collectionname" namespace.
+func splitNamespace(ns string) (string, string) {
+	if i := strings.IndexByte(ns, '.'); i >= 0 {
+		return ns[:i], ns[i+1:]
+	}
+	return ns, ""
+}
+
+type legacyQuery struct {
+	Query     bson.M      `bson:"$query"`
+	OrderBy   bson.D      `bson:"$orderby"`
+	Hint      interface{} `bson:"$hint"`
+	Comment   interface{} `bson:"$comment"`
+	MaxTimeMS int64       `bson:"$maxTimeMS"`
+}
+
+// findRequestFromQuery builds a FindRequest from a legacy OP_QUERY.
+func findRequestFromQuery(queryOp *mongoproto.OpQuery) (*FindRequest, error) {
+	req := &FindRequest{
+		Skip:  queryOp.NumberToSkip,
+		Flags: queryOp.Flags,
+	}
+	req.Database, req.Collection = splitNamespace(queryOp.FullCollectionName)
+
+	// A negative numberToReturn asks for a single batch
+	req.BatchSize = queryOp.NumberToReturn
+	if req.BatchSize < 0 {
+		req.BatchSize = -req.BatchSize
+		req.Limit = req.BatchSize
+	}
+
+	query := bson.Raw(queryOp.Query)
+	if _, err := query.LookupErr("$query"); err == nil {
+		var wrapped legacyQuery
+		if err := bson.Unmarshal(query, &wrapped); err != nil {
+			return nil, err
+		}
+		req.Filter = wrapped.Query
+		req.Sort = wrapped.OrderBy
+		req.Hint = wrapped.Hint
+		req.Comment = wrapped.Comment
+		req.MaxTimeMS = wrapped.MaxTimeMS
+	} else if err := bson.Unmarshal(query, &req.Filter); err != nil {
+		return nil, err
+	}
+	if req.Filter == nil {
+		req.Filter = bson.M{}
+	}
+
+	if len(queryOp.ReturnFieldsSelector) > 0 {
+		if err := bson.Unmarshal(queryOp.ReturnFieldsSelector, &req.Projection); err != nil {
+			return nil, err
+		}
+	}
+
+	return req, nil
+}
+
+type findCommand struct {
+	Filter              bson.M      `bson:"filter"`
+	Projection          bson.M      `bson:"projection"`
+	Sort                bson.D      `bson:"sort"`
+	Skip                int64       `bson:"skip"`
+	Limit               int64       `bson:"limit"`
+	BatchSize           int64       `bson:"batchSize"`
+	SingleBatch         bool        `bson:"singleBatch"`
+	Hint                interface{} `bson:"hint"`
+	Comment             interface{} `bson:"comment"`
+	MaxTimeMS           int64       `bson:"maxTimeMS"`
+	Collation           bson.M      `bson:"collation"`
+	ReadConcern         bson.M      `bson:"readConcern"`
+	Tailable            bool        `bson:"tailable"`
+	AwaitData           bool        `bson:"awaitData"`
+	NoCursorTimeout     bool        `bson:"noCursorTimeout"`
+	AllowPartialResults bool        `bson:"allowPartialResults"`
+}
+
+// findRequestFromCommand builds a FindRequest from a find command. It also
+// reports whether the client asked for a single batch.
+func findRequestFromCommand(cmd *Command) (*FindRequest, bool, error) {
+	collection, ok := cmd.Argument().StringValueOK()
+	if !ok {
+		return nil, false, Errorf(ErrorCodeInvalidNamespace, "collection name has invalid type")
+	}
+
+	var args findCommand
+	if err := bson.Unmarshal(cmd.Doc, &args); err != nil {
+		return nil, false, &Error{Code: ErrorCodeFailedToParse, Message: err.Error()}
+	}
+	if args.Filter == nil {
+		args.Filter = bson.M{}
+	}
+
+	// A negative limit is the legacy way of asking for a single batch
+	if args.Limit < 0 {
+		args.Limit = -args.Limit
+		args.SingleBatch = true
+	}
+
+	req := &FindRequest{
+		Database:    cmd.Database,
+		Collection:  collection,
+		Filter:      args.Filter,
+		Projection:  args.Projection,
+		Sort:        args.Sort,
+		Skip:        int32(args.Skip),
+		Limit:       int32(args.Limit),
+		BatchSize:   int32(args.BatchSize),
+		Hint:        args.Hint,
+		Comment:     args.Comment,
+		MaxTimeMS:   args.MaxTimeMS,
+		Collation:   args.Collation,
+		ReadConcern: args.ReadConcern,
+	}
+	if args.Tailable {
+		req.Flags |= mongoproto.OpQueryTailableCursor
+	}
+	if args.AwaitData {
+		req.Flags |= mongoproto.OpQueryAwaitData
+	}
+	if args.NoCursorTimeout {
+		req.Flags |= mongoproto.OpQueryNoCursorTimeout
+	}
+	if args.AllowPartialResults {
+		req.Flags |= mongoproto.OpQueryPartial
+	}
+
+	return req, args.SingleBatch, nil
+}
+
+func cmdFind(ctx context.Context, cmd *Command) (bson.D, error) {
+	req, singleBatch, err := findRequestFromCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := cmd.client.server.findHandler()(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := cmd.client.newCursor(cur, req)
+	return cmd.client.cursorReply(ctx, sc, "firstBatch", req.BatchSize, singleBatch)
+}
+
+type getMoreCommand struct {
+	GetMore    int64  `bson:"getMore"`
+	Collection string `bson:"collection"`
+	BatchSize  int64  `bson:"batchSize"`
+}
+
+func cmdGetMore(ctx context.Context, cmd *Command) (bson.D, error) {
+	var args getMoreCommand
+	if err := bson.Unmarshal(cmd.Doc, &args); err != nil {
+		return nil, &Error{Code: ErrorCodeFailedToParse, Message: err.Error()}
+	}
+
+	sc, ok := cmd.client.server.getCursor(args.GetMore)
+	if !ok {
+		return nil, Errorf(ErrorCodeCursorNotFound, "cursor id %d not found", args.GetMore)
+	}
+	if err := cmd.client.checkCursorOwner(sc); err != nil {
+		return nil, err
+	}
+	if ns := cmd.Database + "." + args.Collection; ns != sc.ns {
+		return nil, Errorf(ErrorCodeUnauthorized, "requested getMore on namespace '%s', but cursor belongs to a different namespace %s", ns, sc.ns)
+	}
+
+	return cmd.client.cursorReply(ctx, sc, "nextBatch", int32(args.BatchSize), false)
+}
+
+// cursorReply reads the next batch from a cursor and builds the cursor
+// document of a command reply. The cursor is registered with the server when
+// it has more documents, and unregistered and closed when it is exhausted.
+func (c *client) cursorReply(ctx context.Context, sc *serverCursor, batchField string, batchSize int32, singleBatch bool) (bson.D, error) {
+	// The id of a registered cursor never changes, so sc.id is not written
+	// here: the cursor may be continued from another connection meanwhile
+	id := sc.id
+
+	docs, exhausted, err := sc.nextBatch(ctx, batchSize)
+	if err != nil {
+		if id != 0 {
+			c.server.removeCursor(id)
+		}
+		sc.Close(ctx)
+		return nil, err
+	}
+
+	if exhausted || singleBatch {
+		if id != 0 {
+			c.server.removeCursor(id)
+		}
+		id = 0
+		if err := sc.Close(ctx); err != nil {
+			return nil, err
+		}
+	} else if id == 0 {
+		id = c.server.storeCursor(sc)
+	}
+
+	batch := make(bson.A, len(docs))
+	for i, doc := range docs {
+		batch[i] = bson.Raw(doc)
+	}
+
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: batchField, Value: batch},
+			{Key: "id", Value: id},
+			{Key: "ns", Value: sc.ns},
+		}},
+	}, nil
+}
+
+func cmdKillCursors(ctx context.Context, cmd *Command) (bson.D, error) {
+	ids, ok := cmd.Doc.Lookup("cursors").ArrayOK()
+	if !ok {
+		return nil, Errorf(ErrorCodeFailedToParse, "killCursors requires a cursors array")
+	}
+
+	values, err := ids.Values()
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail before killing any cursor if one was opened by another principal
+	cursorIDs := make([]int64, len(values))
+	for i, v := range values {
+		id, ok := asInt64(v)
+		if !ok {
+			return nil, Errorf(ErrorCodeFailedToParse, "cursor ids must be integers")
+		}
+		if sc, ok := cmd.client.server.getCursor(id); ok {
+			if err := cmd.client.checkCursorOwner(sc); err != nil {
+				return nil, err
+			}
+		}
+		cursorIDs[i] = id
+	}
+
+	killed := bson.A{}
+	notFound := bson.A{}
+	for _, id := range cursorIDs {
+		found, err := cmd.client.killCursor(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			killed = append(killed, id)
+		} else {
+			notFound = append(notFound, id)
+		}
+	}
+
+	return bson.D{
+		{Key: "cursorsKilled", Value: killed},
+		{Key: "cursorsNotFound", Value: notFound},
+		{Key: "cursorsAlive", Value: bson.A{}},
+		{Key: "cursorsUnknown", Value: bson.A{}},
+	}, nil
+}
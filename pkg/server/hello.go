@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func init() {
+	builtinCommands["isMaster"] = cmdIsMaster
+	builtinCommands["ismaster"] = cmdIsMaster
+	builtinCommands["hello"] = cmdHello
+}
+
+// Defaults of the handshake fields configurable with HelloOptions
+const (
+	DefaultMaxWireVersion               = 6
+	DefaultLogicalSessionTimeoutMinutes = 30
+)
+
+// Topology is the kind of server a Server presents itself as.
+type Topology int
+
+// The topologies a Server can present
+const (
+	TopologyStandalone Topology = iota
+	TopologyReplicaSetPrimary
+	TopologyReplicaSetSecondary
+	TopologyMongos
+)
+
+func (t Topology) String() string {
+	switch t {
+	case TopologyStandalone:
+		return "Standalone"
+	case TopologyReplicaSetPrimary:
+		return "RSPrimary"
+	case TopologyReplicaSetSecondary:
+		return "RSSecondary"
+	case TopologyMongos:
+		return "Mongos"
+	default:
+		return fmt.Sprintf("Topology(%d)", int(t))
+	}
+}
+
+// HelloOptions configures the reply to the hello and isMaster commands, which
+// drivers use to select the type of the server.
+type HelloOptions struct {
+	Topology Topology
+
+	// SetName, Hosts, Primary and Me describe the replica set of a replica
+	// set member. Hosts and Primary are "host:port" addresses.
+	SetName    string
+	SetVersion int32
+	Hosts      []string
+	Primary    string
+	Me         string
+
+	// ElectionID identifies the term of a replica set primary. Drivers
+	// ignore primaries reporting an older election than one already seen.
+	ElectionID primitive.ObjectID
+
+	// MaxWireVersion is the highest wire protocol version supported. When
+	// zero, DefaultMaxWireVersion is used.
+	MaxWireVersion int32
+
+	// LogicalSessionTimeoutMinutes enables sessions, and with them retryable
+	// reads and writes. When zero, DefaultLogicalSessionTimeoutMinutes is
+	// used; a negative value disables sessions.
+	LogicalSessionTimeoutMinutes int32
+
+	// SASLSupportedMechs lists the authentication mechanisms reported to
+	// clients asking for the mechanisms of a user.
+	SASLSupportedMechs []string
+}
+
+// writable tells if the server accepts writes.
+func (opts *HelloOptions) writable() bool {
+	return opts.Topology != TopologyReplicaSetSecondary
+}
+
+// topologyVersion identifies a state of the topology for awaitable hello
+// commands.
+type topologyVersion struct {
+	ProcessID primitive.ObjectID `bson:"processId"`
+	Counter   int64              `bson:"counter"`
+}
+
+// SetHello changes the handshake options of the server. Clients waiting in
+// an awaitable hello are notified of the change.
+func (s *Server) SetHello(opts HelloOptions) {
+	s.init()
+
+	s.helloMu.Lock()
+	defer s.helloMu.Unlock()
+	s.Hello = opts
+	s.topologyVersion.Counter++
+	close(s.topologyChanged)
+	s.topologyChanged = make(chan struct{})
+}
+
+// hello returns the handshake options, the current topology version and a
+// channel that is closed when they change.
+func (s *Server) hello() (HelloOptions, topologyVersion, <-chan struct{}) {
+	s.helloMu.RLock()
+	defer s.helloMu.RUnlock()
+	return s.Hello, s.topologyVersion, s.topologyChanged
+}
+
+type helloCommand struct {
+	TopologyVersion    *topologyVersion `bson:"topologyVersion"`
+	MaxAwaitTimeMS     int64            `bson:"maxAwaitTimeMS"`
+	SASLSupportedMechs string           `bson:"saslSupportedMechs"`
+
+	SpeculativeAuthenticate bson.Raw `bson:"speculativeAuthenticate"`
+}
+
+// awaitTopologyChange waits for the topology to change or the server to shut
+// down when the client sent an awaitable hello with the current topology
+// version. It returns the options to reply with.
+func (s *Server) awaitTopologyChange(ctx context.Context, args *helloCommand) (HelloOptions, topologyVersion) {
+	opts, version, changed := s.hello()
+	if args.TopologyVersion == nil || args.MaxAwaitTimeMS <= 0 || *args.TopologyVersion != version {
+		return opts, version
+	}
+
+	timer := time.NewTimer(time.Duration(args.MaxAwaitTimeMS) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-s.shutdown:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	opts, version, _ = s.hello()
+	return opts, version
+}
+
+// handshakeReply builds the reply of hello and isMaster. primaryKey is the
+// field reporting whether the server is writable.
+func handshakeReply(ctx context.Context, cmd *Command, primaryKey string) (bson.D, error) {
+	var args helloCommand
+	if err := bson.Unmarshal(cmd.Doc, &args); err != nil {
+		return nil, &Error{Code: ErrorCodeFailedToParse, Message: err.Error()}
+	}
+
+	s := cmd.client.server
+	opts, version := s.awaitTopologyChange(ctx, &args)
+
+	reply := bson.D{{Key: primaryKey, Value: opts.writable()}}
+	switch opts.Topology {
+	case TopologyReplicaSetPrimary, TopologyReplicaSetSecondary:
+		reply = append(reply,
+			bson.E{Key: "secondary", Value: opts.Topology == TopologyReplicaSetSecondary},
+			bson.E{Key: "setName", Value: opts.SetName},
+			bson.E{Key: "setVersion", Value: opts.SetVersion},
+			bson.E{Key: "hosts", Value: opts.Hosts},
+		)
+		if opts.Primary != "" {
+			reply = append(reply, bson.E{Key: "primary", Value: opts.Primary})
+		}
+		if opts.Me != "" {
+			reply = append(reply, bson.E{Key: "me", Value: opts.Me})
+		}
+		if opts.Topology == TopologyReplicaSetPrimary && !opts.ElectionID.IsZero() {
+			reply = append(reply, bson.E{Key: "electionId", Value: opts.ElectionID})
+		}
+	case TopologyMongos:
+		reply = append(reply, bson.E{Key: "msg", Value: "isdbgrid"})
+	}
+
+	maxWireVersion := opts.MaxWireVersion
+	if maxWireVersion == 0 {
+		maxWireVersion = DefaultMaxWireVersion
+	}
+
+	reply = append(reply,
+		bson.E{Key: "topologyVersion", Value: version},
+		bson.E{Key: "maxBsonObjectSize", Value: int32(16 * 1024 * 1024)},
+		bson.E{Key: "maxMessageSizeBytes", Value: s.maxMessageSize()},
+		bson.E{Key: "maxWriteBatchSize", Value: int32(maxWriteBatchSize)},
+		bson.E{Key: "localTime", Value: primitive.NewDateTimeFromTime(time.Now())},
+	)
+	switch timeout := opts.LogicalSessionTimeoutMinutes; {
+	case timeout == 0:
+		reply = append(reply, bson.E{Key: "logicalSessionTimeoutMinutes", Value: int32(DefaultLogicalSessionTimeoutMinutes)})
+	case timeout > 0:
+		reply = append(reply, bson.E{Key: "logicalSessionTimeoutMinutes", Value: timeout})
+	}
+	reply = append(reply,
+		bson.E{Key: "connectionId", Value: cmd.client.id},
+		bson.E{Key: "minWireVersion", Value: int32(0)},
+		bson.E{Key: "maxWireVersion", Value: maxWireVersion},
+		bson.E{Key: "readOnly", Value: s.readOnly()},
+	)
+
+	if requested, err := cmd.Doc.LookupErr("compression"); err == nil {
+		reply = append(reply, bson.E{Key: "compression", Value: s.negotiateCompressors(requested)})
+	}
+	if args.SASLSupportedMechs != "" {
+		supported := opts.SASLSupportedMechs
+		if s.authRequired() {
+			supported = s.supportedMechanisms(ctx, args.SASLSupportedMechs)
+		}
+
+		mechs := bson.A{}
+		for _, mech := range supported {
+			mechs = append(mechs, mech)
+		}
+		reply = append(reply, bson.E{Key: "saslSupportedMechs", Value: mechs})
+	}
+	if args.SpeculativeAuthenticate != nil {
+		if auth, ok := cmd.client.speculativeAuthenticate(ctx, args.SpeculativeAuthenticate); ok {
+			reply = append(reply, bson.E{Key: "speculativeAuthenticate", Value: auth})
+		}
+	}
+
+	return reply, nil
+}
+
+func cmdIsMaster(ctx context.Context, cmd *Command) (bson.D, error) {
+	return handshakeReply(ctx, cmd, "ismaster")
+}
+
+func cmdHello(ctx context.Context, cmd *Command) (bson.D, error) {
+	return handshakeReply(ctx, cmd, "isWritablePrimary")
+}
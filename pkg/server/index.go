@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func init() {
+	builtinCommands["createIndexes"] = cmdCreateIndexes
+	builtinCommands["dropIndexes"] = cmdDropIndexes
+	builtinCommands["listIndexes"] = cmdListIndexes
+}
+
+// IndexModel describes an index of a collection.
+type IndexModel struct {
+	Name   string `bson:"name"`
+	Key    bson.D `bson:"key"` // fields and their directions, 1 or -1
+	Unique bool   `bson:"unique,omitempty"`
+	Sparse bool   `bson:"sparse,omitempty"`
+}
+
+// CreateIndexesRequest describes a createIndexes command. Indexes without a
+// name are named after their key, e.g. "a_1_b_-1".
+type CreateIndexesRequest struct {
+	Database   string
+	Collection string
+	Indexes    []IndexModel
+}
+
+// Namespace returns the "dbname.collectionname" namespace of the request.
+func (req *CreateIndexesRequest) Namespace() string {
+	return req.Database + "." + req.Collection
+}
+
+// DropIndexesRequest describes a dropIndexes command. Names lists the
+// indexes to drop by name, and Key identifies a single index by its key.
+// Both are empty when all the indexes are dropped.
+type DropIndexesRequest struct {
+	Database   string
+	Collection string
+	Names      []string
+	Key        bson.D
+}
+
+// Namespace returns the "dbname.collectionname" namespace of the request.
+func (req *DropIndexesRequest) Namespace() string {
+	return req.Database + "." + req.Collection
+}
+
+// ListIndexesRequest describes a listIndexes command.
+type ListIndexesRequest struct {
+	Database   string
+	Collection string
+}
+
+// Namespace returns the "dbname.collectionname" namespace of the request.
+func (req *ListIndexesRequest) Namespace() string {
+	return req.Database + "." + req.Collection
+}
+
+// IndexesResult is the outcome of creating or dropping indexes.
+type IndexesResult struct {
+	NumIndexesBefore int32
+	NumIndexesAfter  int32
+}
+
+// CreateIndexesHandler, DropIndexesHandler and ListIndexesHandler manage the
+// indexes of collections.
+type (
+	CreateIndexesHandler func(ctx context.Context, req *CreateIndexesRequest) (*IndexesResult, error)
+	DropIndexesHandler   func(ctx context.Context, req *DropIndexesRequest) (*IndexesResult, error)
+	ListIndexesHandler   func(ctx context.Context, req *ListIndexesRequest) ([]IndexModel, error)
+)
+
+// IndexName returns the default name of an index with key, its fields and
+// directions joined with underscores.
+func IndexName(key bson.D) string {
+	parts := make([]string, 0, 2*len(key))
+	for _, e := range key {
+		parts = append(parts, e.Key, fmt.Sprint(e.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+type createIndexesCommand struct {
+	Indexes []IndexModel `bson:"indexes"`
+}
+
+func cmdCreateIndexes(ctx context.Context, cmd *Command) (bson.D, error) {
+	if err := cmd.client.server.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	handler := cmd.client.server.CreateIndexesHandler
+	if handler == nil {
+		return nil, errWriteNotSupported(cmd.Name)
+	}
+
+	var args createIndexesCommand
+	collection, err := parseWriteCommand(cmd, &args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args.Indexes) == 0 {
+		return nil, Errorf(ErrorCodeBadValue, "Must specify at least one index to create")
+	}
+	for i := range args.Indexes {
+		if len(args.Indexes[i].Key) == 0 {
+			return nil, Errorf(ErrorCodeCannotCreateIndex, "index %d has no key", i)
+		}
+		if args.Indexes[i].Name == "" {
+			args.Indexes[i].Name = IndexName(args.Indexes[i].Key)
+		}
+	}
+
+	res, err := handler(ctx, &CreateIndexesRequest{
+		Database:   cmd.Database,
+		Collection: collection,
+		Indexes:    args.Indexes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		res = &IndexesResult{}
+	}
+
+	return bson.D{
+		{Key: "createdCollectionAutomatically", Value: false},
+		{Key: "numIndexesBefore", Value: res.NumIndexesBefore},
+		{Key: "numIndexesAfter", Value: res.NumIndexesAfter},
+	}, nil
+}
+
+func cmdDropIndexes(ctx context.Context, cmd *Command) (bson.D, error) {
+	if err := cmd.client.server.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	handler := cmd.client.server.DropIndexesHandler
+	if handler == nil {
+		return nil, errWriteNotSupported(cmd.Name)
+	}
+
+	collection, ok := cmd.Argument().StringValueOK()
+	if !ok {
+		return nil, Errorf(ErrorCodeInvalidNamespace, "collection name has invalid type")
+	}
+
+	req := &DropIndexesRequest{Database: cmd.Database, Collection: collection}
+	index, err := cmd.Doc.LookupErr("index")
+	if err != nil {
+		return nil, Errorf(ErrorCodeFailedToParse, "dropIndexes requires an index")
+	}
+	switch {
+	case index.Type == bson.TypeString:
+		if name := index.StringValue(); name != "*" {
+			req.Names = []string{name}
+		}
+	case index.Type == bson.TypeArray:
+		if err := index.Unmarshal(&req.Names); err != nil {
+			return nil, Errorf(ErrorCodeFailedToParse, "index names must be strings")
+		}
+	case index.Type == bson.TypeEmbeddedDocument:
+		if err := index.Unmarshal(&req.Key); err != nil {
+			return nil, &Error{Code: ErrorCodeFailedToParse, Message: err.Error()}
+		}
+	default:
+		return nil, Errorf(ErrorCodeTypeMismatch, "index has invalid type %s", index.Type)
+	}
+
+	res, err := handler(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		res = &IndexesResult{}
+	}
+	return bson.D{{Key: "nIndexesWas", Value: res.NumIndexesBefore}}, nil
+}
+
+func cmdListIndexes(ctx context.Context, cmd *Command) (bson.D, error) {
+	handler := cmd.client.server.ListIndexesHandler
+	if handler == nil {
+		return nil, errWriteNotSupported(cmd.Name)
+	}
+
+	collection, ok := cmd.Argument().StringValueOK()
+	if !ok {
+		return nil, Errorf(ErrorCodeInvalidNamespace, "collection name has invalid type")
+	}
+
+	req := &ListIndexesRequest{Database: cmd.Database, Collection: collection}
+	indexes, err := handler(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := make(bson.A, len(indexes))
+	for i, index := range indexes {
+		batch[i] = index
+	}
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "firstBatch", Value: batch},
+			{Key: "id", Value: int64(0)},
+			{Key: "ns", Value: req.Namespace()},
+		}},
+	}, nil
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ReplicaSet runs several Servers posing as the members of a replica set with
+// a single primary. The members share a cursor store, and secondaries reject
+// writes with NotWritablePrimary. It is meant for exercising driver failover
+// and read preferences against handlers in tests.
+type ReplicaSet struct {
+	Name    string
+	Members []*Server
+
+	// CursorTimeout is the time after which idle cursors of any member are
+	// closed. When zero, DefaultCursorTimeout is used. The CursorTimeout of
+	// the members is not used.
+	CursorTimeout time.Duration
+
+	cursors    *cursorStore
+	stopReaper context.CancelFunc
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	hosts     []string
+	primary   int
+}
+
+// NewReplicaSet returns a replica set named name with n members. configure
+// is called with each member to set its handlers before the member starts.
+func NewReplicaSet(name string, n int, configure func(s *Server)) *ReplicaSet {
+	rs := &ReplicaSet{Name: name, primary: -1, cursors: newCursorStore()}
+
+	for i := 0; i < n; i++ {
+		s := &Server{cursors: rs.cursors}
+		if configure != nil {
+			configure(s)
+		}
+		s.RegisterCommand("replSetStepDown", rs.cmdStepDown)
+		rs.Members = append(rs.Members, s)
+	}
+	return rs
+}
+
+// Start listens on addrs, one address per member, and elects the first
+// member. When no addresses are given, members listen on random ports of the
+// loopback interface.
+func (rs *ReplicaSet) Start(addrs ...string) error {
+	if len(addrs) == 0 {
+		for range rs.Members {
+			addrs = append(addrs, "127.0.0.1:0")
+		}
+	}
+	if len(addrs) != len(rs.Members) {
+		return fmt.Errorf("server: replica set has %d members, got %d addresses", len(rs.Members), len(addrs))
+	}
+
+	rs.mu.Lock()
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			rs.mu.Unlock()
+			rs.Close()
+			return err
+		}
+		rs.listeners = append(rs.listeners, ln)
+		rs.hosts = append(rs.hosts, ln.Addr().String())
+	}
+	rs.mu.Unlock()
+
+	if err := rs.Elect(0); err != nil {
+		return err
+	}
+
+	timeout := rs.CursorTimeout
+	if timeout <= 0 {
+		timeout = DefaultCursorTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rs.mu.Lock()
+	rs.stopReaper = cancel
+	rs.mu.Unlock()
+	go rs.cursors.reap(ctx, timeout)
+
+	for i, s := range rs.Members {
+		go func(s *Server, ln net.Listener) {
+			if err := s.Listen(ln); err != nil && err != ErrServerClosed {
+				s.logf("server: replica set member %s: %v", ln.Addr(), err)
+			}
+		}(s, rs.listeners[i])
+	}
+	return nil
+}
+
+// Hosts returns the "host:port" addresses of the members.
+func (rs *ReplicaSet) Hosts() []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return append([]string{}, rs.hosts...)
+}
+
+// URI returns a connection string for the replica set.
+func (rs *ReplicaSet) URI() string {
+	return "mongodb://" + strings.Join(rs.Hosts(), ",") + "/?replicaSet=" + rs.Name
+}
+
+// Primary returns the index of the primary in Members.
+func (rs *ReplicaSet) Primary() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.primary
+}
+
+// Elect makes the member at index i the primary and the other members
+// secondaries.
+func (rs *ReplicaSet) Elect(i int) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if i < 0 || i >= len(rs.Members) {
+		return fmt.Errorf("server: replica set has no member %d", i)
+	}
+	if len(rs.hosts) != len(rs.Members) {
+		return fmt.Errorf("server: replica set has not been started")
+	}
+
+	rs.primary = i
+	electionID := primitive.NewObjectID()
+	for j, s := range rs.Members {
+		opts, _, _ := s.hello()
+		opts.Topology = TopologyReplicaSetSecondary
+		if j == i {
+			opts.Topology = TopologyReplicaSetPrimary
+		}
+		opts.SetName = rs.Name
+		opts.SetVersion = 1
+		opts.Hosts = rs.hosts
+		opts.Primary = rs.hosts[i]
+		opts.Me = rs.hosts[j]
+		opts.ElectionID = electionID
+		s.SetHello(opts)
+	}
+	return nil
+}
+
+// StepDown makes the primary step down and elects the next member.
+func (rs *ReplicaSet) StepDown() error {
+	primary := rs.Primary()
+	if primary < 0 {
+		return fmt.Errorf("server: replica set has no primary")
+	}
+	return rs.Elect((primary + 1) % len(rs.Members))
+}
+
+// Close closes all members.
+func (rs *ReplicaSet) Close() error {
+	var err error
+	for _, s := range rs.Members {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	// Members that were never started don't own their listeners yet
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.stopReaper != nil {
+		rs.stopReaper()
+	}
+	for _, ln := range rs.listeners {
+		ln.Close()
+	}
+	return err
+}
+
+func (rs *ReplicaSet) cmdStepDown(ctx context.Context, cmd *Command) (bson.D, error) {
+	primary := rs.Primary()
+	if primary < 0 || rs.Members[primary] != cmd.client.server {
+		return nil, Errorf(ErrorCodeNotWritablePrimary, "not primary so can't step down")
+	}
+	return bson.D{}, rs.StepDown()
+}
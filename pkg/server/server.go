@@ -2,80 +2,193 @@ package server
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/orktes/mongache/pkg/mongoproto"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-type Cursor interface {
-	Next(ctx context.Context) (interface{}, error)
-	Skip(ctx context.Context, n int32) error
-	Position(ctx context.Context) (int32, error)
-	Close(ctx context.Context) error
-}
+// ErrServerClosed is returned by ListenAddr and Listen after a call to
+// Shutdown or Close.
+var ErrServerClosed = errors.New("server: Server closed")
+
+// shutdownPollInterval is how often Shutdown checks for idle connections.
+const shutdownPollInterval = 50 * time.Millisecond
 
-type QueryHandler func(collection string, q bson.M, fields bson.M) (Cursor, error)
+// QueryHandler answers queries on the "dbname.collectionname" namespace
+// collection. The sort of a query is not passed to it and is ignored. ctx is
+// cancelled when the request completes, the client disconnects or the server
+// shuts down.
+type QueryHandler func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error)
 
 type Server struct {
-	ln  net.Listener
-	ctx context.Context
+	initOnce sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	clients    map[*client]struct{}
+	inShutdown bool
+	shutdown   chan struct{} // closed when the server starts shutting down
+
+	cursors *cursorStore
+
+	commandsMutex sync.RWMutex
+	commands      map[string]CommandFunc
 
-	cursorsMutex    sync.RWMutex
-	cursorIDCounter int64
-	cursors         map[int64]Cursor
+	connectionIDCounter int32
+
+	helloMu         sync.RWMutex
+	topologyVersion topologyVersion
+	topologyChanged chan struct{}
 
 	Handler QueryHandler
+	// FindHandler answers queries. When nil, Handler is used.
+	FindHandler FindHandler
+	// AggregateHandler runs aggregation pipelines. The aggregate command
+	// fails with CommandNotSupported when it is not set.
+	AggregateHandler AggregateHandler
+
+	// Hello configures the reply to the hello and isMaster commands. Use
+	// SetHello to change it while the server is running.
+	Hello HelloOptions
+
+	// InsertHandler, UpdateHandler and DeleteHandler apply writes. The server
+	// reports itself as read-only when none is set, and write commands fail
+	// with CommandNotSupported when their handler is not set.
+	InsertHandler InsertHandler
+	UpdateHandler UpdateHandler
+	DeleteHandler DeleteHandler
+
+	// CreateIndexesHandler, DropIndexesHandler and ListIndexesHandler manage
+	// the indexes of collections. The index commands fail with
+	// CommandNotSupported when their handler is not set.
+	CreateIndexesHandler CreateIndexesHandler
+	DropIndexesHandler   DropIndexesHandler
+	ListIndexesHandler   ListIndexesHandler
+
+	// CursorTimeout is the time after which idle cursors are closed. When
+	// zero, DefaultCursorTimeout is used. The members of a ReplicaSet use
+	// ReplicaSet.CursorTimeout instead.
+	CursorTimeout time.Duration
+
+	// MaxMessageSizeBytes is the largest message accepted from clients,
+	// after decompression. Connections sending larger or malformed messages
+	// are closed. When zero, mongoproto.DefaultMaxMessageSize is used.
+	MaxMessageSizeBytes int32
+
+	// Compressors lists the wire protocol compressors ("snappy", "zlib" and
+	// "zstd") clients may negotiate. Compression is disabled when empty.
+	Compressors []string
+
+	// Credentials enables authentication with SCRAM-SHA-1 and SCRAM-SHA-256.
+	// When set, clients must authenticate before running commands other
+	// than the handshake, and handlers find the user with UserFromContext.
+	Credentials CredentialStore
+
+	// TLSConfig enables TLS on the listeners opened by ListenAddr. Clients
+	// presenting a certificate verified against TLSConfig.ClientCAs can
+	// authenticate with MONGODB-X509 as the user of the "$external"
+	// database named after the subject of the certificate.
+	TLSConfig *tls.Config
+
+	// Authorizer, when set, is consulted before running queries, getMores,
+	// killCursors, legacy writes and commands. The commands of the handshake
+	// and of authentication, such as hello and saslStart, are not
+	// authorized.
+	Authorizer Authorizer
+
+	// ErrorLog logs errors processing and closing connections. When nil,
+	// the standard logger of the log package is used.
+	ErrorLog *log.Logger
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
 }
 
 func (s *Server) ListenAddr(addr string) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+
+	var config *tls.Config
+	if s.TLSConfig != nil {
+		var err error
+		if config, err = s.tlsConfig("", ""); err != nil {
+			return err
+		}
+	}
+
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
 
 	return s.Listen(ln)
 }
 
 func (s *Server) init() {
-	s.cursors = map[int64]Cursor{}
-	s.ctx = context.Background()
+	s.initOnce.Do(func() {
+		s.listeners = map[net.Listener]struct{}{}
+		s.clients = map[*client]struct{}{}
+		s.shutdown = make(chan struct{})
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		s.topologyVersion = topologyVersion{ProcessID: primitive.NewObjectID()}
+		s.topologyChanged = make(chan struct{})
+
+		// The members of a ReplicaSet share the store and its reaper
+		if s.cursors == nil {
+			s.cursors = newCursorStore()
+			go s.cursors.reap(s.ctx, s.cursorTimeout())
+		}
+	})
 }
 
 func (s *Server) Listen(ln net.Listener) error {
-	s.ln = ln
 	s.init()
 
-	return s.listen()
-}
-
-func (s *Server) storeCursor(c Cursor) int64 {
-	id := atomic.AddInt64(&s.cursorIDCounter, 1)
-	s.cursorsMutex.Lock()
-	defer s.cursorsMutex.Unlock()
-	s.cursors[id] = c
-	return id
-}
+	s.mu.Lock()
+	if s.inShutdown {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
 
-func (s *Server) removeCursor(id int64) {
-	s.cursorsMutex.RLock()
-	defer s.cursorsMutex.RUnlock()
-	delete(s.cursors, id)
-}
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+	}()
 
-func (s *Server) getCursor(id int64) (Cursor, bool) {
-	s.cursorsMutex.RLock()
-	defer s.cursorsMutex.RUnlock()
-	c, ok := s.cursors[id]
-	return c, ok
+	return s.listen(ln)
 }
 
-func (s *Server) listen() error {
+func (s *Server) listen(ln net.Listener) error {
 	for {
-		conn, err := s.ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
@@ -83,16 +196,130 @@ func (s *Server) listen() error {
 	}
 }
 
+// maxMessageSize returns the largest message accepted from clients.
+func (s *Server) maxMessageSize() int32 {
+	if s.MaxMessageSizeBytes > 0 {
+		return s.MaxMessageSizeBytes
+	}
+	return mongoproto.DefaultMaxMessageSize
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting connections,
+// waits for in-flight requests to finish and then closes all connections and
+// cursors. If ctx expires first, the contexts of in-flight requests are
+// cancelled and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.init()
+
+	err := s.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !s.closeIdleClients() {
+		select {
+		case <-ctx.Done():
+			s.cancel()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	s.cancel()
+	if cerr := s.closeCursors(ctx, s.ownsCursor); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Close immediately closes all listeners, connections and cursors and
+// cancels the contexts of in-flight requests. Use Shutdown to wait for
+// in-flight requests to finish.
+func (s *Server) Close() error {
+	s.init()
+
+	err := s.closeListeners()
+	s.cancel()
+
+	s.mu.Lock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+
+	if cerr := s.closeCursors(context.Background(), s.ownsCursor); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ownsCursor tells if a cursor was opened on a connection to the server.
+func (s *Server) ownsCursor(c *serverCursor) bool {
+	return c.owner.server == s
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.inShutdown {
+		s.inShutdown = true
+		close(s.shutdown)
+	}
+
+	var err error
+	for ln := range s.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeIdleClients closes the connections that are not processing a request
+// and reports whether all connections have been closed.
+func (s *Server) closeIdleClients() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.closeIfIdle()
+	}
+	return len(s.clients) == 0
+}
+
 func (s *Server) handleConn(conn net.Conn) {
-	cli := &client{conn: conn, server: s}
+	s.init()
+
+	cli := &client{
+		id:     atomic.AddInt32(&s.connectionIDCounter, 1),
+		conn:   conn,
+		server: s,
+	}
+
+	s.mu.Lock()
+	if s.inShutdown {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.clients[cli] = struct{}{}
+	s.mu.Unlock()
+
 	defer func() {
-		err := cli.close(s.ctx)
-		if err != nil {
-			panic(err)
+		if err := cli.close(s.ctx); err != nil {
+			s.logf("server: closing connection %d: %v", cli.id, err)
 		}
+
+		s.mu.Lock()
+		delete(s.clients, cli)
+		s.mu.Unlock()
 	}()
 
-	if err := cli.process(s.ctx); err != nil {
-		fmt.Printf("Err: %s\n", err.Error())
+	if err := cli.process(s.ctx); err != nil && err != io.EOF && !s.shuttingDown() {
+		s.logf("server: connection %d: %v", cli.id, err)
 	}
 }
@@ -1,11 +1,30 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/orktes/mongache/pkg/mongoproto"
 	"github.com/orktes/mongache/pkg/slice"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
@@ -30,7 +49,7 @@ func TestServerPing(t *testing.T) {
 
 func TestServerReadOne(t *testing.T) {
 	s := &Server{
-		Handler: func(collection string, q bson.M, fields bson.M) (Cursor, error) {
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
 			assert.Equal(t, "foo.test", collection)
 			assert.Equal(t, bson.M{"test": true}, q)
 			return slice.NewCursor([]map[string]interface{}{
@@ -68,7 +87,7 @@ func TestServerReadCursorAll(t *testing.T) {
 	}
 
 	s := &Server{
-		Handler: func(collection string, q bson.M, fields bson.M) (Cursor, error) {
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
 			assert.Equal(t, bson.M{}, q)
 
 			return slice.NewCursor(data)
@@ -101,7 +120,7 @@ func TestServerReadCursorAllWithBatchSize(t *testing.T) {
 	}
 
 	s := &Server{
-		Handler: func(collection string, q bson.M, fields bson.M) (Cursor, error) {
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
 			assert.Equal(t, bson.M{}, q)
 
 			return slice.NewCursor(data)
@@ -135,7 +154,7 @@ func TestServerReadCursorLimit(t *testing.T) {
 	}
 
 	s := &Server{
-		Handler: func(collection string, q bson.M, fields bson.M) (Cursor, error) {
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
 			return slice.NewCursor(data)
 		},
 	}
@@ -166,7 +185,7 @@ func TestServerReadCursorSkip(t *testing.T) {
 	}
 
 	s := &Server{
-		Handler: func(collection string, q bson.M, fields bson.M) (Cursor, error) {
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
 			assert.Equal(t, bson.M{}, q)
 
 			return slice.NewCursor(data)
@@ -191,12 +210,1565 @@ func TestServerReadCursorSkip(t *testing.T) {
 	assert.Equal(t, data[10:], result)
 }
 
+func TestServerCommands(t *testing.T) {
+	s := &Server{}
+	s.RegisterCommand("echo", func(ctx context.Context, cmd *Command) (bson.D, error) {
+		assert.Equal(t, "foo", cmd.Database)
+		return bson.D{{Key: "echo", Value: cmd.Argument().StringValue()}}, nil
+	})
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	var res bson.M
+	assert.NoError(t, cli.Database("foo").RunCommand(ctx, bson.D{{Key: "echo", Value: "hello"}}).Decode(&res))
+	assert.Equal(t, bson.M{"echo": "hello", "ok": 1.0}, res)
+
+	assert.NoError(t, cli.Database("admin").RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&res))
+	assert.NotEmpty(t, res["version"])
+
+	err = cli.Database("foo").RunCommand(ctx, bson.D{{Key: "noSuchCommand", Value: 1}}).Err()
+	if assert.Error(t, err) {
+		cmdErr, ok := err.(mongo.CommandError)
+		assert.True(t, ok)
+		assert.Equal(t, int32(59), cmdErr.Code)
+		assert.Equal(t, "CommandNotFound", cmdErr.Name)
+	}
+}
+
+func TestServerKillCursors(t *testing.T) {
+	data := make([]map[string]interface{}, 3000)
+	for i := 0; i < 3000; i++ {
+		data[i] = map[string]interface{}{
+			"foo": fmt.Sprintf("bar_%d", i),
+		}
+	}
+
+	s := &Server{
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
+			return slice.NewCursor(data)
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	batchSize := int32(50)
+	cur, err := cli.Database("foo").Collection("test").Find(ctx, bson.M{}, &options.FindOptions{BatchSize: &batchSize})
+	assert.NoError(t, err)
+
+	for i := 0; i < 60; i++ {
+		assert.True(t, cur.Next(ctx))
+	}
+	assert.Equal(t, 1, cursorCount(s))
+
+	err = cli.Database("foo").RunCommand(ctx, bson.D{{Key: "getMore", Value: cur.ID()}, {Key: "collection", Value: "other"}}).Err()
+	cmdErr, ok := err.(mongo.CommandError)
+	if assert.True(t, ok, "unexpected error %v", err) {
+		assert.Equal(t, int32(ErrorCodeUnauthorized), cmdErr.Code)
+	}
+
+	assert.NoError(t, cur.Close(ctx))
+	assert.Equal(t, 0, cursorCount(s))
+}
+
+func TestServerFindHandler(t *testing.T) {
+	s := &Server{
+		FindHandler: func(ctx context.Context, req *FindRequest) (Cursor, error) {
+			assert.Equal(t, "foo", req.Database)
+			assert.Equal(t, "test", req.Collection)
+			assert.Equal(t, bson.M{"test": true}, req.Filter)
+			assert.Equal(t, bson.M{"foo": int32(1)}, req.Projection)
+			assert.Equal(t, bson.D{{Key: "foo", Value: int32(-1)}}, req.Sort)
+			assert.Equal(t, int32(5), req.Skip)
+			assert.Equal(t, int32(2), req.Limit)
+			assert.Equal(t, "idx", req.Hint)
+			assert.Equal(t, "hello", req.Comment)
+			return slice.NewCursor([]map[string]interface{}{
+				{"foo": "a"}, {"foo": "b"}, {"foo": "c"},
+			})
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	opts := options.Find().
+		SetProjection(bson.M{"foo": 1}).
+		SetSort(bson.D{{Key: "foo", Value: -1}}).
+		SetSkip(5).
+		SetLimit(2).
+		SetHint("idx").
+		SetComment("hello")
+	cur, err := cli.Database("foo").Collection("test").Find(ctx, bson.M{"test": true}, opts)
+	assert.NoError(t, err)
+
+	var result []map[string]interface{}
+	assert.NoError(t, cur.All(ctx, &result))
+	assert.Equal(t, []map[string]interface{}{{"foo": "a"}, {"foo": "b"}}, result)
+}
+
+func TestServerNoFindHandler(t *testing.T) {
+	s := &Server{}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	err = cli.Database("foo").Collection("test").FindOne(ctx, bson.M{}).Err()
+	if cmdErr, ok := err.(mongo.CommandError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, int32(ErrorCodeCommandNotSupported), cmdErr.Code)
+	}
+}
+
+func TestFindRequestFromLegacyQuery(t *testing.T) {
+	query, _ := bson.Marshal(bson.D{
+		{Key: "$query", Value: bson.D{{Key: "a", Value: int32(1)}}},
+		{Key: "$orderby", Value: bson.D{{Key: "b", Value: int32(1)}, {Key: "a", Value: int32(-1)}}},
+		{Key: "$comment", Value: "hi"},
+	})
+
+	req, err := findRequestFromQuery(&mongoproto.OpQuery{
+		FullCollectionName: "foo.bar.baz",
+		NumberToSkip:       3,
+		NumberToReturn:     -10,
+		Flags:              mongoproto.OpQueryNoCursorTimeout,
+		Query:              query,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &FindRequest{
+		Database:   "foo",
+		Collection: "bar.baz",
+		Filter:     bson.M{"a": int32(1)},
+		Sort:       bson.D{{Key: "b", Value: int32(1)}, {Key: "a", Value: int32(-1)}},
+		Skip:       3,
+		Limit:      10,
+		BatchSize:  10,
+		Comment:    "hi",
+		Flags:      mongoproto.OpQueryNoCursorTimeout,
+	}, req)
+}
+
+func TestServerHandlerError(t *testing.T) {
+	s := &Server{
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
+			return nil, Errorf(ErrorCodeNamespaceNotFound, "%s does not exist", collection)
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	for i := 0; i < 2; i++ {
+		_, err = cli.Database("foo").Collection("test").Find(ctx, bson.M{})
+		if assert.Error(t, err) {
+			cmdErr, ok := err.(mongo.CommandError)
+			assert.True(t, ok)
+			assert.Equal(t, int32(26), cmdErr.Code)
+			assert.Equal(t, "NamespaceNotFound", cmdErr.Name)
+			assert.Equal(t, "foo.test does not exist", cmdErr.Message)
+		}
+	}
+}
+
+func TestServerLegacyQueryFailure(t *testing.T) {
+	s := &Server{
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
+			return nil, Errorf(ErrorCodeUnauthorized, "not allowed")
+		},
+	}
+	s.init()
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	query, _ := bson.Marshal(bson.M{})
+	c := &client{server: s, conn: a}
+	go func() {
+		assert.NoError(t, c.processQuery(context.Background(), &mongoproto.OpQuery{
+			Header:             mongoproto.MsgHeader{RequestID: 5},
+			FullCollectionName: "foo.test",
+			Query:              query,
+		}))
+	}()
+
+	op, err := mongoproto.OpFromReader(b)
+	assert.NoError(t, err)
+
+	reply := op.(*mongoproto.OpReply)
+	assert.Equal(t, int32(5), reply.Header.ResponseTo)
+	assert.Equal(t, mongoproto.OpReplyQueryFailure, reply.Flags)
+
+	var doc bson.M
+	assert.NoError(t, bson.Unmarshal(reply.Documents[0], &doc))
+	assert.Equal(t, bson.M{"$err": "not allowed", "code": int32(13)}, doc)
+}
+
+type failingCursor struct {
+	Cursor
+	failAfter int32
+	closed    bool
+}
+
+func (c *failingCursor) Next(ctx context.Context) (interface{}, error) {
+	pos, _ := c.Position(ctx)
+	if pos == c.failAfter {
+		return nil, Errorf(ErrorCodeOperationFailed, "backend failed")
+	}
+	return c.Cursor.Next(ctx)
+}
+
+func (c *failingCursor) Close(ctx context.Context) error {
+	c.closed = true
+	return c.Cursor.Close(ctx)
+}
+
+func TestServerCursorError(t *testing.T) {
+	data := make([]map[string]interface{}, 3000)
+	for i := 0; i < 3000; i++ {
+		data[i] = map[string]interface{}{
+			"foo": fmt.Sprintf("bar_%d", i),
+		}
+	}
+
+	var cursor *failingCursor
+	s := &Server{
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
+			cur, err := slice.NewCursor(data)
+			cursor = &failingCursor{Cursor: cur, failAfter: 120}
+			return cursor, err
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	batchSize := int32(50)
+	cur, err := cli.Database("foo").Collection("test").Find(ctx, bson.M{}, &options.FindOptions{BatchSize: &batchSize})
+	assert.NoError(t, err)
+
+	n := 0
+	for cur.Next(ctx) {
+		n++
+	}
+	assert.Equal(t, 100, n)
+
+	if assert.Error(t, cur.Err()) {
+		cmdErr, ok := cur.Err().(mongo.CommandError)
+		assert.True(t, ok)
+		assert.Equal(t, int32(96), cmdErr.Code)
+	}
+	assert.True(t, cursor.closed)
+	assert.Equal(t, 0, cursorCount(s))
+}
+
+func TestServerCursorTimeout(t *testing.T) {
+	data := make([]map[string]interface{}, 3000)
+	for i := 0; i < 3000; i++ {
+		data[i] = map[string]interface{}{
+			"foo": fmt.Sprintf("bar_%d", i),
+		}
+	}
+
+	s := &Server{
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
+			return slice.NewCursor(data)
+		},
+		CursorTimeout: 50 * time.Millisecond,
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	coll := cli.Database("foo").Collection("test")
+	expiring, err := coll.Find(ctx, bson.M{}, options.Find().SetBatchSize(10))
+	assert.NoError(t, err)
+	immortal, err := coll.Find(ctx, bson.M{}, options.Find().SetBatchSize(10).SetNoCursorTimeout(true))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, cursorCount(s))
+	assert.Eventually(t, func() bool { return cursorCount(s) == 1 }, time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 11; i++ {
+		expiring.Next(ctx)
+		assert.True(t, immortal.Next(ctx))
+	}
+	if assert.Error(t, expiring.Err()) {
+		assert.Equal(t, int32(43), expiring.Err().(mongo.CommandError).Code)
+	}
+}
+
+// blockingCursor blocks in Next until release is closed.
+type blockingCursor struct {
+	Cursor
+	reading chan struct{}
+	release chan struct{}
+	inNext  int32
+	raced   int32
+}
+
+func (c *blockingCursor) Next(ctx context.Context) (interface{}, error) {
+	atomic.StoreInt32(&c.inNext, 1)
+	defer atomic.StoreInt32(&c.inNext, 0)
+	close(c.reading)
+	<-c.release
+	return c.Cursor.Next(ctx)
+}
+
+func (c *blockingCursor) Close(ctx context.Context) error {
+	if atomic.LoadInt32(&c.inNext) == 1 {
+		atomic.StoreInt32(&c.raced, 1)
+	}
+	return c.Cursor.Close(ctx)
+}
+
+func TestServerReapCursorDuringBatch(t *testing.T) {
+	s := &Server{}
+	s.init()
+
+	ctx := context.Background()
+	cur, err := slice.NewCursor([]bson.M{{"n": 1}, {"n": 2}})
+	assert.NoError(t, err)
+	blocking := &blockingCursor{Cursor: cur, reading: make(chan struct{}), release: make(chan struct{})}
+	sc := &serverCursor{Cursor: blocking}
+	s.storeCursor(sc)
+
+	batch := make(chan error)
+	go func() {
+		_, _, err := sc.nextBatch(ctx, 1)
+		batch <- err
+	}()
+	<-blocking.reading
+
+	closed := make(chan error)
+	go func() {
+		closed <- s.closeCursors(ctx, func(*serverCursor) bool { return true })
+	}()
+	assert.Eventually(t, func() bool { return cursorCount(s) == 0 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(blocking.release)
+
+	assert.NoError(t, <-batch)
+	assert.NoError(t, <-closed)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&blocking.raced))
+
+	_, _, err = sc.nextBatch(ctx, 1)
+	if assert.Error(t, err) {
+		assert.Equal(t, ErrorCodeCursorNotFound, err.(*Error).Code)
+	}
+}
+
+func TestServerCloseCursorsOnDisconnect(t *testing.T) {
+	data := make([]map[string]interface{}, 3000)
+	for i := 0; i < 3000; i++ {
+		data[i] = map[string]interface{}{
+			"foo": fmt.Sprintf("bar_%d", i),
+		}
+	}
+
+	s := &Server{
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
+			return slice.NewCursor(data)
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+
+	_, err = cli.Database("foo").Collection("test").Find(ctx, bson.M{}, options.Find().SetBatchSize(10))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cursorCount(s))
+
+	assert.NoError(t, cli.Disconnect(ctx))
+	assert.Eventually(t, func() bool { return cursorCount(s) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestServerShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := &Server{
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
+			close(started)
+			<-release
+			return slice.NewCursor([]map[string]interface{}{{"foo": "bar"}})
+		},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	listenErr := make(chan error, 1)
+	go func() { listenErr <- s.Listen(ln) }()
+
+	ctx := context.Background()
+
+	// The client ends its sessions on Disconnect, which fails after the
+	// server has shut down
+	cli, err := mongo.Connect(ctx, options.Client().
+		ApplyURI("mongodb://"+ln.Addr().String()).
+		SetServerSelectionTimeout(100*time.Millisecond))
+	assert.NoError(t, err)
+	defer cli.Disconnect(ctx)
+
+	findErr := make(chan error, 1)
+	go func() {
+		findErr <- cli.Database("foo").Collection("test").FindOne(ctx, bson.M{}).Err()
+	}()
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(ctx) }()
+
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown returned before the in-flight request finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	assert.NoError(t, <-findErr)
+	assert.NoError(t, <-shutdownErr)
+	assert.Equal(t, ErrServerClosed, <-listenErr)
+	assert.Equal(t, ErrServerClosed, s.ListenAddr("127.0.0.1:0"))
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	handlerErr := make(chan error, 1)
+	s := &Server{
+		FindHandler: func(ctx context.Context, req *FindRequest) (Cursor, error) {
+			<-ctx.Done()
+			handlerErr <- ctx.Err()
+			return nil, ctx.Err()
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	go cli.Database("foo").Collection("test").FindOne(ctx, bson.M{})
+
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for c := range s.clients {
+			c.mu.Lock()
+			active := c.active
+			c.mu.Unlock()
+			if active {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(shutdownCtx))
+	assert.Equal(t, context.Canceled, <-handlerErr)
+	assert.NoError(t, s.Close())
+}
+
+func TestServerMaxTimeMS(t *testing.T) {
+	s := &Server{
+		FindHandler: func(ctx context.Context, req *FindRequest) (Cursor, error) {
+			assert.Equal(t, int64(50), req.MaxTimeMS)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	_, err = cli.Database("foo").Collection("test").Find(ctx, bson.M{}, options.Find().SetMaxTime(50*time.Millisecond))
+	if assert.Error(t, err) {
+		cmdErr, ok := err.(mongo.CommandError)
+		assert.True(t, ok)
+		assert.Equal(t, int32(50), cmdErr.Code)
+		assert.Equal(t, "MaxTimeMSExpired", cmdErr.Name)
+	}
+}
+
+func TestServerCancelOnDisconnect(t *testing.T) {
+	handlerErr := make(chan error, 1)
+	s := &Server{
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
+			<-ctx.Done()
+			handlerErr <- ctx.Err()
+			return nil, ctx.Err()
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	findCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = cli.Database("foo").Collection("test").Find(findCtx, bson.M{})
+	assert.Error(t, err)
+
+	select {
+	case err := <-handlerErr:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("handler context was not cancelled")
+	}
+}
+
+func TestServerCompression(t *testing.T) {
+	data := make([]map[string]interface{}, 3000)
+	for i := 0; i < 3000; i++ {
+		data[i] = map[string]interface{}{
+			"foo": fmt.Sprintf("bar_%d", i),
+		}
+	}
+
+	for _, compressor := range []string{"snappy", "zlib", "zstd"} {
+		t.Run(compressor, func(t *testing.T) {
+			s := &Server{
+				Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
+					return slice.NewCursor(data)
+				},
+				Compressors: []string{"zstd", "zlib", "snappy"},
+			}
+			s.init()
+
+			ctx := context.Background()
+
+			d := &dialer{s: s}
+			cli, err := mongo.NewClient(options.Client().SetDialer(d).SetCompressors([]string{compressor}))
+			assert.NoError(t, err)
+			assert.NoError(t, cli.Connect(ctx))
+			defer cli.Disconnect(ctx)
+
+			cur, err := cli.Database("foo").Collection("test").Find(ctx, bson.M{})
+			assert.NoError(t, err)
+
+			var result []map[string]interface{}
+			assert.NoError(t, cur.All(ctx, &result))
+			assert.Equal(t, data, result)
+
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			assert.NotZero(t, d.opCodes[mongoproto.OpCodeCompressed])
+		})
+	}
+}
+
+func TestServerCompressorNotEnabled(t *testing.T) {
+	s := &Server{Compressors: []string{"snappy"}}
+	s.init()
+
+	a, b := net.Pipe()
+	go s.handleConn(a)
+	defer b.Close()
+
+	ping := func(compressor *mongoproto.CompressorID) bson.M {
+		body, _ := bson.Marshal(bson.D{{Key: "ping", Value: int32(1)}, {Key: "$db", Value: "admin"}})
+		var op wireOp = &mongoproto.OpMsgV2{Header: mongoproto.MsgHeader{RequestID: 7}, Body: body}
+		if compressor != nil {
+			var err error
+			op, err = mongoproto.Compress(op, *compressor)
+			assert.NoError(t, err)
+		}
+		go op.WriteTo(b)
+
+		reply, err := mongoproto.OpFromReader(b)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		msg, ok := reply.(*mongoproto.OpMsgV2)
+		if !assert.True(t, ok, "unexpected reply %v", reply) {
+			return nil
+		}
+		assert.Equal(t, int32(7), msg.Header.ResponseTo)
+		var res bson.M
+		assert.NoError(t, bson.Unmarshal(msg.Body, &res))
+		return res
+	}
+
+	zlib := mongoproto.CompressorZlib
+	res := ping(&zlib)
+	assert.Equal(t, 0.0, res["ok"])
+	assert.Equal(t, int32(ErrorCodeProtocolError), res["code"])
+
+	// The connection stays open
+	res = ping(nil)
+	assert.Equal(t, 1.0, res["ok"])
+}
+
+func cursorCount(s *Server) int {
+	s.cursors.mu.RLock()
+	defer s.cursors.mu.RUnlock()
+	return len(s.cursors.cursors)
+}
+
 type dialer struct {
 	s *Server
+
+	mu      sync.Mutex
+	opCodes map[mongoproto.OpCode]int // opcodes of the messages sent by the server
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	a, b := net.Pipe()
+	go d.s.handleConn(&sniffConn{Conn: a, d: d})
+	return b, nil
+}
+
+type sniffConn struct {
+	net.Conn
+	d *dialer
+}
+
+func (c *sniffConn) Write(b []byte) (int, error) {
+	if len(b) >= mongoproto.MsgHeaderLen {
+		h, _ := mongoproto.ReadHeader(bytes.NewReader(b))
+		c.d.mu.Lock()
+		if c.d.opCodes == nil {
+			c.d.opCodes = map[mongoproto.OpCode]int{}
+		}
+		c.d.opCodes[h.OpCode]++
+		c.d.mu.Unlock()
+	}
+	return c.Conn.Write(b)
+}
+
+func BenchmarkServerReadCursorAll(b *testing.B) {
+	data := make([]map[string]interface{}, 3000)
+	for i := 0; i < 3000; i++ {
+		data[i] = map[string]interface{}{
+			"foo": fmt.Sprintf("bar_%d", i),
+		}
+	}
+
+	s := &Server{
+		Handler: func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
+			return slice.NewCursor(data)
+		},
+	}
+	s.init()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := cli.Connect(ctx); err != nil {
+		b.Fatal(err)
+	}
+	defer cli.Disconnect(ctx)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cur, err := cli.Database("foo").Collection("test").Find(ctx, bson.M{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		var result []bson.Raw
+		if err := cur.All(ctx, &result); err != nil {
+			b.Fatal(err)
+		}
+		if len(result) != len(data) {
+			b.Fatalf("got %d documents, want %d", len(result), len(data))
+		}
+	}
+}
+
+func TestServerMaxMessageSize(t *testing.T) {
+	var errorLog bytes.Buffer
+	s := &Server{MaxMessageSizeBytes: 1024, ErrorLog: log.New(&errorLog, "", 0)}
+	s.init()
+
+	a, b := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handleConn(a)
+		close(done)
+	}()
+	defer b.Close()
+
+	body, _ := bson.Marshal(bson.D{
+		{Key: "ping", Value: int32(1)},
+		{Key: "padding", Value: string(make([]byte, 2048))},
+		{Key: "$db", Value: "admin"},
+	})
+	go (&mongoproto.OpMsgV2{Body: body}).WriteTo(b)
+
+	_, err := mongoproto.OpFromReader(b)
+	assert.Error(t, err)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection was not closed")
+	}
+	assert.Contains(t, errorLog.String(), "exceeds the maximum message size")
+}
+
+func TestServerWriteCommands(t *testing.T) {
+	var (
+		inserts []*InsertRequest
+		updates []*UpdateRequest
+		deletes []*DeleteRequest
+	)
+	s := &Server{
+		InsertHandler: func(ctx context.Context, req *InsertRequest) (*WriteResult, error) {
+			inserts = append(inserts, req)
+			return &WriteResult{N: int32(len(req.Documents))}, nil
+		},
+		UpdateHandler: func(ctx context.Context, req *UpdateRequest) (*WriteResult, error) {
+			updates = append(updates, req)
+			return &WriteResult{
+				N:         1,
+				NModified: 0,
+				Upserted:  []Upserted{{Index: 0, ID: "new"}},
+			}, nil
+		},
+		DeleteHandler: func(ctx context.Context, req *DeleteRequest) (*WriteResult, error) {
+			deletes = append(deletes, req)
+			return &WriteResult{N: 2}, nil
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	coll := cli.Database("foo").Collection("test")
+
+	insertRes, err := coll.InsertMany(ctx, []interface{}{bson.M{"_id": 1}, bson.M{"_id": 2}}, options.InsertMany().SetOrdered(false))
+	assert.NoError(t, err)
+	assert.Len(t, insertRes.InsertedIDs, 2)
+	if assert.Len(t, inserts, 1) {
+		assert.Equal(t, "foo.test", inserts[0].Namespace())
+		assert.False(t, inserts[0].Ordered)
+		assert.Len(t, inserts[0].Documents, 2)
+		assert.Equal(t, int32(1), inserts[0].Documents[0].Lookup("_id").Int32())
+	}
+
+	updateRes, err := coll.UpdateOne(ctx, bson.M{"_id": "new"}, bson.M{"$set": bson.M{"a": 1}}, options.Update().SetUpsert(true))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), updateRes.MatchedCount)
+	assert.Equal(t, "new", updateRes.UpsertedID)
+	if assert.Len(t, updates, 1) && assert.Len(t, updates[0].Updates, 1) {
+		stmt := updates[0].Updates[0]
+		assert.Equal(t, bson.M{"_id": "new"}, stmt.Filter)
+		assert.True(t, stmt.Upsert)
+		assert.False(t, stmt.Multi)
+		assert.Equal(t, bson.TypeEmbeddedDocument, stmt.Update.Type)
+	}
+
+	deleteRes, err := coll.DeleteMany(ctx, bson.M{"a": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), deleteRes.DeletedCount)
+	if assert.Len(t, deletes, 1) && assert.Len(t, deletes[0].Deletes, 1) {
+		assert.Equal(t, int32(0), deletes[0].Deletes[0].Limit)
+	}
+}
+
+func TestServerWriteErrors(t *testing.T) {
+	s := &Server{
+		InsertHandler: func(ctx context.Context, req *InsertRequest) (*WriteResult, error) {
+			return &WriteResult{
+				N:           1,
+				WriteErrors: []WriteError{{Index: 1, Code: ErrorCodeDuplicateKey, Message: "duplicate key"}},
+			}, nil
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	coll := cli.Database("foo").Collection("test")
+
+	_, err = coll.InsertMany(ctx, []interface{}{bson.M{"_id": 1}, bson.M{"_id": 1}})
+	if assert.IsType(t, mongo.BulkWriteException{}, err) {
+		writeErrors := err.(mongo.BulkWriteException).WriteErrors
+		if assert.Len(t, writeErrors, 1) {
+			assert.Equal(t, 1, writeErrors[0].Index)
+			assert.Equal(t, int(ErrorCodeDuplicateKey), writeErrors[0].Code)
+		}
+	}
+
+	_, err = coll.DeleteOne(ctx, bson.M{})
+	if assert.IsType(t, mongo.CommandError{}, err) {
+		assert.Equal(t, int32(ErrorCodeCommandNotSupported), err.(mongo.CommandError).Code)
+	}
 }
 
-func (d *dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+func TestServerLegacyWrites(t *testing.T) {
+	requests := make(chan interface{}, 3)
+	s := &Server{
+		InsertHandler: func(ctx context.Context, req *InsertRequest) (*WriteResult, error) {
+			requests <- req
+			return &WriteResult{N: int32(len(req.Documents))}, nil
+		},
+		UpdateHandler: func(ctx context.Context, req *UpdateRequest) (*WriteResult, error) {
+			requests <- req
+			return &WriteResult{N: 1}, nil
+		},
+		DeleteHandler: func(ctx context.Context, req *DeleteRequest) (*WriteResult, error) {
+			requests <- req
+			return &WriteResult{N: 1}, nil
+		},
+	}
+	s.init()
+
 	a, b := net.Pipe()
-	go d.s.handleConn(a)
-	return b, nil
+	go s.handleConn(a)
+	defer b.Close()
+
+	doc, _ := bson.Marshal(bson.M{"a": int32(1)})
+	update, _ := bson.Marshal(bson.M{"$set": bson.M{"b": int32(2)}})
+
+	for _, op := range []io.WriterTo{
+		&mongoproto.OpInsert{
+			Flags:              mongoproto.OpInsertContinueOnError,
+			FullCollectionName: "foo.test",
+			Documents:          [][]byte{doc, doc},
+		},
+		&mongoproto.OpUpdate{
+			Flags:              mongoproto.OpUpdateMuli,
+			FullCollectionName: "foo.test",
+			Selector:           doc,
+			Update:             update,
+		},
+		&mongoproto.OpDelete{
+			Flags:              mongoproto.OpDeleteSingleRemove,
+			FullCollectionName: "foo.test",
+			Selector:           doc,
+		},
+	} {
+		_, err := op.WriteTo(b)
+		assert.NoError(t, err)
+	}
+
+	insert := (<-requests).(*InsertRequest)
+	assert.Equal(t, "foo.test", insert.Namespace())
+	assert.False(t, insert.Ordered)
+	assert.Len(t, insert.Documents, 2)
+
+	upd := (<-requests).(*UpdateRequest)
+	if assert.Len(t, upd.Updates, 1) {
+		assert.Equal(t, bson.M{"a": int32(1)}, upd.Updates[0].Filter)
+		assert.True(t, upd.Updates[0].Multi)
+		assert.Equal(t, bson.Raw(update), upd.Updates[0].Update.Document())
+	}
+
+	del := (<-requests).(*DeleteRequest)
+	if assert.Len(t, del.Deletes, 1) {
+		assert.Equal(t, int32(1), del.Deletes[0].Limit)
+	}
+}
+
+func TestServerGetLastError(t *testing.T) {
+	var concerns []*WriteConcern
+	s := &Server{
+		InsertHandler: func(ctx context.Context, req *InsertRequest) (*WriteResult, error) {
+			concerns = append(concerns, req.WriteConcern)
+			return &WriteResult{
+				N:           1,
+				WriteErrors: []WriteError{{Index: 1, Code: ErrorCodeDuplicateKey, Message: "duplicate key"}},
+			}, nil
+		},
+		UpdateHandler: func(ctx context.Context, req *UpdateRequest) (*WriteResult, error) {
+			concerns = append(concerns, req.WriteConcern)
+			return &WriteResult{N: 1, Upserted: []Upserted{{ID: "new"}}}, nil
+		},
+		DeleteHandler: func(ctx context.Context, req *DeleteRequest) (*WriteResult, error) {
+			concerns = append(concerns, req.WriteConcern)
+			return nil, Errorf(ErrorCodeWriteConcernFailed, "waiting for replication timed out")
+		},
+	}
+	s.init()
+
+	a, b := net.Pipe()
+	go s.handleConn(a)
+	defer b.Close()
+
+	getLastError := func(cmd bson.D) bson.M {
+		q, _ := bson.Marshal(cmd)
+		_, err := (&mongoproto.OpQuery{FullCollectionName: "foo.$cmd", NumberToReturn: -1, Query: q}).WriteTo(b)
+		assert.NoError(t, err)
+
+		op, err := mongoproto.OpFromReader(b)
+		assert.NoError(t, err)
+		var res bson.M
+		assert.NoError(t, bson.Unmarshal(op.(*mongoproto.OpReply).Documents[0], &res))
+		return res
+	}
+
+	res := getLastError(bson.D{{Key: "getLastError", Value: 1}})
+	assert.Equal(t, bson.M{"err": nil, "n": int32(0), "wtimeout": false, "ok": 1.0}, res)
+
+	doc, _ := bson.Marshal(bson.M{"a": int32(1)})
+	(&mongoproto.OpInsert{FullCollectionName: "foo.test", Documents: [][]byte{doc, doc}}).WriteTo(b)
+	res = getLastError(bson.D{{Key: "getLastError", Value: 1}, {Key: "w", Value: "majority"}, {Key: "wtimeout", Value: 100}})
+	assert.Equal(t, "duplicate key", res["err"])
+	assert.Equal(t, int32(ErrorCodeDuplicateKey), res["code"])
+	assert.Equal(t, int32(1), res["n"])
+
+	(&mongoproto.OpUpdate{Flags: mongoproto.OpUpdateUpsert, FullCollectionName: "foo.test", Selector: doc, Update: doc}).WriteTo(b)
+	res = getLastError(bson.D{{Key: "getlasterror", Value: 1}})
+	assert.Nil(t, res["err"])
+	assert.Equal(t, false, res["updatedExisting"])
+	assert.Equal(t, "new", res["upserted"])
+
+	(&mongoproto.OpDelete{FullCollectionName: "foo.test", Selector: doc}).WriteTo(b)
+	res = getLastError(bson.D{{Key: "getLastError", Value: 1}, {Key: "fsync", Value: true}})
+	assert.Equal(t, int32(ErrorCodeWriteConcernFailed), res["code"])
+	assert.Equal(t, true, res["wtimeout"])
+
+	assert.Equal(t, []*WriteConcern{{W: "majority", WTimeout: 100}, nil, {J: true}}, concerns)
+}
+
+func TestServerHello(t *testing.T) {
+	s := &Server{}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	hello := func(cmd bson.D) bson.M {
+		var res bson.M
+		assert.NoError(t, cli.Database("admin").RunCommand(ctx, cmd).Decode(&res))
+		return res
+	}
+
+	res := hello(bson.D{{Key: "hello", Value: 1}, {Key: "saslSupportedMechs", Value: "admin.user"}})
+	assert.Equal(t, true, res["isWritablePrimary"])
+	assert.NotContains(t, res, "setName")
+	assert.Equal(t, int32(DefaultMaxWireVersion), res["maxWireVersion"])
+	assert.Equal(t, int32(DefaultLogicalSessionTimeoutMinutes), res["logicalSessionTimeoutMinutes"])
+	assert.Equal(t, int32(maxWriteBatchSize), res["maxWriteBatchSize"])
+	assert.Contains(t, res, "localTime")
+	assert.Contains(t, res, "connectionId")
+	assert.Equal(t, bson.A{}, res["saslSupportedMechs"])
+
+	s.SetHello(HelloOptions{
+		Topology: TopologyReplicaSetSecondary,
+		SetName:  "rs0",
+		Hosts:    []string{"a:27017", "b:27017"},
+		Primary:  "a:27017",
+		Me:       "b:27017",
+	})
+	res = hello(bson.D{{Key: "isMaster", Value: 1}})
+	assert.Equal(t, false, res["ismaster"])
+	assert.Equal(t, true, res["secondary"])
+	assert.Equal(t, "rs0", res["setName"])
+	assert.Equal(t, bson.A{"a:27017", "b:27017"}, res["hosts"])
+	assert.Equal(t, "a:27017", res["primary"])
+	assert.Equal(t, "b:27017", res["me"])
+
+	s.SetHello(HelloOptions{Topology: TopologyMongos, LogicalSessionTimeoutMinutes: -1})
+	res = hello(bson.D{{Key: "hello", Value: 1}})
+	assert.Equal(t, true, res["isWritablePrimary"])
+	assert.Equal(t, "isdbgrid", res["msg"])
+	assert.NotContains(t, res, "logicalSessionTimeoutMinutes")
+}
+
+func TestServerAwaitableHello(t *testing.T) {
+	s := &Server{}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	var res struct {
+		TopologyVersion topologyVersion `bson:"topologyVersion"`
+		Msg             string          `bson:"msg"`
+	}
+	assert.NoError(t, cli.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&res))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.SetHello(HelloOptions{Topology: TopologyMongos})
+	}()
+
+	start := time.Now()
+	version := res.TopologyVersion
+	assert.NoError(t, cli.Database("admin").RunCommand(ctx, bson.D{
+		{Key: "hello", Value: 1},
+		{Key: "topologyVersion", Value: version},
+		{Key: "maxAwaitTimeMS", Value: 5000},
+	}).Decode(&res))
+
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, "isdbgrid", res.Msg)
+	assert.Equal(t, version.ProcessID, res.TopologyVersion.ProcessID)
+	assert.Equal(t, version.Counter+1, res.TopologyVersion.Counter)
+}
+
+func TestReplicaSet(t *testing.T) {
+	data := []map[string]interface{}{{"foo": "bar"}}
+	var inserted int32
+	rs := NewReplicaSet("rs0", 3, func(s *Server) {
+		s.Handler = func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
+			return slice.NewCursor(data)
+		}
+		s.InsertHandler = func(ctx context.Context, req *InsertRequest) (*WriteResult, error) {
+			atomic.AddInt32(&inserted, int32(len(req.Documents)))
+			return &WriteResult{N: int32(len(req.Documents))}, nil
+		}
+	})
+	assert.NoError(t, rs.Start())
+	defer rs.Close()
+
+	ctx := context.Background()
+
+	cli, err := mongo.Connect(ctx, options.Client().ApplyURI(rs.URI()))
+	assert.NoError(t, err)
+	defer cli.Disconnect(ctx)
+
+	coll := cli.Database("foo").Collection("test")
+	_, err = coll.InsertOne(ctx, bson.M{"a": 1})
+	assert.NoError(t, err)
+
+	secondaryColl := cli.Database("foo").Collection("test", options.Collection().SetReadPreference(readpref.Secondary()))
+	var res map[string]interface{}
+	assert.NoError(t, secondaryColl.FindOne(ctx, bson.M{}).Decode(&res))
+	assert.Equal(t, "bar", res["foo"])
+
+	// Writes sent directly to a secondary are rejected
+	direct, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+rs.Hosts()[1]+"/?connect=direct&retryWrites=false"))
+	assert.NoError(t, err)
+	defer direct.Disconnect(ctx)
+	_, err = direct.Database("foo").Collection("test").InsertOne(ctx, bson.M{"a": 1})
+	if assert.IsType(t, mongo.CommandError{}, err) {
+		assert.Equal(t, int32(ErrorCodeNotWritablePrimary), err.(mongo.CommandError).Code)
+	}
+
+	// The driver follows the primary after a step down
+	var stepDown bson.M
+	assert.NoError(t, cli.Database("admin").RunCommand(ctx, bson.D{{Key: "replSetStepDown", Value: 60}}).Decode(&stepDown))
+	assert.Equal(t, 1, rs.Primary())
+
+	_, err = coll.InsertOne(ctx, bson.M{"a": 2})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&inserted))
+
+	assert.NoError(t, rs.Elect(2))
+	_, err = coll.InsertOne(ctx, bson.M{"a": 3})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&inserted))
+}
+
+func TestReplicaSetCursorTimeout(t *testing.T) {
+	data := []map[string]interface{}{{"foo": "a"}, {"foo": "b"}, {"foo": "c"}}
+	rs := NewReplicaSet("rs0", 2, func(s *Server) {
+		s.Handler = func(ctx context.Context, collection string, q bson.M, fields bson.M) (Cursor, error) {
+			return slice.NewCursor(data)
+		}
+		// Not used by the shared cursor store
+		s.CursorTimeout = time.Millisecond
+	})
+	rs.CursorTimeout = 200 * time.Millisecond
+	assert.NoError(t, rs.Start())
+	defer rs.Close()
+
+	ctx := context.Background()
+
+	cli, err := mongo.Connect(ctx, options.Client().ApplyURI(rs.URI()))
+	assert.NoError(t, err)
+	defer cli.Disconnect(ctx)
+
+	coll := cli.Database("foo").Collection("test")
+	cur, err := coll.Find(ctx, bson.M{}, options.Find().SetBatchSize(1))
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	var res []map[string]interface{}
+	assert.NoError(t, cur.All(ctx, &res))
+	assert.Len(t, res, 3)
+
+	_, err = coll.Find(ctx, bson.M{}, options.Find().SetBatchSize(1))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cursorCount(rs.Members[0]))
+	assert.Eventually(t, func() bool { return cursorCount(rs.Members[0]) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestServerAuthentication(t *testing.T) {
+	store := &MemoryCredentialStore{}
+	assert.NoError(t, store.AddUser(User{
+		Name:     "user",
+		Database: "admin",
+		Roles:    []Role{{Name: "read", Database: "foo"}},
+	}, "pencil"))
+
+	s := &Server{
+		Credentials: store,
+		FindHandler: func(ctx context.Context, req *FindRequest) (Cursor, error) {
+			user, ok := UserFromContext(ctx)
+			if assert.True(t, ok) {
+				assert.Equal(t, "user", user.Name)
+				assert.Equal(t, []Role{{Name: "read", Database: "foo"}}, user.Roles)
+			}
+			return slice.NewCursor([]map[string]interface{}{{"foo": "a"}})
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	connect := func(cred *options.Credential) *mongo.Client {
+		opts := &options.ClientOptions{Dialer: &dialer{s: s}}
+		if cred != nil {
+			opts.SetAuth(*cred)
+		}
+		cli, err := mongo.NewClient(opts.SetServerSelectionTimeout(time.Second))
+		assert.NoError(t, err)
+		assert.NoError(t, cli.Connect(ctx))
+		return cli
+	}
+
+	for _, mechanism := range []string{"", MechanismSCRAMSHA1, MechanismSCRAMSHA256} {
+		t.Run("mechanism "+mechanism, func(t *testing.T) {
+			cli := connect(&options.Credential{AuthMechanism: mechanism, Username: "user", Password: "pencil"})
+			defer cli.Disconnect(ctx)
+
+			var res []map[string]interface{}
+			cur, err := cli.Database("foo").Collection("test").Find(ctx, bson.M{})
+			if assert.NoError(t, err) {
+				assert.NoError(t, cur.All(ctx, &res))
+			}
+			assert.Equal(t, []map[string]interface{}{{"foo": "a"}}, res)
+		})
+	}
+
+	t.Run("wrong password", func(t *testing.T) {
+		cli := connect(&options.Credential{Username: "user", Password: "pen"})
+		defer cli.Disconnect(ctx)
+
+		_, err := cli.Database("foo").Collection("test").Find(ctx, bson.M{})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "AuthenticationFailed")
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		cli := connect(nil)
+		defer cli.Disconnect(ctx)
+
+		assert.NoError(t, cli.Ping(ctx, readpref.Primary()))
+
+		var res bson.M
+		assert.NoError(t, cli.Database("admin").RunCommand(ctx, bson.D{
+			{Key: "hello", Value: 1},
+			{Key: "saslSupportedMechs", Value: "admin.user"},
+			{Key: "speculativeAuthenticate", Value: bson.D{
+				{Key: "saslStart", Value: 1},
+				{Key: "mechanism", Value: MechanismSCRAMSHA256},
+				{Key: "payload", Value: []byte("n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL")},
+				{Key: "db", Value: "admin"},
+			}},
+		}).Decode(&res))
+		assert.Equal(t, bson.A{MechanismSCRAMSHA1, MechanismSCRAMSHA256}, res["saslSupportedMechs"])
+		if assert.Contains(t, res, "speculativeAuthenticate") {
+			assert.Equal(t, false, res["speculativeAuthenticate"].(bson.M)["done"])
+		}
+
+		_, err := cli.Database("foo").Collection("test").Find(ctx, bson.M{})
+		cmdErr, ok := err.(mongo.CommandError)
+		if assert.True(t, ok, "unexpected error %v", err) {
+			assert.Equal(t, int32(ErrorCodeUnauthorized), cmdErr.Code)
+		}
+	})
+}
+
+// testCertificate issues a certificate for subject signed by parent, or a
+// self-signed CA certificate when parent is nil.
+func testCertificate(t *testing.T, subject pkix.Name, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestServerTLS(t *testing.T) {
+	ca := testCertificate(t, pkix.Name{CommonName: "ca"}, nil)
+	serverCert := testCertificate(t, pkix.Name{CommonName: "localhost"}, &ca)
+	clientCert := testCertificate(t, pkix.Name{CommonName: "client", Organization: []string{"mongache"}}, &ca)
+
+	dir, err := ioutil.TempDir("", "mongache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	keyDER, err := x509.MarshalECPrivateKey(serverCert.PrivateKey.(*ecdsa.PrivateKey))
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCert.Certificate[0]}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	store := &MemoryCredentialStore{}
+	store.AddCredential(&Credential{User: User{Name: "CN=client,O=mongache", Database: "$external"}})
+
+	s := &Server{
+		TLSConfig:   &tls.Config{ClientCAs: pool},
+		Credentials: store,
+		FindHandler: func(ctx context.Context, req *FindRequest) (Cursor, error) {
+			user, ok := UserFromContext(ctx)
+			if assert.True(t, ok) {
+				assert.Equal(t, "CN=client,O=mongache", user.Name)
+			}
+			return slice.NewCursor([]map[string]interface{}{{"foo": "a"}})
+		},
+	}
+	defer s.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go s.ListenTLS(ln, certFile, keyFile)
+
+	ctx := context.Background()
+
+	connect := func(certs []tls.Certificate) *mongo.Client {
+		opts := options.Client().
+			ApplyURI("mongodb://" + ln.Addr().String() + "/?connect=direct").
+			SetTLSConfig(&tls.Config{RootCAs: pool, Certificates: certs}).
+			SetServerSelectionTimeout(time.Second)
+		if certs != nil {
+			opts.SetAuth(options.Credential{AuthMechanism: MechanismX509})
+		}
+		cli, err := mongo.Connect(ctx, opts)
+		assert.NoError(t, err)
+		return cli
+	}
+
+	cli := connect([]tls.Certificate{clientCert})
+	defer cli.Disconnect(ctx)
+
+	var res []map[string]interface{}
+	cur, err := cli.Database("foo").Collection("test").Find(ctx, bson.M{})
+	if assert.NoError(t, err) {
+		assert.NoError(t, cur.All(ctx, &res))
+	}
+	assert.Equal(t, []map[string]interface{}{{"foo": "a"}}, res)
+
+	anonymous := connect(nil)
+	defer anonymous.Disconnect(ctx)
+
+	assert.NoError(t, anonymous.Ping(ctx, readpref.Primary()))
+	err = anonymous.Database("$external").RunCommand(ctx, bson.D{
+		{Key: "authenticate", Value: 1},
+		{Key: "mechanism", Value: MechanismX509},
+	}).Err()
+	cmdErr, ok := err.(mongo.CommandError)
+	if assert.True(t, ok, "unexpected error %v", err) {
+		assert.Equal(t, int32(ErrorCodeAuthenticationFailed), cmdErr.Code)
+	}
+}
+
+func TestServerAuthorizer(t *testing.T) {
+	store := &MemoryCredentialStore{}
+	assert.NoError(t, store.AddUser(User{Name: "alice", Database: "admin"}, "pencil"))
+	assert.NoError(t, store.AddUser(User{Name: "bob", Database: "admin"}, "pencil"))
+
+	var mu sync.Mutex
+	var checked []string
+	s := &Server{
+		Credentials: store,
+		Authorizer: AuthorizerFunc(func(ctx context.Context, principal Principal, action, namespace string) error {
+			mu.Lock()
+			checked = append(checked, action+" "+namespace)
+			mu.Unlock()
+			if principal.User == nil {
+				return errors.New("not authenticated")
+			}
+			if namespace == "foo.secret" {
+				return fmt.Errorf("%s may not read secrets", principal.User.Name)
+			}
+			if namespace == "foo.hidden" {
+				return fmt.Errorf("hidden: %w", Errorf(ErrorCodeNamespaceNotFound, "ns not found"))
+			}
+			return nil
+		}),
+		FindHandler: func(ctx context.Context, req *FindRequest) (Cursor, error) {
+			return slice.NewCursor([]map[string]interface{}{{"foo": "a"}, {"foo": "b"}, {"foo": "c"}})
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	connect := func(name string) *mongo.Client {
+		opts := &options.ClientOptions{Dialer: &dialer{s: s}}
+		opts.SetAuth(options.Credential{Username: name, Password: "pencil"})
+		cli, err := mongo.NewClient(opts)
+		assert.NoError(t, err)
+		assert.NoError(t, cli.Connect(ctx))
+		return cli
+	}
+
+	alice := connect("alice")
+	defer alice.Disconnect(ctx)
+	bob := connect("bob")
+	defer bob.Disconnect(ctx)
+
+	_, err := alice.Database("foo").Collection("secret").Find(ctx, bson.M{})
+	cmdErr, ok := err.(mongo.CommandError)
+	if assert.True(t, ok, "unexpected error %v", err) {
+		assert.Equal(t, int32(ErrorCodeUnauthorized), cmdErr.Code)
+		assert.Contains(t, cmdErr.Message, "alice may not read secrets")
+	}
+
+	_, err = alice.Database("foo").Collection("hidden").Find(ctx, bson.M{})
+	cmdErr, ok = err.(mongo.CommandError)
+	if assert.True(t, ok, "unexpected error %v", err) {
+		assert.Equal(t, int32(ErrorCodeNamespaceNotFound), cmdErr.Code)
+	}
+
+	cur, err := alice.Database("foo").Collection("test").Find(ctx, bson.M{}, options.Find().SetBatchSize(1))
+	assert.NoError(t, err)
+	defer cur.Close(ctx)
+
+	mu.Lock()
+	assert.Contains(t, checked, "find foo.test")
+	mu.Unlock()
+
+	for _, cmd := range []bson.D{
+		{{Key: "getMore", Value: cur.ID()}, {Key: "collection", Value: "test"}},
+		{{Key: "killCursors", Value: "test"}, {Key: "cursors", Value: bson.A{cur.ID()}}},
+	} {
+		err = bob.Database("foo").RunCommand(ctx, cmd).Err()
+		cmdErr, ok = err.(mongo.CommandError)
+		if assert.True(t, ok, "unexpected error %v", err) {
+			assert.Equal(t, int32(ErrorCodeUnauthorized), cmdErr.Code)
+		}
+	}
+
+	// No cursor is killed when one of them belongs to another principal
+	own, err := bob.Database("foo").Collection("test").Find(ctx, bson.M{}, options.Find().SetBatchSize(1))
+	assert.NoError(t, err)
+	defer own.Close(ctx)
+	err = bob.Database("foo").RunCommand(ctx, bson.D{{Key: "killCursors", Value: "test"}, {Key: "cursors", Value: bson.A{own.ID(), cur.ID()}}}).Err()
+	cmdErr, ok = err.(mongo.CommandError)
+	if assert.True(t, ok, "unexpected error %v", err) {
+		assert.Equal(t, int32(ErrorCodeUnauthorized), cmdErr.Code)
+	}
+
+	var result []map[string]interface{}
+	assert.NoError(t, cur.All(ctx, &result))
+	assert.Len(t, result, 3)
+	assert.NoError(t, own.All(ctx, &result))
+	assert.Len(t, result, 3)
+}
+
+func TestServerIndexCommands(t *testing.T) {
+	var (
+		creates []*CreateIndexesRequest
+		drops   []*DropIndexesRequest
+	)
+	s := &Server{
+		CreateIndexesHandler: func(ctx context.Context, req *CreateIndexesRequest) (*IndexesResult, error) {
+			creates = append(creates, req)
+			return &IndexesResult{NumIndexesBefore: 1, NumIndexesAfter: 1 + int32(len(req.Indexes))}, nil
+		},
+		DropIndexesHandler: func(ctx context.Context, req *DropIndexesRequest) (*IndexesResult, error) {
+			drops = append(drops, req)
+			return &IndexesResult{NumIndexesBefore: 2}, nil
+		},
+		ListIndexesHandler: func(ctx context.Context, req *ListIndexesRequest) ([]IndexModel, error) {
+			if req.Collection != "test" {
+				return nil, Errorf(ErrorCodeNamespaceNotFound, "ns does not exist: %s", req.Namespace())
+			}
+			return []IndexModel{{Name: "a_1", Key: bson.D{{Key: "a", Value: int32(1)}}, Unique: true}}, nil
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	db := cli.Database("foo")
+	indexes := db.Collection("test").Indexes()
+
+	name, err := indexes.CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "a", Value: 1}, {Key: "b", Value: -1}},
+		Options: options.Index().SetSparse(true),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "a_1_b_-1", name)
+	if assert.Len(t, creates, 1) && assert.Len(t, creates[0].Indexes, 1) {
+		assert.Equal(t, "foo.test", creates[0].Namespace())
+		assert.Equal(t, IndexModel{Name: "a_1_b_-1", Key: bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: int32(-1)}}, Sparse: true}, creates[0].Indexes[0])
+	}
+
+	var res bson.M
+	assert.NoError(t, db.RunCommand(ctx, bson.D{
+		{Key: "createIndexes", Value: "test"},
+		{Key: "indexes", Value: bson.A{bson.M{"key": bson.M{"c": 1}}}},
+	}).Decode(&res))
+	assert.EqualValues(t, 2, res["numIndexesAfter"])
+	if assert.Len(t, creates, 2) {
+		assert.Equal(t, "c_1", creates[1].Indexes[0].Name)
+	}
+
+	_, err = indexes.DropOne(ctx, "a_1_b_-1")
+	assert.NoError(t, err)
+	_, err = indexes.DropAll(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, db.RunCommand(ctx, bson.D{
+		{Key: "dropIndexes", Value: "test"},
+		{Key: "index", Value: bson.D{{Key: "c", Value: 1}}},
+	}).Err())
+	if assert.Len(t, drops, 3) {
+		assert.Equal(t, []string{"a_1_b_-1"}, drops[0].Names)
+		assert.Empty(t, drops[1].Names)
+		assert.Empty(t, drops[1].Key)
+		assert.Equal(t, bson.D{{Key: "c", Value: int32(1)}}, drops[2].Key)
+	}
+
+	cur, err := indexes.List(ctx)
+	assert.NoError(t, err)
+	var list []bson.M
+	assert.NoError(t, cur.All(ctx, &list))
+	assert.Equal(t, []bson.M{{"name": "a_1", "key": bson.M{"a": int32(1)}, "unique": true}}, list)
+
+	// The driver returns no indexes for missing collections
+	cur, err = db.Collection("missing").Indexes().List(ctx)
+	assert.NoError(t, err)
+	assert.False(t, cur.Next(ctx))
+}
+
+func TestServerAggregate(t *testing.T) {
+	var reqs []*AggregateRequest
+	s := &Server{
+		AggregateHandler: func(ctx context.Context, req *AggregateRequest) (Cursor, error) {
+			reqs = append(reqs, req)
+			return slice.NewCursor([]bson.M{{"n": 1}, {"n": 2}, {"n": 3}})
+		},
+	}
+	s.init()
+
+	ctx := context.Background()
+
+	cli, err := mongo.NewClient(&options.ClientOptions{Dialer: &dialer{s: s}})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Connect(ctx))
+	defer cli.Disconnect(ctx)
+
+	db := cli.Database("foo")
+	cur, err := db.Collection("test").Aggregate(ctx, bson.A{bson.M{"$match": bson.M{"n": 1}}}, options.Aggregate().SetBatchSize(2))
+	assert.NoError(t, err)
+	var docs []bson.M
+	assert.NoError(t, cur.All(ctx, &docs))
+	assert.Len(t, docs, 3)
+	if assert.Len(t, reqs, 1) {
+		assert.Equal(t, "foo.test", reqs[0].Namespace())
+		assert.Equal(t, int32(2), reqs[0].BatchSize)
+		assert.Len(t, reqs[0].Pipeline, 1)
+	}
+
+	err = db.RunCommand(ctx, bson.D{{Key: "aggregate", Value: "test"}, {Key: "pipeline", Value: bson.A{}}}).Err()
+	if cmdErr, ok := err.(mongo.CommandError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, int32(ErrorCodeFailedToParse), cmdErr.Code)
+	}
+
+	s.AggregateHandler = nil
+	err = db.RunCommand(ctx, bson.D{{Key: "aggregate", Value: 1}, {Key: "pipeline", Value: bson.A{}}, {Key: "cursor", Value: bson.M{}}}).Err()
+	if cmdErr, ok := err.(mongo.CommandError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, int32(ErrorCodeCommandNotSupported), cmdErr.Code)
+	}
 }
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func init() {
+	builtinCommands["authenticate"] = cmdAuthenticate
+}
+
+// MechanismX509 authenticates clients with their TLS certificate.
+const MechanismX509 = "MONGODB-X509"
+
+// externalDatabase is the database of users authenticated outside of the
+// server, such as with a certificate.
+const externalDatabase = "$external"
+
+// ListenAndServeTLS listens on addr and serves TLS connections with the
+// certificate and key of certFile and keyFile, added to those of TLSConfig.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.ListenTLS(ln, certFile, keyFile)
+}
+
+// ListenTLS serves TLS connections accepted by ln, like ListenAndServeTLS.
+func (s *Server) ListenTLS(ln net.Listener, certFile, keyFile string) error {
+	config, err := s.tlsConfig(certFile, keyFile)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	return s.Listen(tls.NewListener(ln, config))
+}
+
+// tlsConfig returns a copy of TLSConfig with the certificate of certFile and
+// keyFile. Client certificates are verified when given if TLSConfig has
+// client CAs and no client authentication policy.
+func (s *Server) tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	if config.ClientCAs != nil && config.ClientAuth == tls.NoClientCert {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+type authenticateCommand struct {
+	Mechanism string `bson:"mechanism"`
+	User      string `bson:"user"`
+}
+
+// authenticateX509 authenticates the client as the user named after the
+// subject of its verified certificate.
+func (c *client) authenticateX509(ctx context.Context, db string, args *authenticateCommand) (bson.D, error) {
+	store := c.server.Credentials
+	if store == nil {
+		return nil, Errorf(ErrorCodeMechanismUnavailable, "authentication is not enabled")
+	}
+	if args.Mechanism != MechanismX509 {
+		return nil, Errorf(ErrorCodeMechanismUnavailable, "Received authentication for mechanism %s which is unknown or not enabled", args.Mechanism)
+	}
+	if db != externalDatabase {
+		return nil, Errorf(ErrorCodeBadValue, "%s authentication must be run against the %s database", MechanismX509, externalDatabase)
+	}
+
+	conn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil, Errorf(ErrorCodeProtocolError, "%s authentication requires a TLS connection", MechanismX509)
+	}
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil, Errorf(ErrorCodeAuthenticationFailed, "No verified subject name available from client")
+	}
+
+	subject := state.VerifiedChains[0][0].Subject.String()
+	if args.User != "" && args.User != subject {
+		return nil, errAuthenticationFailed()
+	}
+
+	cred, err := store.Credential(ctx, externalDatabase, subject)
+	if err != nil {
+		return nil, err
+	}
+	if cred == nil {
+		return nil, errAuthenticationFailed()
+	}
+
+	user := cred.User
+	c.user = &user
+	c.sasl = nil
+
+	return bson.D{
+		{Key: "dbname", Value: externalDatabase},
+		{Key: "user", Value: subject},
+	}, nil
+}
+
+func cmdAuthenticate(ctx context.Context, cmd *Command) (bson.D, error) {
+	var args authenticateCommand
+	if err := bson.Unmarshal(cmd.Doc, &args); err != nil {
+		return nil, &Error{Code: ErrorCodeFailedToParse, Message: err.Error()}
+	}
+
+	return cmd.client.authenticateX509(ctx, cmd.Database, &args)
+}
@@ -0,0 +1,530 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/orktes/mongache/pkg/mongoproto"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func init() {
+	builtinCommands["insert"] = cmdInsert
+	builtinCommands["update"] = cmdUpdate
+	builtinCommands["delete"] = cmdDelete
+	builtinCommands["getLastError"] = cmdGetLastError
+	builtinCommands["getlasterror"] = cmdGetLastError
+}
+
+// WriteConcern is the acknowledgement requested by a client for a write.
+type WriteConcern struct {
+	W        interface{} `bson:"w,omitempty"` // number of nodes or a tag such as "majority"
+	J        bool        `bson:"j,omitempty"`
+	WTimeout int64       `bson:"wtimeout,omitempty"` // milliseconds
+}
+
+// InsertRequest describes an insert received from a client either as a
+// legacy OP_INSERT or as an insert command.
+type InsertRequest struct {
+	Database     string
+	Collection   string
+	Documents    []bson.Raw
+	Ordered      bool          // stop at the first failed document
+	WriteConcern *WriteConcern // nil when the client did not specify one
+}
+
+// Namespace returns the "dbname.collectionname" namespace of the request.
+func (req *InsertRequest) Namespace() string {
+	return req.Database + "." + req.Collection
+}
+
+// UpdateStatement is a single update of an UpdateRequest.
+type UpdateStatement struct {
+	Filter       bson.M        `bson:"q"`
+	Update       bson.RawValue `bson:"u"` // update document, replacement document or pipeline
+	Upsert       bool          `bson:"upsert"`
+	Multi        bool          `bson:"multi"`
+	ArrayFilters []bson.M      `bson:"arrayFilters"`
+	Collation    bson.M        `bson:"collation"`
+	Hint         interface{}   `bson:"hint"`
+}
+
+// UpdateRequest describes an update received from a client either as a
+// legacy OP_UPDATE or as an update command.
+type UpdateRequest struct {
+	Database     string
+	Collection   string
+	Updates      []UpdateStatement
+	Ordered      bool          // stop at the first failed statement
+	WriteConcern *WriteConcern // nil when the client did not specify one
+}
+
+// Namespace returns the "dbname.collectionname" namespace of the request.
+func (req *UpdateRequest) Namespace() string {
+	return req.Database + "." + req.Collection
+}
+
+// DeleteStatement is a single delete of a DeleteRequest.
+type DeleteStatement struct {
+	Filter    bson.M      `bson:"q"`
+	Limit     int32       `bson:"limit"` // 1 to delete a single document, 0 for all matching
+	Collation bson.M      `bson:"collation"`
+	Hint      interface{} `bson:"hint"`
+}
+
+// DeleteRequest describes a delete received from a client either as a
+// legacy OP_DELETE or as a delete command.
+type DeleteRequest struct {
+	Database     string
+	Collection   string
+	Deletes      []DeleteStatement
+	Ordered      bool          // stop at the first failed statement
+	WriteConcern *WriteConcern // nil when the client did not specify one
+}
+
+// Namespace returns the "dbname.collectionname" namespace of the request.
+func (req *DeleteRequest) Namespace() string {
+	return req.Database + "." + req.Collection
+}
+
+// Upserted identifies a document inserted by an upsert.
+type Upserted struct {
+	Index int32       // index of the statement in the request
+	ID    interface{} // _id of the inserted document
+}
+
+// WriteError reports the failure of a single document or statement of a
+// write. Errors that fail the whole request are returned by the handler
+// instead.
+type WriteError struct {
+	Index   int32 // index of the document or statement in the request
+	Code    ErrorCode
+	Message string
+}
+
+// WriteResult is the outcome of a write.
+type WriteResult struct {
+	N           int32 // documents inserted, matched by updates or deleted
+	NModified   int32 // documents modified by updates
+	Upserted    []Upserted
+	WriteErrors []WriteError
+}
+
+// InsertHandler, UpdateHandler and DeleteHandler apply writes. ctx is
+// cancelled when the request completes, the client disconnects, the server
+// shuts down or the maxTimeMS of the command elapses.
+type (
+	InsertHandler func(ctx context.Context, req *InsertRequest) (*WriteResult, error)
+	UpdateHandler func(ctx context.Context, req *UpdateRequest) (*WriteResult, error)
+	DeleteHandler func(ctx context.Context, req *DeleteRequest) (*WriteResult, error)
+)
+
+// readOnly tells if the server has no write handlers.
+func (s *Server) readOnly() bool {
+	return s.InsertHandler == nil && s.UpdateHandler == nil && s.DeleteHandler == nil
+}
+
+// checkWritable fails writes on replica set secondaries.
+func (s *Server) checkWritable() error {
+	if opts, _, _ := s.hello(); !opts.writable() {
+		return Errorf(ErrorCodeNotWritablePrimary, "not primary")
+	}
+	return nil
+}
+
+// checkWritable fails legacy writes of connections that must authenticate or
+// are not authorized, and writes to a server that is not writable.
+func (c *client) checkWritable(ctx context.Context, action, namespace string) error {
+	if err := c.checkAuthenticated(); err != nil {
+		return err
+	}
+	if err := c.authorize(ctx, action, namespace); err != nil {
+		return err
+	}
+	return c.server.checkWritable()
+}
+
+func errWriteNotSupported(name string) error {
+	return Errorf(ErrorCodeCommandNotSupported, "%s is not supported by this server", name)
+}
+
+// writeReply builds the reply of a write command.
+func writeReply(res *WriteResult, update bool) bson.D {
+	if res == nil {
+		res = &WriteResult{}
+	}
+
+	reply := bson.D{{Key: "n", Value: res.N}}
+	if update {
+		reply = append(reply, bson.E{Key: "nModified", Value: res.NModified})
+	}
+	if len(res.Upserted) > 0 {
+		upserted := make(bson.A, len(res.Upserted))
+		for i, u := range res.Upserted {
+			upserted[i] = bson.D{{Key: "index", Value: u.Index}, {Key: "_id", Value: u.ID}}
+		}
+		reply = append(reply, bson.E{Key: "upserted", Value: upserted})
+	}
+	if len(res.WriteErrors) > 0 {
+		writeErrors := make(bson.A, len(res.WriteErrors))
+		for i, e := range res.WriteErrors {
+			writeErrors[i] = bson.D{
+				{Key: "index", Value: e.Index},
+				{Key: "code", Value: int32(e.Code)},
+				{Key: "errmsg", Value: e.Message},
+			}
+		}
+		reply = append(reply, bson.E{Key: "writeErrors", Value: writeErrors})
+	}
+	return reply
+}
+
+// ordered returns the value of the "ordered" argument of a write command,
+// which defaults to true.
+func ordered(v *bool) bool {
+	return v == nil || *v
+}
+
+// parseWriteCommand decodes the arguments of a write command into args and
+// returns the collection it targets.
+func parseWriteCommand(cmd *Command, args interface{}) (string, error) {
+	collection, ok := cmd.Argument().StringValueOK()
+	if !ok {
+		return "", Errorf(ErrorCodeInvalidNamespace, "collection name has invalid type")
+	}
+	if err := bson.Unmarshal(cmd.Doc, args); err != nil {
+		return "", &Error{Code: ErrorCodeFailedToParse, Message: err.Error()}
+	}
+	return collection, nil
+}
+
+type insertCommand struct {
+	Documents    []bson.Raw    `bson:"documents"`
+	Ordered      *bool         `bson:"ordered"`
+	WriteConcern *WriteConcern `bson:"writeConcern"`
+}
+
+func cmdInsert(ctx context.Context, cmd *Command) (bson.D, error) {
+	if err := cmd.client.server.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	handler := cmd.client.server.InsertHandler
+	if handler == nil {
+		return nil, errWriteNotSupported(cmd.Name)
+	}
+
+	var args insertCommand
+	collection, err := parseWriteCommand(cmd, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := handler(ctx, &InsertRequest{
+		Database:     cmd.Database,
+		Collection:   collection,
+		Documents:    args.Documents,
+		Ordered:      ordered(args.Ordered),
+		WriteConcern: args.WriteConcern,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return writeReply(res, false), nil
+}
+
+type updateCommand struct {
+	Updates      []UpdateStatement `bson:"updates"`
+	Ordered      *bool             `bson:"ordered"`
+	WriteConcern *WriteConcern     `bson:"writeConcern"`
+}
+
+func cmdUpdate(ctx context.Context, cmd *Command) (bson.D, error) {
+	if err := cmd.client.server.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	handler := cmd.client.server.UpdateHandler
+	if handler == nil {
+		return nil, errWriteNotSupported(cmd.Name)
+	}
+
+	var args updateCommand
+	collection, err := parseWriteCommand(cmd, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := handler(ctx, &UpdateRequest{
+		Database:     cmd.Database,
+		Collection:   collection,
+		Updates:      args.Updates,
+		Ordered:      ordered(args.Ordered),
+		WriteConcern: args.WriteConcern,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return writeReply(res, true), nil
+}
+
+type deleteCommand struct {
+	Deletes      []DeleteStatement `bson:"deletes"`
+	Ordered      *bool             `bson:"ordered"`
+	WriteConcern *WriteConcern     `bson:"writeConcern"`
+}
+
+func cmdDelete(ctx context.Context, cmd *Command) (bson.D, error) {
+	if err := cmd.client.server.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	handler := cmd.client.server.DeleteHandler
+	if handler == nil {
+		return nil, errWriteNotSupported(cmd.Name)
+	}
+
+	var args deleteCommand
+	collection, err := parseWriteCommand(cmd, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := handler(ctx, &DeleteRequest{
+		Database:     cmd.Database,
+		Collection:   collection,
+		Deletes:      args.Deletes,
+		Ordered:      ordered(args.Ordered),
+		WriteConcern: args.WriteConcern,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return writeReply(res, false), nil
+}
+
+// lastWrite is the outcome of the last legacy write of a connection,
+// reported by getLastError.
+type lastWrite struct {
+	res    *WriteResult
+	err    error
+	update bool
+}
+
+// Legacy OP_INSERT, OP_UPDATE and OP_DELETE messages have no reply. Drivers
+// acknowledge them with a getLastError sent right after the write, so a
+// legacy write is held back until the next message of the connection and
+// passed to the handler with the write concern of that getLastError, if it
+// is one. The outcome is recorded for getLastError.
+
+// legacyWrite applies a legacy write with the write concern acknowledging it.
+type legacyWrite func(ctx context.Context, wc *WriteConcern) *lastWrite
+
+// getLastErrorWait is how long a legacy write waits for the next message
+// of the connection before it is applied without a write concern.
+const getLastErrorWait = 50 * time.Millisecond
+
+// deferWrite holds back a legacy write until the next message of the
+// connection, applying the write held back before it.
+func (c *client) deferWrite(ctx context.Context, w legacyWrite) {
+	c.flushWrite(ctx, nil)
+	c.pendingWrite = w
+}
+
+// flushWrite applies the legacy write held back, if any, with write concern
+// wc.
+func (c *client) flushWrite(ctx context.Context, wc *WriteConcern) {
+	if w := c.pendingWrite; w != nil {
+		c.pendingWrite = nil
+		c.lastWrite = w(ctx, wc)
+	}
+}
+
+func (c *client) processInsert(ctx context.Context, insertOp *mongoproto.OpInsert) error {
+	c.deferWrite(ctx, func(ctx context.Context, wc *WriteConcern) *lastWrite {
+		return c.insert(ctx, insertOp, wc)
+	})
+	return nil
+}
+
+func (c *client) insert(ctx context.Context, insertOp *mongoproto.OpInsert, wc *WriteConcern) *lastWrite {
+	if err := c.checkWritable(ctx, ActionInsert, insertOp.FullCollectionName); err != nil {
+		return &lastWrite{err: err}
+	}
+
+	handler := c.server.InsertHandler
+	if handler == nil {
+		return &lastWrite{err: errWriteNotSupported("insert")}
+	}
+
+	req := &InsertRequest{
+		Documents:    make([]bson.Raw, len(insertOp.Documents)),
+		Ordered:      insertOp.Flags&mongoproto.OpInsertContinueOnError == 0,
+		WriteConcern: wc,
+	}
+	req.Database, req.Collection = splitNamespace(insertOp.FullCollectionName)
+	for i, doc := range insertOp.Documents {
+		req.Documents[i] = doc
+	}
+
+	res, err := handler(ctx, req)
+	return &lastWrite{res: res, err: c.requestError(ctx, err)}
+}
+
+func (c *client) processUpdate(ctx context.Context, updateOp *mongoproto.OpUpdate) error {
+	c.deferWrite(ctx, func(ctx context.Context, wc *WriteConcern) *lastWrite {
+		return c.update(ctx, updateOp, wc)
+	})
+	return nil
+}
+
+func (c *client) update(ctx context.Context, updateOp *mongoproto.OpUpdate, wc *WriteConcern) *lastWrite {
+	if err := c.checkWritable(ctx, ActionUpdate, updateOp.FullCollectionName); err != nil {
+		return &lastWrite{err: err, update: true}
+	}
+
+	handler := c.server.UpdateHandler
+	if handler == nil {
+		return &lastWrite{err: errWriteNotSupported("update"), update: true}
+	}
+
+	stmt := UpdateStatement{
+		Update: bson.RawValue{Type: bson.TypeEmbeddedDocument, Value: updateOp.Update},
+		Upsert: updateOp.Flags&mongoproto.OpUpdateUpsert != 0,
+		Multi:  updateOp.Flags&mongoproto.OpUpdateMuli != 0,
+	}
+	if err := bson.Unmarshal(updateOp.Selector, &stmt.Filter); err != nil {
+		return &lastWrite{err: &Error{Code: ErrorCodeFailedToParse, Message: err.Error()}, update: true}
+	}
+
+	req := &UpdateRequest{
+		Updates:      []UpdateStatement{stmt},
+		Ordered:      true,
+		WriteConcern: wc,
+	}
+	req.Database, req.Collection = splitNamespace(updateOp.FullCollectionName)
+
+	res, err := handler(ctx, req)
+	return &lastWrite{res: res, err: c.requestError(ctx, err), update: true}
+}
+
+func (c *client) processDelete(ctx context.Context, deleteOp *mongoproto.OpDelete) error {
+	c.deferWrite(ctx, func(ctx context.Context, wc *WriteConcern) *lastWrite {
+		return c.delete(ctx, deleteOp, wc)
+	})
+	return nil
+}
+
+func (c *client) delete(ctx context.Context, deleteOp *mongoproto.OpDelete, wc *WriteConcern) *lastWrite {
+	if err := c.checkWritable(ctx, ActionDelete, deleteOp.FullCollectionName); err != nil {
+		return &lastWrite{err: err}
+	}
+
+	handler := c.server.DeleteHandler
+	if handler == nil {
+		return &lastWrite{err: errWriteNotSupported("delete")}
+	}
+
+	stmt := DeleteStatement{}
+	if deleteOp.Flags&mongoproto.OpDeleteSingleRemove != 0 {
+		stmt.Limit = 1
+	}
+	if err := bson.Unmarshal(deleteOp.Selector, &stmt.Filter); err != nil {
+		return &lastWrite{err: &Error{Code: ErrorCodeFailedToParse, Message: err.Error()}}
+	}
+
+	req := &DeleteRequest{
+		Deletes:      []DeleteStatement{stmt},
+		Ordered:      true,
+		WriteConcern: wc,
+	}
+	req.Database, req.Collection = splitNamespace(deleteOp.FullCollectionName)
+
+	res, err := handler(ctx, req)
+	return &lastWrite{res: res, err: c.requestError(ctx, err)}
+}
+
+type getLastErrorCommand struct {
+	W        interface{} `bson:"w"`
+	J        bool        `bson:"j"`
+	FSync    bool        `bson:"fsync"`
+	WTimeout int64       `bson:"wtimeout"`
+}
+
+// getLastErrorConcern returns the write concern of op if it is a
+// getLastError command specifying one.
+func getLastErrorConcern(op mongoproto.Op) *WriteConcern {
+	var cmd *Command
+	var err error
+	switch v := op.(type) {
+	case *mongoproto.OpQuery:
+		if !isCommandNamespace(v.FullCollectionName) {
+			return nil
+		}
+		cmd, err = parseQueryCommand(v)
+	case *mongoproto.OpMsgV2:
+		cmd, err = parseMsgCommand(v)
+	default:
+		return nil
+	}
+	if err != nil || (cmd.Name != "getLastError" && cmd.Name != "getlasterror") {
+		return nil
+	}
+
+	var args getLastErrorCommand
+	if err := bson.Unmarshal(cmd.Doc, &args); err != nil {
+		return nil
+	}
+	if args.W == nil && !args.J && !args.FSync && args.WTimeout == 0 {
+		return nil
+	}
+	return &WriteConcern{
+		W:        args.W,
+		J:        args.J || args.FSync,
+		WTimeout: args.WTimeout,
+	}
+}
+
+// cmdGetLastError reports the outcome of the last legacy write of the
+// connection. A write concern error returned by the handler is reported as
+// a wtimeout.
+func cmdGetLastError(ctx context.Context, cmd *Command) (bson.D, error) {
+	reply := bson.D{}
+	last := cmd.client.lastWrite
+	if last == nil {
+		last = &lastWrite{}
+	}
+	res := last.res
+	if res == nil {
+		res = &WriteResult{}
+	}
+
+	// Like mongod, report the last error of the write
+	var lastErr *Error
+	if last.err != nil {
+		lastErr = asError(last.err)
+	} else if len(res.WriteErrors) > 0 {
+		e := res.WriteErrors[len(res.WriteErrors)-1]
+		lastErr = &Error{Code: e.Code, Message: e.Message}
+	}
+	if lastErr != nil {
+		reply = append(reply,
+			bson.E{Key: "err", Value: lastErr.Message},
+			bson.E{Key: "code", Value: int32(lastErr.Code)},
+			bson.E{Key: "codeName", Value: lastErr.Code.String()},
+		)
+	} else {
+		reply = append(reply, bson.E{Key: "err", Value: nil})
+	}
+
+	reply = append(reply, bson.E{Key: "n", Value: res.N})
+	if last.update {
+		reply = append(reply, bson.E{Key: "updatedExisting", Value: res.N > int32(len(res.Upserted))})
+	}
+	if len(res.Upserted) > 0 {
+		reply = append(reply, bson.E{Key: "upserted", Value: res.Upserted[0].ID})
+	}
+	reply = append(reply, bson.E{Key: "wtimeout", Value: lastErr != nil && lastErr.Code == ErrorCodeWriteConcernFailed})
+
+	return reply, nil
+}
@@ -22,7 +22,7 @@ func NewCursor(slice interface{}) (*Cursor, error) {
 	case reflect.Slice:
 	case reflect.Array:
 	default:
-		return nil, fmt.Errorf("%T is not a slice or array")
+		return nil, fmt.Errorf("%T is not a slice or array", slice)
 	}
 
 	return &Cursor{slice: val, length: int32(val.Len())}, nil
@@ -0,0 +1,183 @@
+package slice
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/orktes/mongache/pkg/match"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Dataset is a read-only collection of the elements of a slice, marshalled
+// to BSON documents. Queries use the indexes of the dataset to look up the
+// documents matching equality and range conditions and to return them in
+// order without sorting.
+type Dataset struct {
+	docs []bson.Raw
+
+	mu      sync.RWMutex
+	indexes []*index
+}
+
+// NewDataset returns a dataset of the elements of a slice.
+func NewDataset(slice interface{}) (*Dataset, error) {
+	val := reflect.ValueOf(slice)
+
+	switch val.Kind() {
+	case reflect.Slice:
+	case reflect.Array:
+	default:
+		return nil, fmt.Errorf("%T is not a slice or array", slice)
+	}
+
+	docs := make([]bson.Raw, val.Len())
+	for i := range docs {
+		doc, err := toDocument(val.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = doc
+	}
+	return &Dataset{docs: docs}, nil
+}
+
+// Len returns the number of documents of the dataset.
+func (d *Dataset) Len() int {
+	return len(d.docs)
+}
+
+// CreateIndex builds an index. Creating an index identical to an existing
+// one does nothing.
+func (d *Dataset) CreateIndex(model IndexModel) error {
+	d.mu.RLock()
+	for _, idx := range d.indexes {
+		if idx.model.Name == model.Name {
+			d.mu.RUnlock()
+			if !reflect.DeepEqual(idx.model, model) {
+				return fmt.Errorf("%w: %s", ErrIndexConflict, model.Name)
+			}
+			return nil
+		}
+	}
+	d.mu.RUnlock()
+
+	idx, err := newIndex(d.docs, model)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, other := range d.indexes {
+		if other.model.Name == model.Name {
+			return fmt.Errorf("%w: %s", ErrIndexConflict, model.Name)
+		}
+	}
+	d.indexes = append(d.indexes, idx)
+	return nil
+}
+
+// DropIndex removes the index name.
+func (d *Dataset) DropIndex(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, idx := range d.indexes {
+		if idx.model.Name == name {
+			d.indexes = append(d.indexes[:i:i], d.indexes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrIndexNotFound, name)
+}
+
+// DropIndexes removes all the indexes.
+func (d *Dataset) DropIndexes() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.indexes = nil
+}
+
+// Indexes returns the indexes of the dataset in creation order.
+func (d *Dataset) Indexes() []IndexModel {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	models := make([]IndexModel, len(d.indexes))
+	for i, idx := range d.indexes {
+		models[i] = idx.model
+	}
+	return models
+}
+
+// plan returns the best plan of a query, nil for a collection scan.
+func (d *Dataset) plan(filter interface{}, sortKeys []sortKey) (*plan, error) {
+	bounds, err := filterBounds(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var best *plan
+	for _, idx := range d.indexes {
+		if p := planIndex(idx, bounds, sortKeys); p != nil && p.better(best) {
+			best = p
+		}
+	}
+	return best, nil
+}
+
+// Explain returns the name of the index a query would use, or an empty
+// string when it would scan the whole dataset.
+func (d *Dataset) Explain(filter interface{}, sortBy bson.D) (string, error) {
+	keys, err := parseSort(sortBy)
+	if err != nil {
+		return "", err
+	}
+	p, err := d.plan(filter, keys)
+	if err != nil || p == nil {
+		return "", err
+	}
+	return p.index.model.Name, nil
+}
+
+// Find returns a cursor over the documents matching filter, ordered by sort
+// and projected with projection, like NewQueryCursor.
+func (d *Dataset) Find(filter, projection interface{}, sortBy bson.D) (*Cursor, error) {
+	matcher, err := match.Compile(filter)
+	if err != nil {
+		return nil, err
+	}
+	proj, err := newProjection(projection)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseSort(sortBy)
+	if err != nil {
+		return nil, err
+	}
+	p, err := d.plan(filter, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []bson.Raw
+	if p != nil {
+		for _, pos := range p.positions() {
+			if matcher.MatchRaw(d.docs[pos]) {
+				docs = append(docs, d.docs[pos])
+			}
+		}
+	} else {
+		for _, doc := range d.docs {
+			if matcher.MatchRaw(doc) {
+				docs = append(docs, doc)
+			}
+		}
+	}
+
+	if len(keys) > 0 && (p == nil || !p.sorted) {
+		sortDocuments(docs, keys)
+	}
+	return newResultCursor(docs, proj)
+}
@@ -0,0 +1,67 @@
+package slice_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/orktes/mongache/pkg/slice"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDatasetIndexes(t *testing.T) {
+	ds, err := slice.NewDataset(people)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, model := range []slice.IndexModel{
+		{Name: "age_1_name_-1", Key: bson.D{{Key: "age", Value: 1}, {Key: "name", Value: -1}}},
+		{Name: "tags_1", Key: bson.D{{Key: "tags", Value: 1}}},
+		{Name: "pets.kind_1", Key: bson.D{{Key: "pets.kind", Value: 1}}, Sparse: true},
+		{Name: "name_1", Key: bson.D{{Key: "name", Value: 1}}, Unique: true},
+	} {
+		assert.NoError(t, ds.CreateIndex(model))
+	}
+	assert.NoError(t, ds.CreateIndex(slice.IndexModel{Name: "name_1", Key: bson.D{{Key: "name", Value: 1}}, Unique: true}))
+	assert.True(t, errors.Is(ds.CreateIndex(slice.IndexModel{Name: "name_1", Key: bson.D{{Key: "age", Value: 1}}}), slice.ErrIndexConflict))
+	assert.True(t, errors.Is(ds.CreateIndex(slice.IndexModel{Name: "age_1", Key: bson.D{{Key: "age", Value: 1}}, Unique: true}), slice.ErrDuplicateKey))
+
+	tests := []struct {
+		filter bson.M
+		sort   bson.D
+		index  string
+		want   []int32
+	}{
+		{nil, nil, "", []int32{1, 2, 3, 4}},
+		{bson.M{"age": 42}, nil, "age_1_name_-1", []int32{3, 1}},
+		{bson.M{"age": 42, "name": "alice"}, nil, "age_1_name_-1", []int32{1}},
+		{bson.M{"age": bson.M{"$gte": 30}}, bson.D{{Key: "age", Value: 1}, {Key: "name", Value: -1}}, "age_1_name_-1", []int32{4, 3, 1}},
+		{bson.M{"age": bson.M{"$gt": 17, "$lt": 42}}, nil, "age_1_name_-1", []int32{4}},
+		{bson.M{"age": bson.M{"$lte": 30.5}}, bson.D{{Key: "age", Value: -1}, {Key: "name", Value: 1}}, "age_1_name_-1", []int32{4, 2}},
+		{bson.M{"age": bson.M{"$in": bson.A{17, 30.5}}}, nil, "age_1_name_-1", []int32{2, 4}},
+		{bson.M{"tags": "b"}, bson.D{{Key: "name", Value: -1}}, "tags_1", []int32{2, 1}},
+		{bson.M{"tags": bson.M{"$gt": "a", "$lt": "c"}}, nil, "tags_1", []int32{1, 2}},
+		{bson.M{"pets.kind": "dog"}, nil, "pets.kind_1", []int32{3}},
+		{bson.M{"name": bson.M{"$gt": "b"}, "age": 42}, nil, "age_1_name_-1", []int32{3}},
+		{bson.M{"name": bson.M{"$gt": "b"}}, nil, "name_1", []int32{2, 3, 4}},
+		{nil, bson.D{{Key: "name", Value: -1}}, "name_1", []int32{4, 3, 2, 1}},
+		{nil, bson.D{{Key: "pets.kind", Value: 1}}, "", []int32{1, 2, 4, 3}},
+		{bson.M{"age": nil}, nil, "", []int32{}},
+	}
+
+	for _, test := range tests {
+		index, err := ds.Explain(test.filter, test.sort)
+		assert.NoError(t, err)
+		assert.Equal(t, test.index, index, "%v %v", test.filter, test.sort)
+
+		cur, err := ds.Find(test.filter, nil, test.sort)
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.want, ids(readAll(t, cur)), "%v %v", test.filter, test.sort)
+		}
+	}
+
+	assert.NoError(t, ds.DropIndex("tags_1"))
+	assert.True(t, errors.Is(ds.DropIndex("tags_1"), slice.ErrIndexNotFound))
+	assert.Len(t, ds.Indexes(), 3)
+}
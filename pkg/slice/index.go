@@ -0,0 +1,409 @@
+package slice
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/orktes/mongache/pkg/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+var (
+	// ErrDuplicateKey is returned when a unique index can't be built
+	// because two documents have the same key.
+	ErrDuplicateKey = errors.New("slice: duplicate key")
+	// ErrIndexNotFound is returned when dropping an unknown index.
+	ErrIndexNotFound = errors.New("slice: index not found")
+	// ErrIndexConflict is returned when creating an index with the name of
+	// an existing index but a different key or options.
+	ErrIndexConflict = errors.New("slice: index already exists with different options")
+)
+
+// IndexModel describes an index. Its fields match server.IndexModel.
+type IndexModel struct {
+	Name   string `bson:"name"`
+	Key    bson.D `bson:"key"` // fields and their directions, 1 or -1
+	Unique bool   `bson:"unique,omitempty"`
+	Sparse bool   `bson:"sparse,omitempty"`
+}
+
+// index is an ordered index over the documents of a dataset.
+type index struct {
+	model    IndexModel
+	keys     []sortKey
+	entries  []indexEntry
+	multikey bool // some document has several keys
+}
+
+// indexEntry is a key of a document.
+type indexEntry struct {
+	key []bson.RawValue
+	pos int // position of the document in the dataset
+}
+
+var nullValue = bson.RawValue{Type: bsontype.Null}
+
+// indexKeys returns the keys of a document: one per combination of the
+// values of the fields, array elements being indexed separately. It reports
+// false when the document has none of the fields.
+func indexKeys(doc bson.Raw, keys []sortKey) ([][]bson.RawValue, bool) {
+	found := false
+	combos := [][]bson.RawValue{nil}
+	for _, key := range keys {
+		var values []bson.RawValue
+		for _, v := range match.Lookup(doc, key.path) {
+			switch v.Type {
+			case 0:
+				values = append(values, nullValue)
+				continue
+			case bsontype.Array:
+				elems, _ := v.Array().Values()
+				if len(elems) == 0 {
+					// Sorted like an empty array by sortValue
+					values = append(values, bson.RawValue{Type: bsontype.MinKey})
+				}
+				values = append(values, elems...)
+			default:
+				values = append(values, v)
+			}
+			found = true
+		}
+		if len(values) == 0 {
+			values = []bson.RawValue{nullValue}
+		}
+
+		next := make([][]bson.RawValue, 0, len(combos)*len(values))
+		for _, combo := range combos {
+			for _, v := range values {
+				next = append(next, append(combo[:len(combo):len(combo)], v))
+			}
+		}
+		combos = next
+	}
+	return combos, found
+}
+
+// compareKeys compares the first len(b) fields of key a to b in the order of
+// the index.
+func compareKeys(a, b []bson.RawValue, keys []sortKey) int {
+	for i := range b {
+		c := match.Compare(a[i], b[i])
+		if keys[i].descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func newIndex(docs []bson.Raw, model IndexModel) (*index, error) {
+	if len(model.Key) == 0 {
+		return nil, fmt.Errorf("slice: index %s has no key", model.Name)
+	}
+	keys, err := parseSort(model.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &index{model: model, keys: keys}
+	for pos, doc := range docs {
+		combos, found := indexKeys(doc, keys)
+		if !found && model.Sparse {
+			continue
+		}
+		if len(combos) > 1 {
+			idx.multikey = true
+		}
+		for _, key := range combos {
+			idx.entries = append(idx.entries, indexEntry{key: key, pos: pos})
+		}
+	}
+
+	sort.SliceStable(idx.entries, func(i, j int) bool {
+		return compareKeys(idx.entries[i].key, idx.entries[j].key, keys) < 0
+	})
+
+	if model.Unique {
+		for i := 1; i < len(idx.entries); i++ {
+			prev, cur := idx.entries[i-1], idx.entries[i]
+			if prev.pos != cur.pos && compareKeys(prev.key, cur.key, keys) == 0 {
+				return nil, fmt.Errorf("%w: index %s, key %v", ErrDuplicateKey, model.Name, cur.key)
+			}
+		}
+	}
+	return idx, nil
+}
+
+// bound is an end of a range of values.
+type bound struct {
+	value     bson.RawValue
+	inclusive bool
+}
+
+// fieldBounds are the values of a field a filter can match: points, or a
+// range with optional ends.
+type fieldBounds struct {
+	points       []bson.RawValue
+	lower, upper *bound
+}
+
+// indexable tells if equality to v can be looked up from an index. Null
+// matches missing fields and regular expressions and arrays don't compare
+// by value.
+func indexable(v bson.RawValue) bool {
+	switch v.Type {
+	case bsontype.Null, bsontype.Undefined, bsontype.Regex, bsontype.Array:
+		return false
+	}
+	return true
+}
+
+// filterBounds returns the bounds of the top-level fields of a filter. The
+// bounds may be wider than the filter, which is still applied to the
+// documents they select.
+func filterBounds(filter interface{}) (map[string]*fieldBounds, error) {
+	bounds := map[string]*fieldBounds{}
+	if filter == nil {
+		return bounds, nil
+	}
+
+	doc, err := toDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, elem := range elems {
+		key, value := elem.Key(), elem.Value()
+		if strings.HasPrefix(key, "$") {
+			continue
+		}
+
+		b := &fieldBounds{}
+		ops, isDoc := value.DocumentOK()
+		if !isDoc || !isOperator(ops) {
+			if indexable(value) {
+				b.points = []bson.RawValue{value}
+				bounds[key] = b
+			}
+			continue
+		}
+
+		opElems, err := ops.Elements()
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range opElems {
+			v := op.Value()
+			switch op.Key() {
+			case "$eq":
+				if indexable(v) {
+					b.points = []bson.RawValue{v}
+				}
+			case "$in":
+				arr, ok := v.ArrayOK()
+				if !ok {
+					continue
+				}
+				points, _ := arr.Values()
+				for _, p := range points {
+					if !indexable(p) {
+						points = nil
+						break
+					}
+				}
+				if points != nil {
+					b.points = points
+				}
+			case "$gt", "$gte":
+				if indexable(v) {
+					b.lower = &bound{value: v, inclusive: op.Key() == "$gte"}
+				}
+			case "$lt", "$lte":
+				if indexable(v) {
+					b.upper = &bound{value: v, inclusive: op.Key() == "$lte"}
+				}
+			}
+		}
+		if b.points != nil || b.lower != nil || b.upper != nil {
+			bounds[key] = b
+		}
+	}
+	return bounds, nil
+}
+
+func isOperator(doc bson.Raw) bool {
+	elems, err := doc.Elements()
+	return err == nil && len(elems) > 0 && strings.HasPrefix(elems[0].Key(), "$")
+}
+
+// keyRange is a range of index keys, in the order of the index. Only the
+// last field of start and end may be exclusive.
+type keyRange struct {
+	start, end                   []bson.RawValue
+	startInclusive, endInclusive bool
+}
+
+// plan is the way a query reads a dataset.
+type plan struct {
+	index     *index
+	ranges    []keyRange
+	bounded   int  // number of fields of the index bounded by the filter
+	equality  int  // number of leading fields bounded to points
+	sorted    bool // the index returns the documents in the requested order
+	backwards bool // the index is read backwards for the requested order
+}
+
+// planIndex returns the plan of a query using idx, nil when the index can't
+// answer it.
+func planIndex(idx *index, bounds map[string]*fieldBounds, sortKeys []sortKey) *plan {
+	p := &plan{index: idx, ranges: []keyRange{{startInclusive: true, endInclusive: true}}}
+
+	for i, key := range idx.keys {
+		b, ok := bounds[key.path]
+		if !ok {
+			break
+		}
+		p.bounded++
+
+		if b.points != nil {
+			points := append([]bson.RawValue(nil), b.points...)
+			sort.SliceStable(points, func(i, j int) bool {
+				c := match.Compare(points[i], points[j])
+				if key.descending {
+					c = -c
+				}
+				return c < 0
+			})
+
+			ranges := make([]keyRange, 0, len(p.ranges)*len(points))
+			for _, r := range p.ranges {
+				for j, point := range points {
+					if j > 0 && match.Equal(point, points[j-1]) {
+						continue
+					}
+					ranges = append(ranges, keyRange{
+						start:          append(r.start[:i:i], point),
+						end:            append(r.end[:i:i], point),
+						startInclusive: true,
+						endInclusive:   true,
+					})
+				}
+			}
+			p.ranges = ranges
+			p.equality++
+			continue
+		}
+
+		lower, upper := b.lower, b.upper
+		if idx.multikey && lower != nil && upper != nil {
+			// Different elements of an array may satisfy each end
+			upper = nil
+		}
+		if key.descending {
+			lower, upper = upper, lower
+		}
+		for j := range p.ranges {
+			r := &p.ranges[j]
+			if lower != nil {
+				r.start = append(r.start[:i:i], lower.value)
+				r.startInclusive = lower.inclusive
+			}
+			if upper != nil {
+				r.end = append(r.end[:i:i], upper.value)
+				r.endInclusive = upper.inclusive
+			}
+		}
+		break
+	}
+
+	p.sorted = len(sortKeys) == 0
+	if !p.sorted && !idx.multikey && len(p.ranges) == 1 {
+		p.sorted, p.backwards = providesSort(idx.keys, p.equality, sortKeys)
+	}
+
+	if p.bounded == 0 && (!p.sorted || len(sortKeys) == 0 || idx.model.Sparse) {
+		return nil
+	}
+	return p
+}
+
+// providesSort tells if the fields of an index following its first skip
+// fields are in the order of sortKeys, and if they are reversed.
+func providesSort(keys []sortKey, skip int, sortKeys []sortKey) (bool, bool) {
+	if len(keys)-skip < len(sortKeys) {
+		return false, false
+	}
+
+	backwards := false
+	for i, sk := range sortKeys {
+		key := keys[skip+i]
+		if key.path != sk.path {
+			return false, false
+		}
+		reversed := key.descending != sk.descending
+		if i == 0 {
+			backwards = reversed
+		} else if reversed != backwards {
+			return false, false
+		}
+	}
+	return true, backwards
+}
+
+// better tells if plan a is preferred to plan b.
+func (p *plan) better(other *plan) bool {
+	if other == nil {
+		return true
+	}
+	if p.bounded != other.bounded {
+		return p.bounded > other.bounded
+	}
+	return p.sorted && !other.sorted
+}
+
+// positions returns the positions of the documents in the ranges of the
+// plan, in index order.
+func (p *plan) positions() []int {
+	entries := p.index.entries
+	keys := p.index.keys
+
+	var positions []int
+	seen := map[int]struct{}{}
+	for _, r := range p.ranges {
+		from := sort.Search(len(entries), func(i int) bool {
+			c := compareKeys(entries[i].key, r.start, keys)
+			return c > 0 || (c == 0 && r.startInclusive)
+		})
+		to := sort.Search(len(entries), func(i int) bool {
+			c := compareKeys(entries[i].key, r.end, keys)
+			return c > 0 || (c == 0 && !r.endInclusive)
+		})
+
+		if to < from {
+			to = from
+		}
+		for _, e := range entries[from:to] {
+			if _, ok := seen[e.pos]; ok {
+				continue
+			}
+			seen[e.pos] = struct{}{}
+			positions = append(positions, e.pos)
+		}
+	}
+
+	if p.backwards {
+		for i, j := 0, len(positions)-1; i < j; i, j = i+1, j-1 {
+			positions[i], positions[j] = positions[j], positions[i]
+		}
+	}
+	return positions
+}
@@ -0,0 +1,456 @@
+package slice
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/orktes/mongache/pkg/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// NewQueryCursor returns a cursor over the elements of a slice matching
+// filter, ordered by sort and projected with projection, like a collection
+// answering a find. Elements are marshalled to BSON documents; filter and
+// projection are documents such as bson.M, and may be nil.
+func NewQueryCursor(slice interface{}, filter, projection interface{}, sortBy bson.D) (*Cursor, error) {
+	val := reflect.ValueOf(slice)
+
+	switch val.Kind() {
+	case reflect.Slice:
+	case reflect.Array:
+	default:
+		return nil, fmt.Errorf("%T is not a slice or array", slice)
+	}
+
+	matcher, err := match.Compile(filter)
+	if err != nil {
+		return nil, err
+	}
+	proj, err := newProjection(projection)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseSort(sortBy)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []bson.Raw
+	for i := 0; i < val.Len(); i++ {
+		doc, err := toDocument(val.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		if matcher.MatchRaw(doc) {
+			docs = append(docs, doc)
+		}
+	}
+
+	if len(keys) > 0 {
+		sortDocuments(docs, keys)
+	}
+	return newResultCursor(docs, proj)
+}
+
+// newResultCursor returns a cursor over the projected documents.
+func newResultCursor(docs []bson.Raw, proj *projection) (*Cursor, error) {
+	results := make([][]byte, len(docs))
+	for i, doc := range docs {
+		var err error
+		if results[i], err = proj.apply(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Cursor{slice: reflect.ValueOf(results), length: int32(len(results))}, nil
+}
+
+func toDocument(v interface{}) (bson.Raw, error) {
+	switch v := v.(type) {
+	case bson.Raw:
+		return v, nil
+	case []byte:
+		return bson.Raw(v), nil
+	}
+	return bson.Marshal(v)
+}
+
+// sortKey is a field of a sort specification.
+type sortKey struct {
+	path       string
+	descending bool
+}
+
+func parseSort(sortBy bson.D) ([]sortKey, error) {
+	keys := make([]sortKey, 0, len(sortBy))
+	for _, e := range sortBy {
+		var dir float64
+		switch v := e.Value.(type) {
+		case int:
+			dir = float64(v)
+		case int32:
+			dir = float64(v)
+		case int64:
+			dir = float64(v)
+		case float64:
+			dir = v
+		default:
+			return nil, fmt.Errorf("slice: unsupported sort value for %s: %v", e.Key, e.Value)
+		}
+		if dir != 1 && dir != -1 {
+			return nil, fmt.Errorf("slice: sort value for %s must be 1 or -1", e.Key)
+		}
+		keys = append(keys, sortKey{path: e.Key, descending: dir < 0})
+	}
+	return keys, nil
+}
+
+// sortValue returns the value a document is sorted by for a key: the
+// smallest of the values of the path, or the largest when descending.
+// Arrays are sorted by their elements, and empty arrays before null.
+func sortValue(doc bson.Raw, key sortKey) bson.RawValue {
+	var values []bson.RawValue
+	for _, v := range match.Lookup(doc, key.path) {
+		if v.Type != bsontype.Array {
+			values = append(values, v)
+			continue
+		}
+		elems, _ := v.Array().Values()
+		if len(elems) == 0 {
+			values = append(values, bson.RawValue{Type: bsontype.MinKey})
+		}
+		values = append(values, elems...)
+	}
+
+	var best bson.RawValue
+	for i, v := range values {
+		c := match.Compare(v, best)
+		if i == 0 || (key.descending && c > 0) || (!key.descending && c < 0) {
+			best = v
+		}
+	}
+	return best
+}
+
+func sortDocuments(docs []bson.Raw, keys []sortKey) {
+	values := make([][]bson.RawValue, len(docs))
+	for i, doc := range docs {
+		values[i] = make([]bson.RawValue, len(keys))
+		for j, key := range keys {
+			values[i][j] = sortValue(doc, key)
+		}
+	}
+
+	sort.Stable(documentSorter{docs: docs, values: values, keys: keys})
+}
+
+type documentSorter struct {
+	docs   []bson.Raw
+	values [][]bson.RawValue
+	keys   []sortKey
+}
+
+func (s documentSorter) Len() int { return len(s.docs) }
+
+func (s documentSorter) Swap(i, j int) {
+	s.docs[i], s.docs[j] = s.docs[j], s.docs[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+func (s documentSorter) Less(i, j int) bool {
+	for k, key := range s.keys {
+		c := match.Compare(s.values[i][k], s.values[j][k])
+		if key.descending {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+// projection is a compiled projection document.
+type projection struct {
+	include   bool // inclusion projection, only the named fields are kept
+	excludeID bool
+	root      *projectionNode
+}
+
+// projectionNode is a field of a projection. Leaves name included or
+// excluded fields, or apply $slice or $elemMatch.
+type projectionNode struct {
+	leaf      bool
+	slice     *sliceSpec
+	elemMatch *match.Matcher
+	children  map[string]*projectionNode
+}
+
+// sliceSpec is the argument of a $slice projection: limit elements after
+// skipping skip. Negative values count from the end of the array.
+type sliceSpec struct {
+	skip, limit int
+}
+
+func newProjection(spec interface{}) (*projection, error) {
+	p := &projection{root: &projectionNode{}}
+	if spec == nil {
+		return p, nil
+	}
+
+	doc, err := toDocument(spec)
+	if err != nil {
+		return nil, err
+	}
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	var included, excluded, elemMatch bool
+	for _, elem := range elems {
+		key, value := elem.Key(), elem.Value()
+		if strings.Contains(key, "$") {
+			return nil, fmt.Errorf("slice: unsupported projection of %s", key)
+		}
+
+		var node projectionNode
+		if op, ok := value.DocumentOK(); ok {
+			if err := node.parseOperator(key, op); err != nil {
+				return nil, err
+			}
+			elemMatch = elemMatch || node.elemMatch != nil
+		} else if key == "_id" {
+			p.excludeID = !truthy(value)
+			continue
+		} else {
+			node.leaf = true
+			if truthy(value) {
+				included = true
+			} else {
+				excluded = true
+			}
+		}
+
+		if err := p.root.add(strings.Split(key, "."), &node); err != nil {
+			return nil, err
+		}
+	}
+
+	if included && excluded {
+		return nil, fmt.Errorf("slice: projection cannot mix inclusion and exclusion")
+	}
+	if _, err := doc.LookupErr("_id"); err == nil && !p.excludeID && !excluded {
+		included = true
+	}
+	p.include = included || (elemMatch && !excluded)
+	return p, nil
+}
+
+func (node *projectionNode) parseOperator(key string, op bson.Raw) error {
+	elems, err := op.Elements()
+	if err != nil {
+		return err
+	}
+	if len(elems) != 1 {
+		return fmt.Errorf("slice: unsupported projection of %s", key)
+	}
+
+	value := elems[0].Value()
+	switch elems[0].Key() {
+	case "$slice":
+		node.slice, err = parseSlice(value)
+		return err
+	case "$elemMatch":
+		if strings.Contains(key, ".") {
+			return fmt.Errorf("slice: $elemMatch cannot be applied to the dotted field %s", key)
+		}
+		filter, ok := value.DocumentOK()
+		if !ok {
+			return fmt.Errorf("slice: $elemMatch of %s needs an object", key)
+		}
+		node.elemMatch, err = match.Compile(filter)
+		return err
+	}
+	return fmt.Errorf("slice: unsupported projection operator %s", elems[0].Key())
+}
+
+func parseSlice(value bson.RawValue) (*sliceSpec, error) {
+	if n, ok := asInt(value); ok {
+		if n < 0 {
+			return &sliceSpec{skip: n, limit: -n}, nil
+		}
+		return &sliceSpec{limit: n}, nil
+	}
+
+	if arr, ok := value.ArrayOK(); ok {
+		values, err := arr.Values()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 2 {
+			skip, ok1 := asInt(values[0])
+			limit, ok2 := asInt(values[1])
+			if ok1 && ok2 && limit > 0 {
+				return &sliceSpec{skip: skip, limit: limit}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("slice: $slice needs a number or an array of a skip and a positive limit")
+}
+
+func asInt(v bson.RawValue) (int, bool) {
+	switch v.Type {
+	case bsontype.Int32:
+		return int(v.Int32()), true
+	case bsontype.Int64:
+		return int(v.Int64()), true
+	case bsontype.Double:
+		return int(v.Double()), true
+	}
+	return 0, false
+}
+
+// truthy tells if a projection value includes a field.
+func truthy(v bson.RawValue) bool {
+	switch v.Type {
+	case bsontype.Boolean:
+		return v.Boolean()
+	case bsontype.Int32:
+		return v.Int32() != 0
+	case bsontype.Int64:
+		return v.Int64() != 0
+	case bsontype.Double:
+		return v.Double() != 0
+	}
+	return true
+}
+
+// add adds the node of a dotted path.
+func (node *projectionNode) add(path []string, leaf *projectionNode) error {
+	if node.children == nil {
+		node.children = map[string]*projectionNode{}
+	}
+
+	child, ok := node.children[path[0]]
+	if len(path) == 1 {
+		if ok {
+			return fmt.Errorf("slice: projection path collision at %s", path[0])
+		}
+		node.children[path[0]] = leaf
+		return nil
+	}
+
+	if !ok {
+		child = &projectionNode{}
+		node.children[path[0]] = child
+	} else if child.children == nil {
+		return fmt.Errorf("slice: projection path collision at %s", path[0])
+	}
+	return child.add(path[1:], leaf)
+}
+
+func (p *projection) apply(doc bson.Raw) ([]byte, error) {
+	if p.root.children == nil && !p.excludeID && !p.include {
+		return doc, nil
+	}
+	return bson.Marshal(p.project(doc, p.root, true))
+}
+
+// project applies the fields of node to a document.
+func (p *projection) project(doc bson.Raw, node *projectionNode, top bool) bson.D {
+	elems, _ := doc.Elements()
+
+	out := bson.D{}
+	for _, elem := range elems {
+		key, value := elem.Key(), elem.Value()
+
+		child := node.children[key]
+		if top && key == "_id" && child == nil {
+			if !p.excludeID {
+				out = append(out, bson.E{Key: key, Value: value})
+			}
+			continue
+		}
+		if child == nil {
+			if !p.include {
+				out = append(out, bson.E{Key: key, Value: value})
+			}
+			continue
+		}
+
+		if v, ok := p.projectValue(value, child); ok {
+			out = append(out, bson.E{Key: key, Value: v})
+		}
+	}
+	return out
+}
+
+// projectValue applies node to the value of a field. It reports false when
+// the field is left out.
+func (p *projection) projectValue(value bson.RawValue, node *projectionNode) (interface{}, bool) {
+	switch {
+	case node.slice != nil:
+		if value.Type != bsontype.Array {
+			return value, true
+		}
+		return node.slice.apply(value.Array()), true
+	case node.elemMatch != nil:
+		if value.Type != bsontype.Array {
+			return nil, false
+		}
+		elems, _ := value.Array().Values()
+		for _, elem := range elems {
+			if elem.Type == bsontype.EmbeddedDocument && node.elemMatch.MatchRaw(elem.Document()) {
+				return bson.A{elem}, true
+			}
+		}
+		return nil, false
+	case node.leaf:
+		return value, p.include
+	}
+
+	switch value.Type {
+	case bsontype.EmbeddedDocument:
+		return p.project(value.Document(), node, false), true
+	case bsontype.Array:
+		elems, _ := value.Array().Values()
+		out := bson.A{}
+		for _, elem := range elems {
+			if v, ok := p.projectValue(elem, node); ok && (elem.Type != bsontype.Array || !p.include) {
+				out = append(out, v)
+			}
+		}
+		return out, true
+	}
+	return value, !p.include
+}
+
+// apply slices an array.
+func (s *sliceSpec) apply(arr bson.Raw) bson.A {
+	elems, _ := arr.Values()
+
+	start := s.skip
+	if start < 0 {
+		start += len(elems)
+		if start < 0 {
+			start = 0
+		}
+	}
+	if start > len(elems) {
+		start = len(elems)
+	}
+	end := start + s.limit
+	if end > len(elems) {
+		end = len(elems)
+	}
+
+	out := make(bson.A, 0, end-start)
+	for _, elem := range elems[start:end] {
+		out = append(out, elem)
+	}
+	return out
+}
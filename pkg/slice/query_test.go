@@ -0,0 +1,101 @@
+package slice_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/orktes/mongache/pkg/slice"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var people = []bson.M{
+	{"_id": int32(1), "name": "alice", "age": int32(42), "tags": bson.A{"a", "b", "c"}, "address": bson.M{"city": "Helsinki", "zip": "00100"}},
+	{"_id": int32(2), "name": "bob", "age": int32(17), "tags": bson.A{"b"}, "address": bson.M{"city": "Espoo", "zip": "02100"}},
+	{"_id": int32(3), "name": "carol", "age": int32(42), "tags": bson.A{}, "pets": bson.A{bson.M{"kind": "cat", "age": int32(3)}, bson.M{"kind": "dog", "age": int32(5)}}},
+	{"_id": int32(4), "name": "dave", "age": 30.5},
+}
+
+func readAll(t *testing.T, cur *slice.Cursor) []bson.M {
+	var docs []bson.M
+	for {
+		v, err := cur.Next(context.Background())
+		if err == io.EOF {
+			return docs
+		}
+		if !assert.NoError(t, err) {
+			return docs
+		}
+
+		var doc bson.M
+		assert.NoError(t, bson.Unmarshal(v.([]byte), &doc))
+		docs = append(docs, doc)
+	}
+}
+
+func ids(docs []bson.M) []int32 {
+	res := []int32{}
+	for _, doc := range docs {
+		res = append(res, doc["_id"].(int32))
+	}
+	return res
+}
+
+func TestQueryCursorFilterAndSort(t *testing.T) {
+	tests := []struct {
+		filter bson.M
+		sort   bson.D
+		want   []int32
+	}{
+		{nil, nil, []int32{1, 2, 3, 4}},
+		{bson.M{"age": 42}, nil, []int32{1, 3}},
+		{bson.M{"age": bson.M{"$gte": 30}}, bson.D{{Key: "age", Value: 1}, {Key: "name", Value: -1}}, []int32{4, 3, 1}},
+		{bson.M{"tags": "b"}, bson.D{{Key: "name", Value: -1}}, []int32{2, 1}},
+		{nil, bson.D{{Key: "tags", Value: 1}, {Key: "_id", Value: 1}}, []int32{3, 4, 1, 2}},
+		{nil, bson.D{{Key: "tags", Value: -1}, {Key: "_id", Value: 1}}, []int32{1, 2, 4, 3}},
+		{nil, bson.D{{Key: "address.zip", Value: -1}}, []int32{2, 1, 3, 4}},
+	}
+
+	for _, test := range tests {
+		cur, err := slice.NewQueryCursor(people, test.filter, nil, test.sort)
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.want, ids(readAll(t, cur)), "%v %v", test.filter, test.sort)
+		}
+	}
+}
+
+func TestQueryCursorProjection(t *testing.T) {
+	tests := []struct {
+		projection bson.M
+		want       bson.M
+	}{
+		{bson.M{"name": 1}, bson.M{"_id": int32(3), "name": "carol"}},
+		{bson.M{"name": 1, "_id": 0}, bson.M{"name": "carol"}},
+		{bson.M{"_id": 1}, bson.M{"_id": int32(3)}},
+		{bson.M{"_id": 0, "pets": 0, "tags": 0, "age": false}, bson.M{"name": "carol"}},
+		{bson.M{"pets.kind": 1, "_id": 0}, bson.M{"pets": bson.A{bson.M{"kind": "cat"}, bson.M{"kind": "dog"}}}},
+		{bson.M{"pets.kind": 0, "_id": 0, "name": 0, "age": 0, "tags": 0}, bson.M{"pets": bson.A{bson.M{"age": int32(3)}, bson.M{"age": int32(5)}}}},
+		{bson.M{"pets": bson.M{"$slice": -1}, "name": 0, "_id": 0, "age": 0, "tags": 0}, bson.M{"pets": bson.A{bson.M{"kind": "dog", "age": int32(5)}}}},
+		{bson.M{"pets": bson.M{"$slice": bson.A{1, 5}}, "name": 1, "_id": 0}, bson.M{"name": "carol", "pets": bson.A{bson.M{"kind": "dog", "age": int32(5)}}}},
+		{bson.M{"pets": bson.M{"$elemMatch": bson.M{"age": bson.M{"$gt": 4}}}}, bson.M{"_id": int32(3), "pets": bson.A{bson.M{"kind": "dog", "age": int32(5)}}}},
+		{bson.M{"pets": bson.M{"$elemMatch": bson.M{"age": 9}}, "name": 1}, bson.M{"_id": int32(3), "name": "carol"}},
+	}
+
+	for _, test := range tests {
+		cur, err := slice.NewQueryCursor(people, bson.M{"_id": 3}, test.projection, nil)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []bson.M{test.want}, readAll(t, cur), "%v", test.projection)
+		}
+	}
+
+	for _, projection := range []bson.M{
+		{"name": 1, "age": 0},
+		{"pets": 1, "pets.kind": 1},
+		{"pets.$": 1},
+		{"pets": bson.M{"$slice": "x"}},
+	} {
+		_, err := slice.NewQueryCursor(people, nil, projection, nil)
+		assert.Error(t, err, "%v", projection)
+	}
+}